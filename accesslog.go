@@ -0,0 +1,65 @@
+package plugin_simplecache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// accessLogEntry is a single line of the cache decision access log.
+type accessLogEntry struct {
+	Time     time.Time `json:"time"`
+	Key      string    `json:"key"`
+	Decision string    `json:"decision"`
+	TTL      int       `json:"ttl"`
+	Size     int       `json:"size"`
+	Duration float64   `json:"duration"`
+}
+
+type accessLog struct {
+	mu    sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	clock clock
+}
+
+func newAccessLog(path string, clk clock) (*accessLog, error) {
+	f, err := os.OpenFile(filepath.Clean(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening access log: %w", err)
+	}
+
+	return &accessLog{f: f, enc: json.NewEncoder(f), clock: clk}, nil
+}
+
+// Write appends an entry to the log. The request duration is computed from start.
+func (l *accessLog) Write(start time.Time, key, decision string, ttl time.Duration, size int) error {
+	e := accessLogEntry{
+		Time:     start,
+		Key:      key,
+		Decision: decision,
+		TTL:      int(ttl.Seconds()),
+		Size:     size,
+		Duration: float64(l.clock.Now().Sub(start)) / float64(time.Millisecond),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.enc.Encode(e); err != nil {
+		return fmt.Errorf("error writing access log: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the log file.
+func (l *accessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
@@ -0,0 +1,382 @@
+package plugin_simplecache
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// AdminConfig configures the control endpoints, all served under Path and
+// protected the same way.
+type AdminConfig struct {
+	Path            string   `json:"path" yaml:"path" toml:"path"`
+	Tokens          []string `json:"tokens" yaml:"tokens" toml:"tokens"`
+	AllowedNetworks []string `json:"allowedNetworks" yaml:"allowedNetworks" toml:"allowedNetworks"`
+	RateLimit       float64  `json:"rateLimit" yaml:"rateLimit" toml:"rateLimit"`
+	Burst           int      `json:"burst" yaml:"burst" toml:"burst"`
+}
+
+const (
+	defaultAdminRateLimit = 1
+	defaultAdminBurst     = 10
+)
+
+// validate checks that the endpoints cannot be enabled without
+// authentication.
+func (c AdminConfig) validate() error {
+	if c.Path == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("invalid admin.path %q: must start with /", c.Path)
+	}
+
+	if len(c.Tokens) == 0 {
+		return errors.New("admin.path requires at least one of admin.tokens")
+	}
+
+	for _, token := range c.Tokens {
+		if token == "" {
+			return errors.New("admin.tokens must not be empty")
+		}
+	}
+
+	if _, err := parseNetworks(c.AllowedNetworks); err != nil {
+		return fmt.Errorf("admin.allowedNetworks: %w", err)
+	}
+
+	if c.RateLimit < 0 || c.Burst < 0 {
+		return errors.New("admin.rateLimit and admin.burst must not be negative")
+	}
+
+	return nil
+}
+
+type purgeResult struct {
+	Purged int `json:"purged"`
+}
+
+type maintenanceResult struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+type flushResult struct {
+	Deleted int `json:"deleted"`
+	Errors  int `json:"errors"`
+}
+
+// allow takes a token from b, or answers with a 429 and reports false if it is
+// empty.
+func (m *cache) allow(w http.ResponseWriter, b *tokenBucket) bool {
+	ok, wait := b.Allow(m.clock.Now())
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	}
+
+	return ok
+}
+
+// isAdmin reports whether r targets the control endpoints.
+func (m *cache) isAdmin(r *http.Request) bool {
+	return m.cfg.Admin.Path != "" && strings.HasPrefix(r.URL.Path, strings.TrimSuffix(m.cfg.Admin.Path, "/")+"/")
+}
+
+// serveAdmin authenticates r, then serves the control endpoint it targets.
+func (m *cache) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if len(m.adminNets) > 0 && !fromNetworks(r, m.adminNets) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if !m.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="simplecache"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	endpoint := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(m.cfg.Admin.Path, "/"))
+
+	// Limiting authenticated requests only keeps anonymous clients from using
+	// up the budget of the legitimate ones. Peers push every entry they store,
+	// and have a budget of their own.
+	if endpoint == "/entries" {
+		if m.allow(w, m.peerLimit) {
+			m.serveEntries(w, r)
+		}
+
+		return
+	}
+
+	if !m.allow(w, m.adminLimit) {
+		return
+	}
+
+	if endpoint == "/stats" || endpoint == "/export" {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		if endpoint == "/export" {
+			m.serveExport(w, r)
+		} else {
+			m.serveStats(w, r)
+		}
+
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	m.serveAction(w, r, endpoint)
+}
+
+// serveAction serves the POST endpoints.
+func (m *cache) serveAction(w http.ResponseWriter, r *http.Request, endpoint string) {
+	switch endpoint {
+	case "/purge":
+		m.servePurge(w, r)
+	case "/flush":
+		m.serveFlush(w, r)
+	case "/import":
+		m.serveImport(w, r)
+	case "/maintenance":
+		m.serveMaintenance(w, r)
+	case "/vacuum":
+		if !m.triggerVacuum() {
+			http.Error(w, "vacuum disabled", http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// triggerVacuum starts a vacuum pass of every storage. It reports false if the
+// vacuum is disabled.
+func (m *cache) triggerVacuum() bool {
+	var ok bool
+
+	for _, s := range m.stores() {
+		ok = s.TriggerVacuum() || ok
+	}
+
+	return ok
+}
+
+// adminAuthorized reports whether r carries one of the admin tokens as a
+// bearer token.
+func (m *cache) adminAuthorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+
+	got := []byte(auth[len(prefix):])
+
+	var ok bool
+	for _, token := range m.cfg.Admin.Tokens {
+		// Every token is compared, so that timing does not tell which matched.
+		if subtle.ConstantTimeCompare(got, []byte(token)) == 1 {
+			ok = true
+		}
+	}
+
+	return ok
+}
+
+// servePurge deletes the entries of the URL given by the url query parameter.
+// URLs without a host refer to the host of the request.
+func (m *cache) servePurge(w http.ResponseWriter, r *http.Request) {
+	u, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || u.Path == "" {
+		http.Error(w, "missing or invalid url parameter", http.StatusBadRequest)
+		return
+	}
+
+	host := u.Host
+	if host == "" {
+		host = r.Host
+	}
+
+	// Purges are scoped to a single tenant, named explicitly.
+	s := m.tenantStore(w, r)
+	if s == nil {
+		return
+	}
+
+	n, err := m.purge(s, r.URL.Query().Get("tenant"), host, u.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, purgeResult{Purged: n})
+}
+
+// purge deletes every stored variant of the responses to host and urlPath
+// from s, within the partition of tenant if the cache is partitioned. It
+// returns the number of entries deleted.
+func (m *cache) purge(s *volumeSet, tenant, host, urlPath string) (int, error) {
+	var n int
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		key := cacheKey(keyRequest(method, host, urlPath))
+		if m.partitioned() {
+			key = tenantKey(tenant, key)
+		}
+
+		for _, k := range []string{key, gzipKey(key)} {
+			if m.memory != nil {
+				m.memory.Delete(k)
+			}
+
+			// Peers may hold entries this instance does not.
+			m.replicator.Delete(k)
+
+			if !s.Has(k) {
+				continue
+			}
+
+			if err := s.Delete(k); err != nil {
+				return n, err
+			}
+
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// serveMaintenance enters or leaves maintenance mode, as given by the enabled
+// query parameter, until the next restart.
+func (m *cache) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	on, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "missing or invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+
+	if on && m.dryRun != nil {
+		http.Error(w, "dry runs always contact the origin", http.StatusConflict)
+		return
+	}
+
+	m.setMaintenance(on)
+	log.Printf("Maintenance mode set to %t", on)
+
+	writeJSON(w, http.StatusOK, maintenanceResult{Maintenance: on})
+}
+
+// serveFlush deletes every entry of the cache, or only the ones of the tenant
+// named by the tenant query parameter.
+func (m *cache) serveFlush(w http.ResponseWriter, r *http.Request) {
+	stores := m.stores()
+
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" {
+		s := m.tenantStore(w, r)
+		if s == nil {
+			return
+		}
+
+		stores = []*volumeSet{s}
+	}
+
+	var stats vacuumStats
+
+	for _, s := range stores {
+		st, err := s.Flush()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		stats.merge(st)
+	}
+
+	switch {
+	case m.memory == nil:
+	case tenant != "" && m.partitioned():
+		m.memory.DeletePrefix(tenantKey(tenant, ""))
+	default:
+		m.memory.Clear()
+	}
+
+	writeJSON(w, http.StatusOK, flushResult{Deleted: stats.Deleted, Errors: stats.Errors})
+}
+
+// serveExport streams a snapshot of the cache, or of the tenant named by the
+// tenant query parameter if the cache is partitioned. Once the response is
+// started, errors can only be reported by leaving the archive without its
+// trailer, which clients detect as a truncated archive.
+func (m *cache) serveExport(w http.ResponseWriter, r *http.Request) {
+	s := m.tenantStore(w, r)
+	if s == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="simplecache.tar.gz"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if _, err := s.Export(r.Context(), w); err != nil {
+		log.Printf("Error exporting the cache: %v", err)
+	}
+}
+
+// serveImport restores the snapshot sent as the request body, into the
+// storage of the tenant named by the tenant query parameter if the cache is
+// partitioned. Entries of the memory tier are left as they are, and expire on
+// their own.
+func (m *cache) serveImport(w http.ResponseWriter, r *http.Request) {
+	s := m.tenantStore(w, r)
+	if s == nil {
+		return
+	}
+
+	stats, err := s.Import(r.Context(), r.Body)
+	switch {
+	case errors.Is(err, errInvalidSnapshot):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func methodNotAllowed(w http.ResponseWriter, method string) {
+	w.Header().Set("Allow", method)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// writeJSON writes v as a JSON response which must not be stored.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, _ := json.Marshal(v)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(code)
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,211 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_ServeAdmin_Auth(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected origin request for %s", req.URL.Path)
+	}
+
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20",
+		Admin: AdminConfig{Path: "/_cache", Tokens: []string{"secret", "other"}, AllowedNetworks: []string{"192.0.2.0/24"}},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const stats, token = "/_cache/stats", "Bearer secret"
+
+	tests := []struct {
+		desc       string
+		method     string
+		path       string
+		auth       string
+		remoteAddr string
+		status     int
+	}{
+		{desc: "no token", method: http.MethodGet, path: stats, status: http.StatusUnauthorized},
+		{desc: "wrong token", method: http.MethodGet, path: stats, auth: "Bearer nope", status: http.StatusUnauthorized},
+		{desc: "basic auth", method: http.MethodGet, path: stats, auth: "Basic secret", status: http.StatusUnauthorized},
+		{desc: "token", method: http.MethodGet, path: stats, auth: token, status: http.StatusOK},
+		{desc: "other token", method: http.MethodGet, path: stats, auth: "bearer other", status: http.StatusOK},
+		{
+			desc: "network not allowed", method: http.MethodGet, path: stats, auth: token,
+			remoteAddr: "198.51.100.1:1234", status: http.StatusForbidden,
+		},
+		{
+			desc: "wrong method", method: http.MethodGet, path: "/_cache/flush", auth: token,
+			status: http.StatusMethodNotAllowed,
+		},
+		{desc: "unknown endpoint", method: http.MethodPost, path: "/_cache/nope", auth: token, status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "http://localhost"+test.path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if test.remoteAddr != "" {
+			req.RemoteAddr = test.remoteAddr
+		}
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s: unexpected status: want %d, got %d", test.desc, test.status, rw.Code)
+		}
+	}
+}
+
+func TestCache_ServeAdmin_Purge(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		Admin: AdminConfig{Path: "/_cache", Tokens: []string{"secret"}},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/a", "/b"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+	}
+
+	admin := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost"+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	rw := admin("/_cache/purge?url=/a")
+
+	var purged purgeResult
+	if err = json.Unmarshal(rw.Body.Bytes(), &purged); err != nil {
+		t.Fatal(err)
+	}
+
+	if purged.Purged != 1 {
+		t.Errorf("unexpected purged entries: want 1, got %d", purged.Purged)
+	}
+
+	rw = admin("/_cache/flush")
+
+	var flushed flushResult
+	if err = json.Unmarshal(rw.Body.Bytes(), &flushed); err != nil {
+		t.Fatal(err)
+	}
+
+	if flushed.Deleted != 1 {
+		t.Errorf("unexpected flushed entries: want 1, got %d", flushed.Deleted)
+	}
+
+	for _, p := range []string{"/a", "/b"} {
+		rw = httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != cacheMissStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", p, cacheMissStatus, state)
+		}
+	}
+
+	if rw = admin("/_cache/vacuum"); rw.Code != http.StatusAccepted {
+		t.Errorf("unexpected vacuum status: want %d, got %d", http.StatusAccepted, rw.Code)
+	}
+}
+
+func TestCache_ServeAdmin_RateLimit(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected origin request for %s", req.URL.Path)
+	}
+
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20",
+		Admin: AdminConfig{Path: "/_cache", Tokens: []string{"secret"}, RateLimit: 0.001, Burst: 2},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flush := func(auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/_cache/flush", nil)
+		req.Header.Set("Authorization", auth)
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	for i := 0; i < 2; i++ {
+		if rw := flush("Bearer secret"); rw.Code != http.StatusOK {
+			t.Errorf("unexpected status of flush %d: want %d, got %d", i, http.StatusOK, rw.Code)
+		}
+	}
+
+	// Unauthenticated requests do not use up the budget.
+	if rw := flush("Bearer nope"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status: want %d, got %d", http.StatusUnauthorized, rw.Code)
+	}
+
+	rw := flush("Bearer secret")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status: want %d, got %d", http.StatusTooManyRequests, rw.Code)
+	}
+
+	if retry := rw.Header().Get("Retry-After"); retry == "" || retry == "0" {
+		t.Errorf("unexpected Retry-After: %q", retry)
+	}
+}
+
+func TestAdminConfig_Validate(t *testing.T) {
+	tests := []struct {
+		desc    string
+		cfg     AdminConfig
+		wantErr bool
+	}{
+		{desc: "disabled", cfg: AdminConfig{}},
+		{desc: "valid", cfg: AdminConfig{Path: "/_cache", Tokens: []string{"secret"}}},
+		{desc: "no token", cfg: AdminConfig{Path: "/_cache"}, wantErr: true},
+		{desc: "empty token", cfg: AdminConfig{Path: "/_cache", Tokens: []string{""}}, wantErr: true},
+		{desc: "relative path", cfg: AdminConfig{Path: "_cache", Tokens: []string{"secret"}}, wantErr: true},
+		{
+			desc:    "invalid network",
+			cfg:     AdminConfig{Path: "/_cache", Tokens: []string{"secret"}, AllowedNetworks: []string{"nope"}},
+			wantErr: true,
+		},
+		{
+			desc:    "negative rate limit",
+			cfg:     AdminConfig{Path: "/_cache", Tokens: []string{"secret"}, RateLimit: -1},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		if err := test.cfg.validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error: %v", test.desc, err)
+		}
+	}
+}
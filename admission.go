@@ -0,0 +1,80 @@
+package plugin_simplecache
+
+import (
+	"sync"
+	"time"
+)
+
+// admissionCandidate is a key requested fewer times than required to be
+// admitted in the cache.
+type admissionCandidate struct {
+	first time.Time
+	count int
+}
+
+// admissionFilter admits keys in the cache once they have been requested a
+// number of times within a window, so that keys requested only once never
+// reach the disk.
+type admissionFilter struct {
+	hits   int
+	window time.Duration
+
+	mu         sync.Mutex
+	candidates map[string]admissionCandidate
+}
+
+func newAdmissionFilter(hits int, window time.Duration) *admissionFilter {
+	return &admissionFilter{
+		hits:       hits,
+		window:     window,
+		candidates: map[string]admissionCandidate{},
+	}
+}
+
+// Admit records a request for key and reports whether key has now been
+// requested enough times to be admitted. Admitted keys start over as new
+// candidates.
+func (a *admissionFilter) Admit(key string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.candidates[key]
+	if !ok && len(a.candidates) >= maxTrackedKeys {
+		a.candidates = map[string]admissionCandidate{}
+	}
+
+	if !ok || a.window > 0 && now.Sub(c.first) > a.window {
+		c = admissionCandidate{first: now}
+	}
+
+	c.count++
+
+	if c.count >= a.hits {
+		delete(a.candidates, key)
+		return true
+	}
+
+	a.candidates[key] = c
+
+	return false
+}
+
+// admit reports whether the cacheable response to key, which took delta to
+// fetch from the origin, may be stored: only responses slow enough and a
+// sample of them are considered, then only once their key has been requested
+// enough times. Refreshes of stored entries are always admitted.
+func (m *cache) admit(key, cs string, delta time.Duration) bool {
+	if cs == cacheRefreshDecision {
+		return true
+	}
+
+	if delta < m.cfg.AdmissionLatency.Duration() {
+		return false
+	}
+
+	if rate := m.cfg.AdmissionSampleRate; rate > 0 && randFloat() >= rate {
+		return false
+	}
+
+	return m.admission == nil || m.admission.Admit(key, m.clock.Now())
+}
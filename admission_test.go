@@ -0,0 +1,166 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionFilter_Admit(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		desc  string
+		at    time.Duration
+		admit bool
+	}{
+		{desc: "first request", at: 0, admit: false},
+		{desc: "second request", at: time.Second, admit: false},
+		{desc: "third request", at: 2 * time.Second, admit: true},
+		{desc: "first request after admission", at: 3 * time.Second, admit: false},
+		{desc: "second request after the window", at: 2 * time.Minute, admit: false},
+		{desc: "second request within the window", at: 2*time.Minute + time.Second, admit: false},
+		{desc: "third request within the window", at: 2*time.Minute + 2*time.Second, admit: true},
+	}
+
+	a := newAdmissionFilter(3, time.Minute)
+
+	for _, test := range tests {
+		if got := a.Admit("key", now.Add(test.at)); got != test.admit {
+			t.Errorf("%s: unexpected admission: want %t, got %t", test.desc, test.admit, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_AdmissionHits(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, AdmissionHits: 2}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{cacheMissStatus, cacheMissStatus, cacheHitStatus}
+
+	for i, state := range want {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		if got := rw.Header().Get("Cache-Status"); got != state {
+			t.Errorf("request %d: unexpected cache state: want %q, got: %q", i, state, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_AdmissionSampleRate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rand  float64
+		state string
+	}{
+		{name: "sampled", rand: 0.2, state: cacheHitStatus},
+		{name: "not sampled", rand: 0.3, state: cacheMissStatus},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func(f func() float64) { randFloat = f }(randFloat)
+			randFloat = func() float64 { return test.rand }
+
+			dir := createTempDir(t)
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, AdmissionSampleRate: 0.25}
+
+			h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			if state := rw.Header().Get("Cache-Status"); state != test.state {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.state, state)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTP_AdmissionLatency(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(60 * time.Millisecond)
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, AdmissionLatency: "50ms"}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		state string
+	}{
+		{path: "/slow", state: cacheHitStatus},
+		{path: "/fast", state: cacheMissStatus},
+	}
+
+	for _, test := range tests {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil))
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.path, test.state, state)
+		}
+	}
+}
+
+func TestResponseWriter_NotAdmitted(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	rw := &responseWriter{
+		ResponseWriter: rec,
+		body:           newSpillBuffer(createTempDir(t), 4),
+		decide:         func(int, http.Header) bool { return false },
+	}
+
+	if _, err := rw.Write([]byte("some body")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The response is decided on before its body, which is then not captured.
+	if !errors.Is(rw.err, errNotAdmitted) || rw.body.Len() != 0 {
+		t.Errorf("unexpected capture: want none, got %d bytes and %v", rw.body.Len(), rw.err)
+	}
+
+	if body := rec.Body.String(); body != "some body" {
+		t.Errorf("unexpected body: want %q, got: %q", "some body", body)
+	}
+}
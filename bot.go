@@ -0,0 +1,77 @@
+package plugin_simplecache
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultBotUserAgents returns the User-Agent substrings of the crawlers
+// recognized by default.
+func defaultBotUserAgents() []string {
+	return []string{"Googlebot", "bingbot", "DuckDuckBot", "YandexBot", "Baiduspider", "Applebot"}
+}
+
+// parseNetworks parses a list of CIDR networks.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", cidr, err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// isBot reports whether r comes from a crawler: its User-Agent must contain
+// one of the bot User-Agents and, if bot networks are configured, its client
+// address must belong to one of them, so that the User-Agent cannot simply be
+// spoofed.
+func (m *cache) isBot(r *http.Request) bool {
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return false
+	}
+
+	var claimed bool
+	for _, bot := range m.cfg.BotUserAgents {
+		if strings.Contains(ua, strings.ToLower(bot)) {
+			claimed = true
+			break
+		}
+	}
+
+	if !claimed || len(m.botNets) == 0 {
+		return claimed
+	}
+
+	return fromNetworks(r, m.botNets)
+}
+
+// fromNetworks reports whether the client address of r belongs to one of
+// nets.
+func fromNetworks(r *http.Request, nets []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,104 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_IsBot(t *testing.T) {
+	tests := []struct {
+		desc       string
+		networks   []string
+		userAgent  string
+		remoteAddr string
+		want       bool
+	}{
+		{
+			desc:      "crawler",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want:      true,
+		},
+		{
+			desc:      "human",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0",
+			want:      false,
+		},
+		{
+			desc: "no user agent",
+			want: false,
+		},
+		{
+			desc:       "crawler from a bot network",
+			networks:   []string{"66.249.64.0/19"},
+			userAgent:  "Googlebot/2.1",
+			remoteAddr: "66.249.66.1:1234",
+			want:       true,
+		},
+		{
+			desc:       "crawler from another network",
+			networks:   []string{"66.249.64.0/19"},
+			userAgent:  "Googlebot/2.1",
+			remoteAddr: "192.0.2.1:1234",
+			want:       false,
+		},
+	}
+
+	for _, test := range tests {
+		nets, err := parseNetworks(test.networks)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := &cache{cfg: &Config{BotUserAgents: defaultBotUserAgents()}, botNets: nets}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.Header.Set("User-Agent", test.userAgent)
+		if test.remoteAddr != "" {
+			req.RemoteAddr = test.remoteAddr
+		}
+
+		if got := m.isBot(req); got != test.want {
+			t.Errorf("%s: unexpected result: want %t, got %t", test.desc, test.want, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_BotsOnly(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, BotsOnly: true}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		userAgent string
+		state     string
+	}{
+		{userAgent: "Firefox/120.0", state: ""},
+		{userAgent: "Googlebot/2.1", state: cacheMissStatus},
+		{userAgent: "Googlebot/2.1", state: cacheHitStatus},
+		{userAgent: "Firefox/120.0", state: ""},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		req.Header.Set("User-Agent", test.userAgent)
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("request %d (%s): unexpected cache state: want %q, got: %q", i, test.userAgent, test.state, state)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerRequests = 20
+	defaultBreakerWindow   = "10s"
+	defaultBreakerCooldown = "30s"
+)
+
+// circuitBreaker tracks the rate of origin errors over fixed windows. Once it
+// exceeds the threshold, the breaker opens: misses are no longer forwarded to
+// the origin until the cool-down ends, when a single probe request is let
+// through. Only the outcome of the probe counts while the breaker is open: a
+// successful probe closes it, a failed one keeps it open for another
+// cool-down. Probes are told apart from the other origin requests by the token
+// Allow gives them. A nil *circuitBreaker is always closed.
+type circuitBreaker struct {
+	name        string
+	rate        float64
+	minRequests int
+	window      time.Duration
+	cooldown    time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	errors      int
+	// openUntil is the end of the cool-down, zero while the breaker is closed.
+	openUntil time.Time
+	// probe is the token of the probe allowed after the cool-down while it is
+	// pending, zero otherwise. probes counts the probes ever allowed, so that
+	// every probe gets a token of its own.
+	probe  uint64
+	probes uint64
+}
+
+func newCircuitBreaker(name string, rate float64, minRequests int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, rate: rate, minRequests: minRequests, window: window, cooldown: cooldown}
+}
+
+// Open reports whether the breaker is open and cooling down at now, in which
+// case stored entries are served, even expired ones, rather than probing the
+// origin.
+func (b *circuitBreaker) Open(now time.Time) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return now.Before(b.openUntil)
+}
+
+// Allow reports whether a request may be forwarded to the origin at now. Once
+// the cool-down is over, one request is allowed as a probe, and the next one
+// only after another cool-down, unless the probe closes the breaker. The probe
+// is given a non-zero token, to pass to Record with its outcome.
+func (b *circuitBreaker) Allow(now time.Time) (bool, uint64) {
+	if b == nil {
+		return true, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true, 0
+	}
+
+	if now.Before(b.openUntil) {
+		return false, 0
+	}
+
+	// A probe never recorded, such as one the client gave up on, is replaced.
+	b.openUntil = now.Add(b.cooldown)
+	b.probes++
+	b.probe = b.probes
+
+	return true, b.probe
+}
+
+// RetryAfter returns how long until the next probe.
+func (b *circuitBreaker) RetryAfter(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.Before(now) {
+		return 0
+	}
+
+	return b.openUntil.Sub(now)
+}
+
+// Record records the outcome of an origin request at now. probe is the token
+// Allow gave the request, if any. While the breaker is open, only the outcome
+// of the pending probe is recorded: the requests allowed before it opened,
+// background refreshes and replaced probes are ignored.
+func (b *circuitBreaker) Record(probe uint64, failed bool, now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.openUntil.IsZero() {
+		if probe == 0 || probe != b.probe {
+			return
+		}
+
+		b.probe = 0
+
+		if failed {
+			b.openUntil = now.Add(b.cooldown)
+			return
+		}
+
+		log.Printf("Origin of %s recovered, misses are forwarded again", b.name)
+
+		b.openUntil = time.Time{}
+		b.reset(now)
+
+		return
+	}
+
+	if now.Sub(b.windowStart) > b.window {
+		b.reset(now)
+	}
+
+	b.requests++
+	if failed {
+		b.errors++
+	}
+
+	if b.requests >= b.minRequests && float64(b.errors) >= b.rate*float64(b.requests) {
+		log.Printf("Origin of %s failing, %d errors in %d requests: serving from the cache only for %s",
+			b.name, b.errors, b.requests, b.cooldown)
+
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// probeKey is the context key of the probe token of a request.
+type probeKey struct{}
+
+// withProbe returns r carrying the probe token Allow gave it, if any.
+func withProbe(r *http.Request, probe uint64) *http.Request {
+	if probe == 0 {
+		return r
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), probeKey{}, probe))
+}
+
+// probeOf returns the probe token carried by r, zero if it is not a probe.
+func probeOf(r *http.Request) uint64 {
+	probe, _ := r.Context().Value(probeKey{}).(uint64)
+	return probe
+}
+
+func (b *circuitBreaker) reset(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.errors = 0
+}
@@ -0,0 +1,188 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker("test", 0.5, 4, 10*time.Second, 30*time.Second)
+	now := time.Unix(1000, 0)
+
+	for _, failed := range []bool{false, false, true} {
+		b.Record(0, failed, now)
+	}
+
+	if ok, _ := b.Allow(now); !ok {
+		t.Fatal("unexpected open breaker below the minimum number of requests")
+	}
+
+	b.Record(0, false, now)
+	b.Record(0, true, now.Add(time.Second))
+
+	if ok, _ := b.Allow(now); !ok {
+		t.Fatal("unexpected open breaker below the error rate")
+	}
+
+	// A new window starts, the past requests no longer count.
+	now = now.Add(time.Minute)
+	for i := 0; i < 4; i++ {
+		b.Record(0, i%2 == 0, now)
+	}
+
+	if ok, _ := b.Allow(now); ok || !b.Open(now) {
+		t.Fatal("unexpected closed breaker at the error rate")
+	}
+
+	if d := b.RetryAfter(now); d != 30*time.Second {
+		t.Errorf("unexpected retry delay: want %s, got %s", 30*time.Second, d)
+	}
+
+	// Requests allowed before the breaker opened do not close it.
+	b.Record(0, false, now)
+
+	if !b.Open(now) {
+		t.Fatal("unexpected closed breaker without a probe")
+	}
+
+	now = now.Add(30 * time.Second)
+
+	ok, probe := b.Allow(now)
+	if !ok || probe == 0 {
+		t.Fatalf("unexpected refused probe after the cool-down: %t, token %d", ok, probe)
+	}
+
+	if ok, _ = b.Allow(now); ok {
+		t.Fatal("unexpected second probe")
+	}
+
+	b.Record(probe, true, now)
+
+	now = now.Add(30 * time.Second)
+
+	if ok, probe = b.Allow(now); !ok {
+		t.Fatal("unexpected refused probe after the failed probe cool-down")
+	}
+
+	b.Record(probe, false, now)
+
+	if ok, _ = b.Allow(now); !ok || b.Open(now) {
+		t.Error("unexpected open breaker after a successful probe")
+	}
+}
+
+func TestCircuitBreaker_LateRequests(t *testing.T) {
+	b := newCircuitBreaker("test", 0.5, 2, 10*time.Second, 30*time.Second)
+	now := time.Unix(1000, 0)
+
+	b.Record(0, true, now)
+	b.Record(0, true, now)
+
+	if !b.Open(now) {
+		t.Fatal("unexpected closed breaker at the error rate")
+	}
+
+	now = now.Add(30 * time.Second)
+
+	ok, probe := b.Allow(now)
+	if !ok {
+		t.Fatal("unexpected refused probe after the cool-down")
+	}
+
+	// Requests in flight since before the breaker opened finish after the
+	// cool-down, but before the probe: they neither close the breaker nor
+	// push the cool-down back.
+	b.Record(0, false, now.Add(time.Second))
+
+	if !b.Open(now.Add(time.Second)) {
+		t.Fatal("unexpected closed breaker after a late successful request")
+	}
+
+	b.Record(0, true, now.Add(2*time.Second))
+
+	if d := b.RetryAfter(now); d != 30*time.Second {
+		t.Errorf("unexpected retry delay after a late failed request: want %s, got %s", 30*time.Second, d)
+	}
+
+	// A replaced probe is ignored as well.
+	now = now.Add(30 * time.Second)
+
+	_, replacing := b.Allow(now)
+	b.Record(probe, false, now)
+
+	if !b.Open(now) {
+		t.Fatal("unexpected closed breaker after the replaced probe")
+	}
+
+	b.Record(replacing, false, now)
+
+	if b.Open(now) {
+		t.Error("unexpected open breaker after a successful probe")
+	}
+}
+
+func TestCache_ServeHTTP_Breaker(t *testing.T) {
+	var requests int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		BreakerErrorRate: 0.5, BreakerRequests: 2, BreakerCooldown: "1m",
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/stored", nil)
+	data := &cacheData{Status: http.StatusOK, Expires: time.Now().Add(-time.Hour), Body: []byte("some body")}
+
+	b, err := data.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.cache.Set(context.Background(), cacheKey(req), b, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc     string
+		path     string
+		status   int
+		state    string
+		requests int
+	}{
+		{desc: "first error", path: "/a", status: http.StatusInternalServerError, state: cacheMissStatus, requests: 1},
+		{desc: "second error", path: "/b", status: http.StatusInternalServerError, state: cacheMissStatus, requests: 2},
+		{desc: "miss while open", path: "/c", status: http.StatusServiceUnavailable, state: cacheMissStatus, requests: 2},
+		{desc: "stale while open", path: "/stored", status: http.StatusOK, state: cacheStaleStatus, requests: 2},
+	}
+
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil))
+
+		if rw.Code != test.status {
+			t.Errorf("%s: unexpected status: want %d, got %d", test.desc, test.status, rw.Code)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.desc, test.state, state)
+		}
+
+		if requests != test.requests {
+			t.Errorf("%s: unexpected origin requests: want %d, got %d", test.desc, test.requests, requests)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package plugin_simplecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Granularities of the expiry buckets.
+const (
+	bucketsHour = "hour"
+	bucketsDay  = "day"
+)
+
+// bucketPrefix starts the names of the expiry bucket directories, which can
+// then not be mistaken for shard directories.
+const bucketPrefix = "exp-"
+
+// expiryBuckets partitions the entries of a cache path into directories by
+// expiry time, so that the vacuum deletes every entry of an expired directory
+// at once instead of deleting them one by one. The entry files keep their
+// layout within the bucket directories.
+type expiryBuckets struct {
+	size   time.Duration
+	layout string
+}
+
+// newExpiryBuckets returns the buckets of the given granularity, "hour" or
+// "day", or nil for an unpartitioned cache.
+func newExpiryBuckets(granularity string) *expiryBuckets {
+	switch granularity {
+	case bucketsHour:
+		return &expiryBuckets{size: time.Hour, layout: "2006010215"}
+	case bucketsDay:
+		return &expiryBuckets{size: 24 * time.Hour, layout: "20060102"}
+	default:
+		return nil
+	}
+}
+
+// name returns the name of the directory of the entries expiring at expires,
+// in unix seconds.
+func (b *expiryBuckets) name(expires int64) string {
+	return bucketPrefix + time.Unix(expires, 0).UTC().Truncate(b.size).Format(b.layout)
+}
+
+// end returns the time, in unix seconds, at which every entry of the bucket
+// directory of the given name has expired. It reports false for directories
+// which are not buckets of this granularity.
+func (b *expiryBuckets) end(name string) (int64, bool) {
+	if !strings.HasPrefix(name, bucketPrefix) || len(name) != len(bucketPrefix)+len(b.layout) {
+		return 0, false
+	}
+
+	start, err := time.ParseInLocation(b.layout, name[len(bucketPrefix):], time.UTC)
+	if err != nil {
+		return 0, false
+	}
+
+	return start.Add(b.size).Unix(), true
+}
+
+// endOf returns the end of the bucket of the entries expiring at expires.
+func (b *expiryBuckets) endOf(expires int64) int64 {
+	return time.Unix(expires, 0).Truncate(b.size).Add(b.size).Unix()
+}
+
+// bucketDirs returns the paths of the expiry bucket directories under the
+// cache path, of any granularity, latest first.
+func bucketDirs(path string) []string {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+
+	var dirs []string
+
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), bucketPrefix) {
+			dirs = append(dirs, filepath.Join(path, info.Name()))
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	return dirs
+}
+
+// entryPrefix returns the prefix of the paths returned by keyPath for the
+// cache path.
+func entryPrefix(path string) string {
+	path = filepath.Clean(path)
+	if !os.IsPathSeparator(path[len(path)-1]) {
+		path += string(filepath.Separator)
+	}
+
+	return path
+}
+
+// filePath returns the path of the file holding the entry at p, as returned
+// by keyPath, expiring at expires: p itself, or p within the directory of its
+// expiry bucket.
+func (c *fileCache) filePath(p string, expires int64) string {
+	if c.buckets == nil {
+		return p
+	}
+
+	return filepath.Join(c.path, c.buckets.name(expires), p[len(c.prefix):])
+}
+
+// entryPath returns the path, as returned by keyPath, of the entry held by
+// file: file itself, or file out of its expiry bucket directory.
+func (c *fileCache) entryPath(file string) string {
+	if c.buckets == nil {
+		return file
+	}
+
+	rel := file[len(c.prefix):]
+
+	return c.prefix + rel[strings.IndexAny(rel, `/\`)+1:]
+}
+
+// files returns the paths of the files which may hold the entry at p. Until
+// the index is complete, or for entries missing from it when the cache path
+// is shared, the entry is looked for in every bucket directory which has not
+// expired, or any while expired entries are retained, latest first.
+func (c *fileCache) files(p string) []string {
+	if c.buckets == nil {
+		return []string{p}
+	}
+
+	if c.isIndexed() {
+		expires, ok := c.index.Get(p)
+		switch {
+		case ok:
+			return []string{c.filePath(p, expires)}
+		case !c.shared:
+			return nil
+		}
+	}
+
+	var files []string
+
+	now := c.clock.Now().Unix()
+
+	for _, dir := range bucketDirs(c.path) {
+		if end, ok := c.buckets.end(filepath.Base(dir)); !ok || (end <= now && !c.retaining()) {
+			continue
+		}
+
+		file := filepath.Join(dir, p[len(c.prefix):])
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// dropBuckets deletes the directories of the expired buckets, and the bucket
+// and shard directories of other layouts, whose entries cannot be found.
+// Other files and directories of the cache root are left alone, in case the
+// cache path is shared.
+func (c *fileCache) dropBuckets(stats *vacuumStats, now int64) {
+	infos, err := ioutil.ReadDir(c.path)
+	if err != nil {
+		stats.Errors++
+		return
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() || !isCacheDir(name) {
+			continue
+		}
+
+		end, ok := c.buckets.end(name)
+		if ok && end > now {
+			continue
+		}
+
+		if err = os.RemoveAll(filepath.Join(c.path, name)); err != nil {
+			stats.Errors++
+			continue
+		}
+
+		stats.Dropped++
+	}
+}
+
+// vacuumBuckets drops the expired bucket directories, then indexes the files
+// of the others without reading them, as expiring at the end of their bucket:
+// their actual expiry is checked when they are read.
+func (c *fileCache) vacuumBuckets(stats *vacuumStats) {
+	now := c.clock.Now().Unix()
+
+	c.dropBuckets(stats, now)
+
+	dirs := bucketDirs(c.path)
+
+	stats.merge(c.forEach(dirs, func(dir string, s *vacuumStats) {
+		end, _ := c.buckets.end(filepath.Base(dir))
+
+		_ = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			switch {
+			case err != nil:
+				s.Errors++
+				return nil
+			case info.IsDir(), !c.isEntryFile(file):
+				return nil
+			}
+
+			s.Scanned++
+
+			p := c.entryPath(file)
+
+			mu := c.pm.MutexAt(p)
+			mu.Lock()
+			if _, ok := c.index.Get(p); !ok {
+				c.index.Set(p, end-1)
+			}
+			mu.Unlock()
+
+			return nil
+		})
+	}))
+}
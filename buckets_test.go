@@ -0,0 +1,204 @@
+package plugin_simplecache
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiryBuckets(t *testing.T) {
+	expires := time.Date(2020, time.January, 1, 10, 30, 0, 0, time.UTC).Unix()
+
+	tests := []struct {
+		granularity string
+		name        string
+		end         time.Time
+	}{
+		{granularity: bucketsHour, name: "exp-2020010110", end: time.Date(2020, time.January, 1, 11, 0, 0, 0, time.UTC)},
+		{granularity: bucketsDay, name: "exp-20200101", end: time.Date(2020, time.January, 2, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		b := newExpiryBuckets(test.granularity)
+
+		if name := b.name(expires); name != test.name {
+			t.Errorf("%s: unexpected bucket name: want %q, got %q", test.granularity, test.name, name)
+		}
+
+		if end, ok := b.end(test.name); !ok || end != test.end.Unix() {
+			t.Errorf("%s: unexpected bucket end: want %v, got %v (%t)", test.granularity, test.end, end, ok)
+		}
+
+		if end := b.endOf(expires); end != test.end.Unix() {
+			t.Errorf("%s: unexpected bucket end of the expiry: want %v, got %v", test.granularity, test.end, end)
+		}
+
+		for _, name := range []string{"00", "exp-2020", "exp-20200101xx", "exp-202001011000"} {
+			if _, ok := b.end(name); ok {
+				t.Errorf("%s: unexpected bucket %q", test.granularity, name)
+			}
+		}
+	}
+
+	if b := newExpiryBuckets(""); b != nil {
+		t.Errorf("unexpected buckets of the flat layout: %+v", b)
+	}
+}
+
+func TestFileCache_Buckets(t *testing.T) {
+	dir := createTempDir(t)
+	clk := newTestClock()
+	ctx := context.Background()
+
+	fc, err := newFileCache(ctx, dir, 0, 1, newExpiryBuckets(bucketsHour), clk)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	// The clock starts at midnight: the first key expires within the first
+	// hour, the second within the fourth.
+	keyA, keyB := testCacheKey+"/a", testCacheKey+"/b"
+	pathA, pathB := keyPath(dir, keyA), keyPath(dir, keyB)
+
+	if err = fc.Set(ctx, keyA, []byte("a"), 30*time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	if err = fc.Set(ctx, keyB, []byte("b"), 3*time.Hour); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	// Until the first vacuum pass, the entries are looked for in the buckets.
+	wantBucketFile(t, fc, pathA, "exp-2020010100")
+	wantBucketFile(t, fc, pathB, "exp-2020010103")
+	wantValue(t, fc, keyA, []byte("a"))
+	wantValue(t, fc, keyB, []byte("b"))
+
+	// Shard directories of the flat layout are dropped, other directories
+	// are left alone.
+	for _, name := range []string{"ab", "foreign"} {
+		if err = os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := fc.runVacuum(); stats.Scanned != 2 || stats.Dropped != 1 {
+		t.Errorf("unexpected first vacuum stats: want 2 scanned and 1 dropped, got %+v", stats)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "foreign")); err != nil {
+		t.Errorf("unexpected foreign directory error: %v", err)
+	}
+
+	clk.Add(2 * time.Hour)
+
+	if stats := fc.runVacuum(); stats.Dropped != 1 {
+		t.Errorf("unexpected vacuum stats: want 1 bucket dropped, got %+v", stats)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "exp-2020010100")); !os.IsNotExist(err) {
+		t.Errorf("unexpected expired bucket: %v", err)
+	}
+
+	wantValue(t, fc, keyA, nil)
+	wantValue(t, fc, keyB, []byte("b"))
+
+	// Replacing an entry moves it to the bucket of its new expiry.
+	old := fc.files(pathB)[0]
+
+	if err = fc.Set(ctx, keyB, []byte("b2"), 10*time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	wantBucketFile(t, fc, pathB, "exp-2020010102")
+	wantValue(t, fc, keyB, []byte("b2"))
+
+	if _, err = os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("unexpected replaced file: %v", err)
+	}
+
+	// Switching back to the flat layout drops the buckets.
+	fc, err = newFileCache(ctx, dir, 0, 1, nil, clk)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if stats := fc.runVacuum(); stats.Dropped != 2 {
+		t.Errorf("unexpected flat vacuum stats: want 2 buckets dropped, got %+v", stats)
+	}
+
+	if dirs := bucketDirs(dir); len(dirs) != 0 {
+		t.Errorf("unexpected bucket directories: %v", dirs)
+	}
+}
+
+// wantBucketFile checks that the entry at p is held by a single file, within
+// the bucket directory of the given name.
+func wantBucketFile(t *testing.T, fc *fileCache, p, bucket string) {
+	t.Helper()
+
+	files := fc.files(p)
+	if len(files) != 1 {
+		t.Fatalf("unexpected files of %s: want 1, got %v", p, files)
+	}
+
+	if prefix := filepath.Join(fc.path, bucket) + string(filepath.Separator); !strings.HasPrefix(files[0], prefix) {
+		t.Errorf("unexpected file of %s: want it under %s, got %s", p, prefix, files[0])
+	}
+
+	if entry := fc.entryPath(files[0]); entry != p {
+		t.Errorf("unexpected entry path of %s: want %s, got %s", files[0], p, entry)
+	}
+}
+
+func TestFileCache_StoreBuckets(t *testing.T) {
+	testStore(t, func(t *testing.T, clk clock) store {
+		t.Helper()
+
+		fc, err := newFileCache(context.Background(), createTempDir(t), 0, 1, newExpiryBuckets(bucketsHour), clk)
+		if err != nil {
+			t.Fatalf("unexpected newFileCache error: %v", err)
+		}
+
+		return fc
+	})
+}
+
+func TestVolumeSet_SnapshotBuckets(t *testing.T) {
+	ctx := context.Background()
+	clk := newTestClock()
+
+	src, err := newVolumeSet(ctx, []string{createTempDir(t)}, 0, 1, newExpiryBuckets(bucketsDay), clk)
+	if err != nil {
+		t.Fatalf("unexpected newVolumeSet error: %v", err)
+	}
+
+	if err = src.Set(ctx, testCacheKey, []byte("content"), time.Hour); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	var snapshot bytes.Buffer
+
+	if n, err := src.Export(ctx, &snapshot); err != nil || n != 1 {
+		t.Fatalf("unexpected export result: want 1 entry, got %d and %v", n, err)
+	}
+
+	// Snapshots do not depend on the layout.
+	for _, buckets := range []*expiryBuckets{nil, newExpiryBuckets(bucketsHour)} {
+		dst, err := newVolumeSet(ctx, []string{createTempDir(t)}, 0, 1, buckets, clk)
+		if err != nil {
+			t.Fatalf("unexpected newVolumeSet error: %v", err)
+		}
+
+		stats, err := dst.Import(ctx, bytes.NewReader(snapshot.Bytes()))
+		if err != nil || stats.Imported != 1 {
+			t.Fatalf("unexpected import result: want 1 imported, got %+v and %v", stats, err)
+		}
+
+		wantValue(t, dst, testCacheKey, []byte("content"))
+	}
+}
@@ -2,170 +2,1679 @@
 package plugin_simplecache
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/pquerna/cachecontrol"
+	"github.com/pquerna/cachecontrol/cacheobject"
 )
 
 // Config configures the middleware.
 type Config struct {
-	Path            string `json:"path" yaml:"path" toml:"path"`
-	MaxExpiry       int    `json:"maxExpiry" yaml:"maxExpiry" toml:"maxExpiry"`
-	Cleanup         int    `json:"cleanup" yaml:"cleanup" toml:"cleanup"`
-	AddStatusHeader bool   `json:"addStatusHeader" yaml:"addStatusHeader" toml:"addStatusHeader"`
+	Path                string       `json:"path" yaml:"path" toml:"path"`
+	Paths               []string     `json:"paths" yaml:"paths" toml:"paths"`
+	MaxExpiry           Duration     `json:"maxExpiry" yaml:"maxExpiry" toml:"maxExpiry"`
+	Cleanup             Duration     `json:"cleanup" yaml:"cleanup" toml:"cleanup"`
+	VacuumWorkers       int          `json:"vacuumWorkers" yaml:"vacuumWorkers" toml:"vacuumWorkers"`
+	ExpiryBuckets       string       `json:"expiryBuckets" yaml:"expiryBuckets" toml:"expiryBuckets"`
+	AddStatusHeader     bool         `json:"addStatusHeader" yaml:"addStatusHeader" toml:"addStatusHeader"`
+	StatusHeader        string       `json:"statusHeader" yaml:"statusHeader" toml:"statusHeader"`
+	StatusHit           string       `json:"statusHit" yaml:"statusHit" toml:"statusHit"`
+	StatusMiss          string       `json:"statusMiss" yaml:"statusMiss" toml:"statusMiss"`
+	StatusStale         string       `json:"statusStale" yaml:"statusStale" toml:"statusStale"`
+	StatusError         string       `json:"statusError" yaml:"statusError" toml:"statusError"`
+	AccessLogPath       string       `json:"accessLogPath" yaml:"accessLogPath" toml:"accessLogPath"`
+	WarmupURLs          []string     `json:"warmupUrls" yaml:"warmupUrls" toml:"warmupUrls"`
+	WarmupFile          string       `json:"warmupFile" yaml:"warmupFile" toml:"warmupFile"`
+	Compress            bool         `json:"compress" yaml:"compress" toml:"compress"`
+	StreamingTypes      []string     `json:"streamingTypes" yaml:"streamingTypes" toml:"streamingTypes"`
+	HealthPath          string       `json:"healthPath" yaml:"healthPath" toml:"healthPath"`
+	BufferSize          int          `json:"bufferSize" yaml:"bufferSize" toml:"bufferSize"`
+	MaxItemBytes        int          `json:"maxItemBytes" yaml:"maxItemBytes" toml:"maxItemBytes"`
+	MemoryBudget        int          `json:"memoryBudget" yaml:"memoryBudget" toml:"memoryBudget"`
+	MemoryItemSize      int          `json:"memoryItemSize" yaml:"memoryItemSize" toml:"memoryItemSize"`
+	NegativeTTL         Duration     `json:"negativeTtl" yaml:"negativeTtl" toml:"negativeTtl"`
+	NegativeStatus      []int        `json:"negativeStatus" yaml:"negativeStatus" toml:"negativeStatus"`
+	CacheableStatus     []int        `json:"cacheableStatus" yaml:"cacheableStatus" toml:"cacheableStatus"`
+	DeceptionCheck      bool         `json:"deceptionCheck" yaml:"deceptionCheck" toml:"deceptionCheck"`
+	GracePeriod         Duration     `json:"gracePeriod" yaml:"gracePeriod" toml:"gracePeriod"`
+	RefreshHits         int          `json:"refreshHits" yaml:"refreshHits" toml:"refreshHits"`
+	RefreshWindow       Duration     `json:"refreshWindow" yaml:"refreshWindow" toml:"refreshWindow"`
+	XFetchBeta          float64      `json:"xfetchBeta" yaml:"xfetchBeta" toml:"xfetchBeta"`
+	BypassHeader        string       `json:"bypassHeader" yaml:"bypassHeader" toml:"bypassHeader"`
+	BypassToken         string       `json:"bypassToken" yaml:"bypassToken" toml:"bypassToken"`
+	RefreshQuery        string       `json:"refreshQuery" yaml:"refreshQuery" toml:"refreshQuery"`
+	BypassCookies       []string     `json:"bypassCookies" yaml:"bypassCookies" toml:"bypassCookies"`
+	BypassTypes         []string     `json:"bypassTypes" yaml:"bypassTypes" toml:"bypassTypes"`
+	Methods             []string     `json:"methods" yaml:"methods" toml:"methods"`
+	CacheContentTypes   []string     `json:"cacheContentTypes" yaml:"cacheContentTypes" toml:"cacheContentTypes"`
+	NoCacheContentTypes []string     `json:"noCacheContentTypes" yaml:"noCacheContentTypes" toml:"noCacheContentTypes"`
+	TTLRules            []TTLRule    `json:"ttlRules" yaml:"ttlRules" toml:"ttlRules"`
+	Hosts               []HostConfig `json:"hosts" yaml:"hosts" toml:"hosts"`
+	RulesFile           string       `json:"rulesFile" yaml:"rulesFile" toml:"rulesFile"`
+	RulesReload         Duration     `json:"rulesReload" yaml:"rulesReload" toml:"rulesReload"`
+	DryRun              bool         `json:"dryRun" yaml:"dryRun" toml:"dryRun"`
+	RequireOptInHeader  string       `json:"requireOptInHeader" yaml:"requireOptInHeader" toml:"requireOptInHeader"`
+	Maintenance         bool         `json:"maintenance" yaml:"maintenance" toml:"maintenance"`
+	ReadOnly            bool         `json:"readOnly" yaml:"readOnly" toml:"readOnly"`
+	SharedPath          bool         `json:"sharedPath" yaml:"sharedPath" toml:"sharedPath"`
+	OnError             string       `json:"onError" yaml:"onError" toml:"onError"`
+	AdmissionHits       int          `json:"admissionHits" yaml:"admissionHits" toml:"admissionHits"`
+	AdmissionWindow     Duration     `json:"admissionWindow" yaml:"admissionWindow" toml:"admissionWindow"`
+	AdmissionSampleRate float64      `json:"admissionSampleRate" yaml:"admissionSampleRate" toml:"admissionSampleRate"`
+	AdmissionLatency    Duration     `json:"admissionLatency" yaml:"admissionLatency" toml:"admissionLatency"`
+	MicroCacheTTL       Duration     `json:"microCacheTtl" yaml:"microCacheTtl" toml:"microCacheTtl"`
+	BotsOnly            bool         `json:"botsOnly" yaml:"botsOnly" toml:"botsOnly"`
+	ESI                 bool         `json:"esi" yaml:"esi" toml:"esi"`
+	BotUserAgents       []string     `json:"botUserAgents" yaml:"botUserAgents" toml:"botUserAgents"`
+	BotNetworks         []string     `json:"botNetworks" yaml:"botNetworks" toml:"botNetworks"`
+	TypeTTLs            []TypeTTL    `json:"typeTtls" yaml:"typeTtls" toml:"typeTtls"`
+	SeedPath            string       `json:"seedPath" yaml:"seedPath" toml:"seedPath"`
+	SeedHost            string       `json:"seedHost" yaml:"seedHost" toml:"seedHost"`
+	SeedTTL             Duration     `json:"seedTtl" yaml:"seedTtl" toml:"seedTtl"`
+	MaxStaleAge         Duration     `json:"maxStaleAge" yaml:"maxStaleAge" toml:"maxStaleAge"`
+	SigningKey          string       `json:"signingKey" yaml:"signingKey" toml:"signingKey"`
+	StripHeaders        []string     `json:"stripHeaders" yaml:"stripHeaders" toml:"stripHeaders"`
+	UnkeyedHeaders      []string     `json:"unkeyedHeaders" yaml:"unkeyedHeaders" toml:"unkeyedHeaders"`
+	AddLastModified     bool         `json:"addLastModified" yaml:"addLastModified" toml:"addLastModified"`
+	ThrottleStaleAge    Duration     `json:"throttleStaleAge" yaml:"throttleStaleAge" toml:"throttleStaleAge"`
+	OfflineStaleAge     Duration     `json:"offlineStaleAge" yaml:"offlineStaleAge" toml:"offlineStaleAge"`
+	BreakerErrorRate    float64      `json:"breakerErrorRate" yaml:"breakerErrorRate" toml:"breakerErrorRate"`
+	BreakerRequests     int          `json:"breakerRequests" yaml:"breakerRequests" toml:"breakerRequests"`
+	BreakerWindow       Duration     `json:"breakerWindow" yaml:"breakerWindow" toml:"breakerWindow"`
+	BreakerCooldown     Duration     `json:"breakerCooldown" yaml:"breakerCooldown" toml:"breakerCooldown"`
+	TenantHeader        string       `json:"tenantHeader" yaml:"tenantHeader" toml:"tenantHeader"`
+	TenantClientCert    bool         `json:"tenantClientCert" yaml:"tenantClientCert" toml:"tenantClientCert"`
+	Tenants             []string     `json:"tenants" yaml:"tenants" toml:"tenants"`
+	MaintenanceStatus   int          `json:"maintenanceStatus" yaml:"maintenanceStatus" toml:"maintenanceStatus"`
+
+	// HitHeaders are set on the responses served from the cache.
+	HitHeaders map[string]string `json:"hitHeaders" yaml:"hitHeaders" toml:"hitHeaders"`
+
+	// ClientCacheControl rewrites the Cache-Control header of the responses
+	// sent to clients.
+	ClientCacheControl []CacheControlRule `json:"clientCacheControl" yaml:"clientCacheControl" toml:"clientCacheControl"`
+
+	// Admin configures the control endpoints.
+	Admin AdminConfig `json:"admin" yaml:"admin" toml:"admin"`
+
+	// Replication pushes the entries stored to peer instances.
+	Replication ReplicationConfig `json:"replication" yaml:"replication" toml:"replication"`
 }
 
 // CreateConfig returns a config instance.
 func CreateConfig() *Config {
 	return &Config{
-		MaxExpiry:       int((5 * time.Minute).Seconds()),
-		Cleanup:         int((5 * time.Minute).Seconds()),
-		AddStatusHeader: true,
+		MaxExpiry:         "5m",
+		Cleanup:           "5m",
+		VacuumWorkers:     1,
+		AddStatusHeader:   true,
+		StatusHeader:      cacheHeader,
+		StatusHit:         cacheHitStatus,
+		StatusMiss:        cacheMissStatus,
+		StatusStale:       cacheStaleStatus,
+		StatusError:       cacheErrorStatus,
+		BufferSize:        defaultBufferSize,
+		MemoryItemSize:    64 * 1024,
+		NegativeStatus:    []int{http.StatusNotFound, http.StatusGone, http.StatusUnavailableForLegalReasons},
+		StreamingTypes:    []string{"text/event-stream"},
+		BypassTypes:       []string{"application/grpc"},
+		Methods:           defaultMethods(),
+		CacheableStatus:   defaultCacheableStatus(),
+		RulesReload:       "10s",
+		MaintenanceStatus: http.StatusServiceUnavailable,
+		OnError:           failOpen,
+		AdmissionWindow:   "10m",
+		SeedTTL:           "1h",
+		BotUserAgents:     defaultBotUserAgents(),
+		StripHeaders:      defaultStripHeaders(),
+		BreakerRequests:   defaultBreakerRequests,
+		BreakerWindow:     defaultBreakerWindow,
+		BreakerCooldown:   defaultBreakerCooldown,
+		UnkeyedHeaders:    defaultUnkeyedHeaders(),
+		Admin:             AdminConfig{RateLimit: defaultAdminRateLimit, Burst: defaultAdminBurst},
 	}
 }
 
+// defaultStripHeaders returns the response headers never stored by default,
+// as they may carry secrets.
+func defaultStripHeaders() []string {
+	return []string{"Set-Cookie", "Authorization", "Proxy-Authenticate", "WWW-Authenticate"}
+}
+
+// defaultMethods returns the request methods cached by default.
+func defaultMethods() []string {
+	return []string{http.MethodGet}
+}
+
+// defaultCacheableStatus returns the response status codes stored by default,
+// which are the ones cacheable by default per RFC 7231 that are safe to replay.
+func defaultCacheableStatus() []int {
+	return []int{http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently, http.StatusNotFound}
+}
+
+// defaultBufferSize is the default number of bytes of a response buffered in
+// memory before spilling to disk.
+const defaultBufferSize = 1024 * 1024
+
 const (
 	cacheHeader      = "Cache-Status"
 	cacheHitStatus   = "hit"
 	cacheMissStatus  = "miss"
+	cacheStaleStatus = "stale"
 	cacheErrorStatus = "error"
+
+	cacheRefreshDecision = "refresh"
+)
+
+// Policies on cache errors.
+const (
+	// failOpen forwards the request to the origin, as on a miss.
+	failOpen = "open"
+	// failClosed answers with a 503 without contacting the origin.
+	failClosed = "closed"
 )
 
 type cache struct {
-	name  string
-	cache *fileCache
-	cfg   *Config
-	next  http.Handler
+	name      string
+	cache     *volumeSet
+	tenants   map[string]*volumeSet
+	memory    *memoryCache
+	cfg       *Config
+	accessLog *accessLog
+	flights   *flightGroup
+	hits      *hitCounter
+	next      http.Handler
+	dryRun    *dryRun
+	admission *admissionFilter
+	botNets   []*net.IPNet
+	adminNets []*net.IPNet
+
+	adminLimit *tokenBucket
+	peerLimit  *tokenBucket
+	breaker    *circuitBreaker
+	throttles  *originThrottle
+	replicator *replicator
+	health     healthProbe
+	clock      clock
+
+	// maintenance is 1 while the origin must not be contacted.
+	maintenance int32
+
+	// rules holds the current *ruleSet.
+	rules atomic.Value
 }
 
 // New returns a plugin instance.
-func New(_ context.Context, next http.Handler, cfg *Config, name string) (http.Handler, error) {
-	if cfg.MaxExpiry <= 1 {
-		return nil, errors.New("maxExpiry must be greater or equal to 1")
+func New(ctx context.Context, next http.Handler, cfg *Config, name string) (http.Handler, error) {
+	return newWithClock(ctx, next, cfg, name, systemClock{})
+}
+
+// newWithClock returns a plugin instance telling the time from clk.
+func newWithClock(ctx context.Context, next http.Handler, cfg *Config, name string, clk clock) (http.Handler, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	setStatusDefaults(cfg)
+
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultBufferSize
+	}
+
+	if len(cfg.CacheableStatus) == 0 {
+		cfg.CacheableStatus = defaultCacheableStatus()
+	}
+
+	if len(cfg.Methods) == 0 {
+		cfg.Methods = defaultMethods()
+	}
+
+	if cfg.MaintenanceStatus == 0 {
+		cfg.MaintenanceStatus = http.StatusServiceUnavailable
+	}
+
+	if len(cfg.BotUserAgents) == 0 {
+		cfg.BotUserAgents = defaultBotUserAgents()
 	}
 
-	if cfg.Cleanup <= 1 {
-		return nil, errors.New("cleanup must be greater or equal to 1")
+	if cfg.BreakerRequests == 0 {
+		cfg.BreakerRequests = defaultBreakerRequests
 	}
 
-	fc, err := newFileCache(cfg.Path, time.Duration(cfg.Cleanup)*time.Second)
+	if cfg.BreakerWindow == "" {
+		cfg.BreakerWindow = defaultBreakerWindow
+	}
+
+	if cfg.BreakerCooldown == "" {
+		cfg.BreakerCooldown = defaultBreakerCooldown
+	}
+
+	if cfg.Admin.RateLimit == 0 {
+		cfg.Admin.RateLimit = defaultAdminRateLimit
+	}
+
+	if cfg.Admin.Burst == 0 {
+		cfg.Admin.Burst = defaultAdminBurst
+	}
+
+	// An empty list, unlike a missing one, disables the stripping.
+	if cfg.StripHeaders == nil {
+		cfg.StripHeaders = defaultStripHeaders()
+	}
+
+	if cfg.UnkeyedHeaders == nil {
+		cfg.UnkeyedHeaders = defaultUnkeyedHeaders()
+	}
+
+	botNets, err := parseNetworks(cfg.BotNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	adminNets, err := parseNetworks(cfg.Admin.AllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read-only caches are never vacuumed.
+	vacuum := cfg.Cleanup.Duration()
+	if cfg.ReadOnly {
+		vacuum = 0
+	}
+
+	paths := cfg.Paths
+	if len(paths) == 0 {
+		paths = []string{cfg.Path}
+	}
+
+	fc, err := openVolumes(ctx, cfg, paths, vacuum, clk)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := newTenantStores(ctx, cfg, paths, vacuum, clk)
 	if err != nil {
 		return nil, err
 	}
 
 	m := &cache{
-		name:  name,
-		cache: fc,
-		cfg:   cfg,
-		next:  next,
+		name:      name,
+		cache:     fc,
+		tenants:   tenants,
+		cfg:       cfg,
+		flights:   newFlightGroup(),
+		hits:      newHitCounter(),
+		next:      next,
+		botNets:   botNets,
+		adminNets: adminNets,
+		throttles: newOriginThrottle(),
+		clock:     clk,
+	}
+
+	if err = m.initRules(ctx); err != nil {
+		return nil, err
+	}
+
+	if cfg.MemoryBudget > 0 {
+		m.memory = newMemoryCache(cfg.MemoryBudget, cfg.MemoryItemSize, clk)
+	}
+
+	if cfg.DryRun {
+		m.dryRun = newDryRun()
+	}
+
+	if cfg.AdmissionHits > 1 {
+		m.admission = newAdmissionFilter(cfg.AdmissionHits, cfg.AdmissionWindow.Duration())
+	}
+
+	if cfg.BreakerErrorRate > 0 {
+		m.breaker = newCircuitBreaker(name, cfg.BreakerErrorRate, cfg.BreakerRequests,
+			cfg.BreakerWindow.Duration(), cfg.BreakerCooldown.Duration())
+	}
+
+	if cfg.Admin.Path != "" {
+		m.adminLimit = newTokenBucket(cfg.Admin.RateLimit, cfg.Admin.Burst)
+		m.peerLimit = newTokenBucket(peerRateLimit, peerBurst)
+	}
+
+	if len(cfg.Replication.Peers) > 0 {
+		m.replicator = newReplicator(m.storeFor, cfg.Replication)
+		go m.replicator.run(ctx)
+	}
+
+	m.setMaintenance(cfg.Maintenance)
+
+	if cfg.AccessLogPath != "" {
+		m.accessLog, err = newAccessLog(cfg.AccessLogPath, m.clock)
+		if err != nil {
+			return nil, err
+		}
+
+		go func() {
+			<-ctx.Done()
+			_ = m.accessLog.Close()
+		}()
+	}
+
+	urls, err := warmupURLs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SeedPath != "" {
+		go m.seedAtStartup(ctx)
+	}
+
+	if len(urls) > 0 {
+		go m.warmup(ctx, urls)
 	}
 
 	return m, nil
 }
 
+// openVolumes opens the storage spanning paths, as configured.
+func openVolumes(ctx context.Context, cfg *Config, paths []string, vacuum time.Duration,
+	clk clock) (*volumeSet, error) {
+	s, err := newVolumeSet(ctx, paths, vacuum, cfg.VacuumWorkers, newExpiryBuckets(cfg.ExpiryBuckets), clk)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range s.volumes {
+		v.readOnly = cfg.ReadOnly
+		v.shared = cfg.SharedPath
+		v.signer = newEntrySigner(cfg.SigningKey)
+		v.checkFormat()
+	}
+
+	return s, nil
+}
+
+// setStatusDefaults fills in the status header settings left empty.
+func setStatusDefaults(cfg *Config) {
+	defaults := []struct {
+		field *string
+		value string
+	}{
+		{&cfg.StatusHeader, cacheHeader},
+		{&cfg.StatusHit, cacheHitStatus},
+		{&cfg.StatusMiss, cacheMissStatus},
+		{&cfg.StatusStale, cacheStaleStatus},
+		{&cfg.StatusError, cacheErrorStatus},
+	}
+
+	for _, d := range defaults {
+		if *d.field == "" {
+			*d.field = d.value
+		}
+	}
+}
+
 type cacheData struct {
 	Status  int
 	Headers map[string][]string
 	Body    []byte
+	// Stored is the time the response was received from the origin.
+	Stored  time.Time
+	Expires time.Time
+	// Delta is the time it took to fetch the response from the origin.
+	Delta time.Duration
+	// Hints are the Link headers of the 103 Early Hints sent by the origin.
+	Hints []string
+}
+
+// clone returns a copy of the entry metadata, without its body.
+func (d *cacheData) clone() *cacheData {
+	return &cacheData{
+		Status:  d.Status,
+		Headers: http.Header(d.Headers).Clone(),
+		Stored:  d.Stored,
+		Expires: d.Expires,
+		Delta:   d.Delta,
+		Hints:   d.Hints,
+	}
 }
 
 // ServeHTTP serves an HTTP request.
 func (m *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	cs := cacheMissStatus
+	if m.serveControl(w, r) {
+		return
+	}
+
+	if m.bypass(r) {
+		if m.inMaintenance() {
+			w.WriteHeader(m.cfg.MaintenanceStatus)
+			return
+		}
+
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	removeUnkeyedHeaders(r, m.cfg.UnkeyedHeaders)
+
+	if m.dryRun != nil {
+		m.serveDryRun(w, r)
+		return
+	}
+
+	if m.cfg.ESI && r.Method == http.MethodGet && !isESIFragment(r) {
+		m.serveESI(w, r)
+		return
+	}
+
+	m.serveCached(w, r)
+}
+
+// serveCached serves r from the cache, or from the origin on a miss.
+func (m *cache) serveCached(w http.ResponseWriter, r *http.Request) {
+	now := m.clock.Now()
+	start, cs := now, cacheMissStatus
 
-	key := cacheKey(r)
+	key := m.requestKey(r)
+
+	data, body, err := m.lookupRequest(r, key)
+	if err == nil && m.rulesFor(r).banned(r.URL.Path, data.Stored) {
+		_ = body.Close()
+		err = errBanned
+	}
 
-	b, err := m.cache.Get(key)
 	if err == nil {
-		var data cacheData
+		defer func() { _ = body.Close() }()
 
-		err := json.Unmarshal(b, &data)
-		if err != nil {
-			cs = cacheErrorStatus
-		} else {
-			for key, vals := range data.Headers {
-				for _, val := range vals {
-					w.Header().Add(key, val)
-				}
-			}
-			if m.cfg.AddStatusHeader {
-				w.Header().Set(cacheHeader, cacheHitStatus)
-			}
-			w.WriteHeader(data.Status)
-			_, _ = w.Write(data.Body)
+		dropESIConditions(w, r, data)
+	}
+
+	switch {
+	case err == nil && !data.Expires.Before(now):
+		n := m.serveData(w, r, data, body, cacheHitStatus)
+		m.logDecision(start, key, cacheHitStatus, data.Expires.Sub(now), n)
+		m.refreshAhead(r, key, data)
+		m.refreshEarly(r, key, data)
+		return
+	case err == nil && m.staleAllowed(r, data, now) && m.staleUsable(data, now):
+		n := m.serveData(w, r, data, body, cacheStaleStatus)
+		m.logDecision(start, key, cacheStaleStatus, data.Expires.Sub(now), n)
+		m.refresh(r, key)
+		return
+	case err != nil && !errors.Is(err, errCacheMiss):
+		cs = cacheErrorStatus
+	}
+
+	m.serveMiss(w, r, key, cs, start)
+}
+
+// serveControl serves the requests to the health and control endpoints, and
+// reports whether r was one of them.
+func (m *cache) serveControl(w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case m.cfg.HealthPath != "" && r.URL.Path == m.cfg.HealthPath:
+		m.serveHealth(w, r)
+	case m.isAdmin(r):
+		m.serveAdmin(w, r)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// serveMiss fetches the response from the origin, unless r only accepts a
+// stored response, the cache is in maintenance mode or the lookup failed and
+// the cache fails closed. In read-only mode, and for range requests, the
+// request is forwarded without capturing the response.
+func (m *cache) serveMiss(w http.ResponseWriter, r *http.Request, key, cs string, start time.Time) {
+	status := 0
+
+	// A range starting at the first byte is the full body, which can be
+	// fetched and stored instead.
+	if r.Header.Get("Range") == "bytes=0-" {
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+	}
+
+	now := m.clock.Now()
+
+	allowed, probe := true, uint64(0)
+	if !onlyIfCached(r) && !m.inMaintenance() {
+		allowed, probe = m.breaker.Allow(now)
+	}
+
+	switch {
+	case onlyIfCached(r):
+		status = http.StatusGatewayTimeout
+	case m.inMaintenance():
+		status = m.cfg.MaintenanceStatus
+	case !allowed:
+		status = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(m.breaker.RetryAfter(now).Seconds()))))
+	case cs == cacheErrorStatus && m.cfg.OnError == failClosed:
+		status = http.StatusServiceUnavailable
+	case m.cfg.ReadOnly || r.Header.Get("Range") != "":
+		m.setStatusHeader(w, cs)
+		m.next.ServeHTTP(w, r)
+		m.logDecision(start, key, cs, 0, 0)
+		return
+	default:
+		m.fetchCoalesced(w, withProbe(r, probe), key, cs, start)
+		return
+	}
+
+	m.setStatusHeader(w, cs)
+	w.WriteHeader(status)
+	m.logDecision(start, key, cs, 0, 0)
+}
+
+// inMaintenance reports whether the cache is in maintenance mode, where only
+// stored responses are served, even expired ones, and the origin is never
+// contacted.
+func (m *cache) inMaintenance() bool {
+	return atomic.LoadInt32(&m.maintenance) == 1
+}
+
+// setMaintenance enters or leaves maintenance mode. Expired entries are kept
+// in maintenance mode, where they are the only copy of the site.
+func (m *cache) setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+
+	for _, s := range m.stores() {
+		s.Retain(on)
+	}
+
+	atomic.StoreInt32(&m.maintenance, v)
+}
+
+// fetchCoalesced fetches the response from the origin, coalescing concurrent
+// misses on the same key: only the leader goes to the origin, the others wait
+// for its response.
+func (m *cache) fetchCoalesced(w http.ResponseWriter, r *http.Request, key, cs string, start time.Time) {
+	call, leader := m.flights.Join(key)
+	if !leader {
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+
+		if call.stored && m.serveStored(w, r, key, start) {
 			return
 		}
+
+		m.fetch(w, r, key, cs, start, nil)
+		return
 	}
 
-	if m.cfg.AddStatusHeader {
-		w.Header().Set(cacheHeader, cs)
+	var stored bool
+	defer func() { m.flights.Done(key, call, stored) }()
+
+	stored = m.fetch(w, r, key, cs, start, call)
+}
+
+// serveStored serves the entry stored by a coalesced request. It reports
+// whether the entry could be served.
+func (m *cache) serveStored(w http.ResponseWriter, r *http.Request, key string, start time.Time) bool {
+	data, body, err := m.lookupVariant(r, key)
+	if err != nil {
+		return false
 	}
 
-	rw := &responseWriter{ResponseWriter: w}
-	m.next.ServeHTTP(rw, r)
+	defer func() { _ = body.Close() }()
 
-	expiry, ok := m.cacheable(r, w, rw.status)
-	if !ok {
-		return
+	n := m.serveData(w, r, data, body, cacheHitStatus)
+	m.logDecision(start, key, cacheHitStatus, data.Expires.Sub(m.clock.Now()), n)
+
+	return true
+}
+
+// lookup returns the cache entry for key, which may be stale, and a reader
+// over its body. The reader must be closed if no error is returned.
+func (m *cache) lookup(ctx context.Context, key string) (*cacheData, io.ReadCloser, error) {
+	if m.memory != nil {
+		if b, ok := m.memory.Get(key); ok {
+			return decodeBytes(b)
+		}
 	}
 
-	data := cacheData{
-		Status:  rw.status,
-		Headers: w.Header(),
-		Body:    rw.body,
+	e, err := m.storeFor(key).Open(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if m.memory != nil {
+		if size, err := e.Size(); err == nil && m.memory.Admits(int(size)) {
+			b, err := ioutil.ReadAll(e)
+			_ = e.Close()
+			if err != nil {
+				return nil, nil, fmt.Errorf("error reading cache item: %w", err)
+			}
+
+			m.memory.Add(key, b, e.Expires())
+
+			return decodeBytes(b)
+		}
 	}
 
-	b, err = json.Marshal(data)
+	data, err := decodeData(e)
 	if err != nil {
-		log.Printf("Error serializing cache item: %v", err)
+		_ = e.Close()
+		return nil, nil, fmt.Errorf("error deserializing cache item: %w", err)
 	}
 
-	if err = m.cache.Set(key, b, expiry); err != nil {
-		log.Printf("Error setting cache item: %v", err)
+	return data, e, nil
+}
+
+// decodeBytes decodes an entry held in memory.
+func decodeBytes(b []byte) (*cacheData, io.ReadCloser, error) {
+	r := bytes.NewReader(b)
+
+	data, err := decodeData(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error deserializing cache item: %w", err)
 	}
+
+	return data, readSeekNopCloser{r}, nil
 }
 
-func (m *cache) cacheable(r *http.Request, w http.ResponseWriter, status int) (time.Duration, bool) {
-	reasons, expireBy, err := cachecontrol.CachableResponseWriter(r, status, w, cachecontrol.Options{})
-	if err != nil || len(reasons) > 0 {
-		return 0, false
+// readSeekNopCloser is an io.ReadSeeker with a no-op Close method, unlike
+// ioutil.NopCloser, which hides Seek.
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
+
+// inGrace reports whether the expired entry may still be served while it is
+// being refreshed.
+func (m *cache) inGrace(data *cacheData, now time.Time) bool {
+	grace := m.cfg.GracePeriod.Duration()
+
+	return grace > 0 && now.Sub(data.Expires) <= grace
+}
+
+// retention returns how long an entry expiring after expiry is kept, to be
+// served stale during the grace period, while the origin throttles or when it
+// cannot be reached.
+func (m *cache) retention(expiry time.Duration) time.Duration {
+	stale := m.cfg.GracePeriod.Duration()
+
+	for _, d := range []Duration{m.cfg.ThrottleStaleAge, m.cfg.OfflineStaleAge} {
+		if d.Duration() > stale {
+			stale = d.Duration()
+		}
 	}
 
-	expiry := time.Until(expireBy)
-	maxExpiry := time.Duration(m.cfg.MaxExpiry) * time.Second
+	return expiry + stale
+}
 
-	if maxExpiry < expiry {
-		expiry = maxExpiry
+// staleAllowed reports whether the expired entry data of r may be served:
+// during the grace period, or while the origin must not be contacted.
+func (m *cache) staleAllowed(r *http.Request, data *cacheData, now time.Time) bool {
+	return m.inGrace(data, now) || m.inMaintenance() || m.throttledFor(r.Host, data, now) || m.breaker.Open(now)
+}
+
+// staleUsable reports whether the expired entry data is recent enough to be
+// served stale, whatever allows it.
+func (m *cache) staleUsable(data *cacheData, now time.Time) bool {
+	maxAge := m.cfg.MaxStaleAge.Duration()
+
+	return maxAge <= 0 || now.Sub(data.Expires) <= maxAge
+}
+
+// refresh fetches a new version of the entry in the background, unless
+// another request is already fetching it.
+func (m *cache) refresh(r *http.Request, key string) {
+	if now := m.clock.Now(); m.inMaintenance() || m.cfg.ReadOnly || m.throttled(r.Host, now) || m.breaker.Open(now) {
+		return
+	}
+
+	call, leader := m.flights.Join(key)
+	if !leader {
+		return
 	}
 
-	return expiry, true
+	req := r.Clone(context.Background())
+
+	go func() {
+		var stored bool
+		defer func() { m.flights.Done(key, call, stored) }()
+
+		stored = m.fetch(newDiscardWriter(), req, key, cacheRefreshDecision, m.clock.Now(), call)
+	}()
 }
 
-func cacheKey(r *http.Request) string {
-	return r.Method + r.Host + r.URL.Path
+// serveData writes a cached response, streaming its body. It returns the
+// number of body bytes written.
+func (m *cache) serveData(w http.ResponseWriter, r *http.Request, data *cacheData, body io.Reader, status string) int {
+	writeEarlyHints(w, data.Hints)
+
+	for key, vals := range data.Headers {
+		for _, val := range vals {
+			w.Header().Add(key, val)
+		}
+	}
+	if !interimResponses {
+		addLinks(w.Header(), data.Hints)
+	}
+	setHitHeaders(w.Header(), m.cfg.HitHeaders)
+
+	m.setClientCacheControl(w.Header())
+	setAge(w.Header(), data, m.clock.Now())
+	m.setStatusHeader(w, status)
+
+	if data.Status == http.StatusOK && notModified(r, w.Header()) {
+		writeNotModified(w)
+		return 0
+	}
+
+	if rs, ok := body.(io.ReadSeeker); ok && data.Status == http.StatusOK {
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		if rangeRequested(r, w.Header()) {
+			if n, served := serveRange(w, r, rs); served {
+				return n
+			}
+		}
+	}
+
+	w.WriteHeader(data.Status)
+
+	n, err := io.Copy(w, body)
+	if errors.Is(err, errChecksumMismatch) || errors.Is(err, errSignatureMismatch) {
+		// The response is under way, the client must not take it as complete.
+		panic(http.ErrAbortHandler)
+	}
+
+	return int(n)
 }
 
-type responseWriter struct {
-	http.ResponseWriter
-	status int
-	body   []byte
+// writeEarlyHints replays the early hints sent by the origin with a stored
+// response, before the response itself, on runtimes sending interim
+// responses.
+func writeEarlyHints(w http.ResponseWriter, hints []string) {
+	if len(hints) == 0 || !interimResponses {
+		return
+	}
+
+	// The stored headers, added next, carry their own Link headers.
+	h := w.Header()
+	h["Link"] = hints
+	w.WriteHeader(http.StatusEarlyHints)
+	h.Del("Link")
 }
 
-func (rw *responseWriter) Header() http.Header {
-	return rw.ResponseWriter.Header()
+// addLinks adds the early hints missing from the Link headers of h, for
+// runtimes which cannot send them as interim responses.
+func addLinks(h http.Header, hints []string) {
+	links := make(map[string]bool)
+	for _, link := range h.Values("Link") {
+		links[link] = true
+	}
+
+	for _, hint := range hints {
+		if !links[hint] {
+			h.Add("Link", hint)
+		}
+	}
 }
 
-func (rw *responseWriter) Write(p []byte) (int, error) {
-	rw.body = append(rw.body, p...)
-	return rw.ResponseWriter.Write(p)
+// writeInterim forwards the interim response of status s to w, on runtimes
+// sending interim responses. Otherwise, its headers are left to the final
+// response, which the status would replace.
+func writeInterim(w http.ResponseWriter, s int) {
+	if interimResponses {
+		w.WriteHeader(s)
+	}
 }
 
-func (rw *responseWriter) WriteHeader(s int) {
-	rw.status = s
-	rw.ResponseWriter.WriteHeader(s)
+// setHitHeaders overrides the stored headers with the configured ones. Headers
+// configured with an empty value are removed.
+func setHitHeaders(h http.Header, headers map[string]string) {
+	for name, value := range headers {
+		if value == "" {
+			h.Del(name)
+			continue
+		}
+
+		h.Set(name, value)
+	}
 }
+
+// setAge sets the Age header of a replayed response to its age when it was
+// stored, plus the time it has been stored for, so that clients compute its
+// remaining freshness correctly. The Date header is set to the time the
+// response was stored if the origin did not send one.
+func setAge(h http.Header, data *cacheData, now time.Time) {
+	if data.Stored.IsZero() {
+		return
+	}
+
+	if h.Get("Date") == "" {
+		h.Set("Date", data.Stored.UTC().Format(http.TimeFormat))
+	}
+
+	age, err := strconv.Atoi(h.Get("Age"))
+	if err != nil || age < 0 {
+		age = 0
+	}
+
+	if resident := now.Sub(data.Stored); resident > 0 {
+		age += int(resident / time.Second)
+	}
+
+	h.Set("Age", strconv.Itoa(age))
+}
+
+// setClientCacheControl rewrites the Cache-Control header sent to the client,
+// according to the clientCacheControl rules.
+func (m *cache) setClientCacheControl(h http.Header) {
+	if v, ok := clientCacheControl(m.cfg.ClientCacheControl, h.Get("Content-Type")); ok {
+		h.Set("Cache-Control", v)
+	}
+}
+
+// fetch forwards the request to the next handler and stores the response if
+// it is cacheable. It reports whether the response was stored. call is the
+// in-flight call led by the request, if any.
+func (m *cache) fetch(w http.ResponseWriter, r *http.Request, key, cs string, start time.Time, call *flightCall) bool {
+	m.setStatusHeader(w, cs)
+
+	rw := &responseWriter{
+		ResponseWriter: w,
+		body:           newSpillBuffer(m.cache.TempDir(), m.cfg.BufferSize),
+		maxSize:        int64(m.cfg.MaxItemBytes),
+		streaming:      m.cfg.StreamingTypes,
+		optIn:          optInFilter{header: m.cfg.RequireOptInHeader},
+		onHeader:       m.setClientCacheControl,
+	}
+
+	if m.cfg.ThrottleStaleAge.Duration() > 0 || m.cfg.OfflineStaleAge.Duration() > 0 {
+		rw.fallback = &originFallback{m: m, r: r, key: key}
+	}
+
+	if call != nil {
+		// Streaming responses may never end, followers must not wait for them.
+		rw.onStreaming = func() { m.flights.Done(key, call, false) }
+	}
+	defer func() { _ = rw.body.Close() }()
+
+	fetchStart := time.Now()
+
+	// Responses which cannot be stored are not captured.
+	var (
+		expiry   time.Duration
+		admitted bool
+	)
+
+	rw.decide = func(status int, h http.Header) bool {
+		expiry, admitted = m.cacheable(r, h, status)
+		admitted = admitted && m.admit(key, cs, time.Since(fetchStart))
+
+		return admitted
+	}
+
+	m.next.ServeHTTP(rw, r)
+	delta := time.Since(fetchStart)
+
+	m.breaker.Record(probeOf(r), rw.status >= http.StatusInternalServerError, m.clock.Now())
+
+	if rw.replaced {
+		n := rw.fallback.serve(w)
+		m.logDecision(start, key, cacheStaleStatus, 0, n)
+
+		return false
+	}
+
+	// Handlers writing nothing implicitly respond with a 200.
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+		rw.optIn.Strip(w.Header())
+		rw.captureHeader()
+		rw.admit(rw.status)
+	}
+
+	rw.captureTrailers()
+
+	size := int(rw.written)
+
+	// Responses to clients gone meanwhile may be incomplete.
+	ctx := r.Context()
+
+	ok := admitted && storable(rw.status, rw.header)
+	if !ok || !rw.optIn.Allowed() || rw.err != nil || ctx.Err() != nil {
+		m.logDecision(start, key, cs, 0, size)
+		return false
+	}
+
+	now := m.clock.Now()
+
+	data := &cacheData{
+		Status:  rw.status,
+		Headers: rw.header,
+		Stored:  now,
+		Expires: now.Add(expiry),
+		Delta:   delta,
+		Hints:   rw.hints,
+	}
+
+	for _, name := range m.cfg.StripHeaders {
+		http.Header(data.Headers).Del(name)
+	}
+
+	// Only replayed responses carry the generated validators, the response
+	// fetched has already been sent.
+	if rw.digest != nil {
+		m.addValidators(data.Headers, rw.digest, now)
+	}
+
+	retention := m.retention(expiry)
+
+	if body, inMemory := rw.body.Bytes(); inMemory && m.cfg.Compress && compressible(data, body) {
+		addVary(data.Headers, "Accept-Encoding")
+		m.storeGzip(ctx, key, data, body, retention)
+	}
+
+	var err error
+	if body, inMemory := rw.body.Bytes(); inMemory {
+		err = m.store(ctx, key, data, body, retention)
+	} else {
+		err = m.storeFrom(ctx, key, data, rw.body, retention)
+	}
+
+	if err != nil {
+		m.logStoreError(err)
+		m.logDecision(start, key, cs, 0, size)
+		return false
+	}
+
+	m.logDecision(start, key, cs, expiry, size)
+
+	return true
+}
+
+// store writes the entry and its body to the cache at once, keeping it for
+// the given retention.
+func (m *cache) store(ctx context.Context, key string, data *cacheData, body []byte, retention time.Duration) error {
+	meta, err := data.encodeMeta()
+	if err != nil {
+		return fmt.Errorf("error serializing cache item: %w", err)
+	}
+
+	if m.memory != nil {
+		defer m.memory.Delete(key)
+	}
+
+	if err = m.storeFor(key).SetParts(ctx, key, [][]byte{meta, body}, retention); err != nil {
+		return err
+	}
+
+	m.replicator.Push(key)
+
+	return nil
+}
+
+// logStoreError logs an error storing an entry. Skipped writes are not
+// logged, the error that suspended them already was.
+func (m *cache) logStoreError(err error) {
+	if !errors.Is(err, errWritesSuspended) {
+		log.Printf("Error setting cache item: %v", err)
+	}
+}
+
+// storeFrom writes the entry to the cache, streaming its body from the
+// spilled buffer.
+func (m *cache) storeFrom(ctx context.Context, key string, data *cacheData, buf *spillBuffer,
+	retention time.Duration) error {
+	meta, err := data.encodeMeta()
+	if err != nil {
+		return fmt.Errorf("error serializing cache item: %w", err)
+	}
+
+	body, err := buf.Reader()
+	if err != nil {
+		return err
+	}
+
+	if m.memory != nil {
+		defer m.memory.Delete(key)
+	}
+
+	if err = m.storeFor(key).SetFrom(ctx, key, io.MultiReader(bytes.NewReader(meta), body), retention); err != nil {
+		return err
+	}
+
+	m.replicator.Push(key)
+
+	return nil
+}
+
+// setStatusHeader sets the configured cache status header for the given status.
+func (m *cache) setStatusHeader(w http.ResponseWriter, status string) {
+	if !m.cfg.AddStatusHeader {
+		return
+	}
+
+	var val string
+	switch status {
+	case cacheHitStatus:
+		val = m.cfg.StatusHit
+	case cacheStaleStatus:
+		val = m.cfg.StatusStale
+	case cacheErrorStatus:
+		val = m.cfg.StatusError
+	default:
+		val = m.cfg.StatusMiss
+	}
+
+	w.Header().Set(m.cfg.StatusHeader, val)
+}
+
+func (m *cache) logDecision(start time.Time, key, decision string, ttl time.Duration, size int) {
+	if m.accessLog == nil {
+		return
+	}
+
+	if err := m.accessLog.Write(start, key, decision, ttl, size); err != nil {
+		log.Printf("Error writing access log: %v", err)
+	}
+}
+
+func (m *cache) cacheable(r *http.Request, h http.Header, status int) (time.Duration, bool) {
+	if !storable(status, h) {
+		return 0, false
+	}
+
+	if m.cfg.DeceptionCheck && !matchesExtension(r.URL.Path, h.Get("Content-Type")) {
+		return 0, false
+	}
+
+	rules := m.rulesFor(r)
+	contentType := h.Get("Content-Type")
+
+	if !allowedContentType(contentType, rules.CacheContentTypes, rules.NoCacheContentTypes) {
+		return 0, false
+	}
+
+	reasons, expireBy, err := m.responseExpiry(r, status, h)
+	if err != nil {
+		return 0, false
+	}
+
+	if m.isNegative(status) {
+		return m.negativeExpiry(reasons)
+	}
+
+	if rule, ok := matchRule(rules.TTLRules, r.URL.Path); ok {
+		return m.ruleExpiry(rule, status, h, reasons, expireBy)
+	}
+
+	if expiry, ok := m.microExpiry(status, reasons); ok {
+		return expiry, true
+	}
+
+	if !containsStatus(m.cfg.CacheableStatus, status) || len(reasons) > 0 {
+		return 0, false
+	}
+
+	return m.originExpiry(expireBy, contentType), true
+}
+
+// storable reports whether a response with the given status and headers can
+// be stored and replayed faithfully. Partial responses are not stored, as they
+// would be replayed to requests for the full resource. Trailers are not
+// stored, so responses declaring them are not cached either. Authentication
+// challenges are never stored, whatever the configuration, as they are
+// specific to the client that triggered them.
+func storable(status int, h http.Header) bool {
+	if status == http.StatusPartialContent || h.Get("Content-Range") != "" {
+		return false
+	}
+
+	if isChallenge(status, h) {
+		return false
+	}
+
+	if len(h.Values("Trailer")) > 0 {
+		return false
+	}
+
+	for name := range h {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// microExpiry returns the micro-caching TTL, if enabled, which replaces the
+// expiry set by the origin of the 200 responses. Responses which must not be
+// stored are not micro-cached.
+func (m *cache) microExpiry(status int, reasons []cacheobject.Reason) (time.Duration, bool) {
+	ttl := m.cfg.MicroCacheTTL.Duration()
+	if ttl <= 0 || status != http.StatusOK || len(reasons) > 0 {
+		return 0, false
+	}
+
+	return ttl, true
+}
+
+// isChallenge reports whether a response with the given status and headers is
+// an authentication challenge.
+func isChallenge(status int, h http.Header) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusProxyAuthRequired:
+		return true
+	}
+
+	return h.Get("WWW-Authenticate") != "" || h.Get("Proxy-Authenticate") != ""
+}
+
+// isNegative reports whether responses with the given status are negatively
+// cached.
+func (m *cache) isNegative(status int) bool {
+	return m.cfg.NegativeTTL.Duration() > 0 && containsStatus(m.cfg.NegativeStatus, status)
+}
+
+// containsMethod reports whether method is one of methods.
+func containsMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsStatus(statuses []int, status int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negativeExpiry returns the expiry of a negatively cached response. It is
+// stored for NegativeTTL regardless of its freshness information, unless it
+// must not be stored at all.
+func (m *cache) negativeExpiry(reasons []cacheobject.Reason) (time.Duration, bool) {
+	for _, reason := range reasons {
+		if reason != cacheobject.ReasonResponseUncachableByDefault {
+			return 0, false
+		}
+	}
+
+	return m.capExpiry(m.cfg.NegativeTTL.Duration()), true
+}
+
+// responseExpiry evaluates the cacheability of a response and the time it
+// expires by, as of the cache clock.
+func (m *cache) responseExpiry(r *http.Request, status int, h http.Header) ([]cacheobject.Reason, time.Time, error) {
+	reasons, _, _, obj, err := cacheobject.UsingRequestResponseWithObject(r, status, h, false)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	obj.NowUTC = m.clock.Now().UTC()
+
+	var rv cacheobject.ObjectResults
+
+	cacheobject.ExpirationObject(obj, &rv)
+	if rv.OutErr != nil {
+		return nil, time.Time{}, rv.OutErr
+	}
+
+	return reasons, rv.OutExpirationTime, nil
+}
+
+// originExpiry returns the expiry of a response expiring at the time set by
+// the origin, limited to the configured maximums.
+func (m *cache) originExpiry(expireBy time.Time, contentType string) time.Duration {
+	return capTypeExpiry(m.cfg.TypeTTLs, contentType, m.capExpiry(expireBy.Sub(m.clock.Now())))
+}
+
+// capExpiry limits expiry to the configured maximum, if any.
+func (m *cache) capExpiry(expiry time.Duration) time.Duration {
+	maxExpiry := m.cfg.MaxExpiry.Duration()
+
+	if maxExpiry > 0 && maxExpiry < expiry {
+		expiry = maxExpiry
+	}
+
+	return expiry
+}
+
+// bypass reports whether r must be passed through untouched. This is the case
+// of methods that are not cached, protocol upgrades, OPTIONS requests such as
+// CORS preflights, which depend on request headers, and streaming protocols
+// such as gRPC, which cannot be buffered. Requests asking for it with the
+// bypass header or a bypass cookie are passed through too, as well as the
+// requests of humans when only crawlers are served from the cache, and the
+// requests of no tenant when the cache is partitioned.
+func (m *cache) bypass(r *http.Request) bool {
+	if m.bypassRequested(r) || !containsMethod(m.cfg.Methods, r.Method) || m.cfg.BotsOnly && !m.isBot(r) {
+		return true
+	}
+
+	// Requests of no tenant cannot be given a partition.
+	if m.partitioned() && m.tenant(r) == "" {
+		return true
+	}
+
+	return r.Method == http.MethodOptions || isUpgrade(r) ||
+		hasTypePrefix(r.Header.Get("Content-Type"), m.cfg.BypassTypes) || m.hasBypassCookie(r)
+}
+
+// bypassRequested reports whether r asks to bypass the cache with the bypass
+// header, whose value must match the bypass token if one is configured. The
+// header is removed, so that it never reaches the origin.
+func (m *cache) bypassRequested(r *http.Request) bool {
+	if m.cfg.BypassHeader == "" {
+		return false
+	}
+
+	v := r.Header.Get(m.cfg.BypassHeader)
+	r.Header.Del(m.cfg.BypassHeader)
+
+	if v == "" {
+		return false
+	}
+
+	return m.cfg.BypassToken == "" || subtle.ConstantTimeCompare([]byte(v), []byte(m.cfg.BypassToken)) == 1
+}
+
+// onlyIfCached reports whether r only accepts a stored response, with the
+// only-if-cached directive.
+func onlyIfCached(r *http.Request) bool {
+	for _, v := range r.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "only-if-cached") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hasBypassCookie reports whether r carries a cookie matching one of the
+// bypass cookie patterns, such as a session cookie of a logged-in user.
+func (m *cache) hasBypassCookie(r *http.Request) bool {
+	patterns := m.rulesFor(r).BypassCookies
+	if len(patterns) == 0 {
+		return false
+	}
+
+	for _, cookie := range r.Cookies() {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, cookie.Name); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// lookupRequest looks up the entry for r, unless r asks to refresh it.
+func (m *cache) lookupRequest(r *http.Request, key string) (*cacheData, io.ReadCloser, error) {
+	if m.refreshRequested(r) {
+		return nil, nil, errCacheMiss
+	}
+
+	return m.lookupVariant(r, key)
+}
+
+// refreshRequested reports whether r asks to refresh its entry with the
+// refresh query parameter, configured as a name, matching any value, or as
+// name=value. The parameter is removed, so that it never reaches the origin.
+func (m *cache) refreshRequested(r *http.Request) bool {
+	query := m.rulesFor(r).RefreshQuery
+	if query == "" || r.URL.RawQuery == "" {
+		return false
+	}
+
+	name, value := query, ""
+	if i := strings.IndexByte(name, '='); i >= 0 {
+		name, value = name[:i], name[i+1:]
+	}
+
+	var (
+		kept      []string
+		requested bool
+	)
+
+	for _, part := range strings.Split(r.URL.RawQuery, "&") {
+		k, v := part, ""
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			k, v = part[:i], part[i+1:]
+		}
+
+		if unescaped, err := url.QueryUnescape(k); err != nil || unescaped != name {
+			kept = append(kept, part)
+			continue
+		}
+
+		v, _ = url.QueryUnescape(v)
+		requested = requested || value == "" || v == value
+	}
+
+	r.URL.RawQuery = strings.Join(kept, "&")
+
+	return requested
+}
+
+// isUpgrade reports whether r asks for a protocol upgrade, such as WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return true
+	}
+
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// cacheKey returns the key of the entry for r. Keys start with the request
+// method, so that HEAD entries, which have no body, are never replayed to GET
+// requests, and the other way around. Host names are case insensitive, so
+// the host is lowercased.
+func cacheKey(r *http.Request) string {
+	return r.Method + strings.ToLower(r.Host) + r.URL.Path
+}
+
+// keyRequest returns a request for urlPath on host with the given method, to
+// get the key of its entry from cacheKey or requestKey for the entries stored
+// or looked up outside of a client request.
+func keyRequest(method, host, urlPath string) *http.Request {
+	return &http.Request{Method: method, Host: host, URL: &url.URL{Path: urlPath}, Header: http.Header{}}
+}
+
+var (
+	errItemTooLarge = errors.New("response exceeds the maximum item size")
+	errHijacked     = errors.New("connection hijacked")
+	errStreaming    = errors.New("streaming response")
+	errNotAdmitted  = errors.New("response not admitted")
+	errBanned       = fmt.Errorf("%w: entry banned", errCacheMiss)
+)
+
+type responseWriter struct {
+	http.ResponseWriter
+	status  int
+	body    *spillBuffer
+	maxSize int64
+	written int64
+	err     error
+
+	// streaming lists the content types of streaming responses, which are
+	// never captured. onStreaming is called when such a response starts.
+	streaming   []string
+	onStreaming func()
+
+	optIn optInFilter
+
+	// header holds the headers of the origin response, captured before
+	// onHeader rewrites those sent to the client.
+	header   http.Header
+	onHeader func(http.Header)
+
+	// decide, if set, reports whether the response with the given status and
+	// origin headers may be stored. Otherwise, it is not captured.
+	decide func(status int, h http.Header) bool
+
+	// hints are the Link headers of the 103 Early Hints sent so far.
+	hints []string
+
+	// digest hashes the body of responses without validators, to give them a
+	// weak entity tag.
+	digest hash.Hash
+
+	// fallback, if set, may replace the response by a stored one, in which
+	// case nothing is written.
+	fallback *originFallback
+	replaced bool
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.ResponseWriter.Header()
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if rw.replaced {
+		return len(p), nil
+	}
+
+	rw.capture(p)
+
+	n, err := rw.ResponseWriter.Write(p)
+	rw.written += int64(n)
+
+	// The client is gone, the rest of the response is not captured.
+	if err != nil && rw.err == nil {
+		rw.err = err
+		_ = rw.body.Close()
+	}
+
+	return n, err
+}
+
+// ReadFrom writes the content of r to the response. Once the response is no
+// longer captured, r is handed to the underlying response writer if it is an
+// io.ReaderFrom, so that it can use sendfile on supported platforms.
+func (rw *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if rw.replaced {
+		return io.Copy(ioutil.Discard, r)
+	}
+
+	if rf, ok := rw.ResponseWriter.(io.ReaderFrom); ok && rw.err != nil {
+		n, err := rf.ReadFrom(r)
+		rw.written += n
+
+		return n, err
+	}
+
+	// Hide ReadFrom from io.Copy, which would call it again.
+	return io.Copy(struct{ io.Writer }{rw}, r)
+}
+
+// capture buffers p for caching. Once the response exceeds the maximum item
+// size, capture stops and the buffer is released, while the response keeps
+// being streamed to the client.
+func (rw *responseWriter) capture(p []byte) {
+	if rw.err != nil {
+		return
+	}
+
+	if rw.maxSize > 0 && rw.body.Len()+int64(len(p)) > rw.maxSize {
+		rw.err = errItemTooLarge
+		_ = rw.body.Close()
+
+		return
+	}
+
+	_, rw.err = rw.body.Write(p)
+
+	if rw.digest != nil {
+		_, _ = rw.digest.Write(p)
+	}
+}
+
+func (rw *responseWriter) WriteHeader(s int) {
+	if isInformational(s) {
+		if s == http.StatusEarlyHints {
+			rw.hints = append(rw.hints, rw.Header().Values("Link")...)
+		}
+
+		writeInterim(rw.ResponseWriter, s)
+
+		return
+	}
+
+	rw.status = s
+	rw.optIn.Strip(rw.Header())
+
+	if rw.fallback != nil && rw.fallback.Replace(s, rw.Header()) {
+		rw.replaced = true
+		rw.err = errThrottled
+		_ = rw.body.Close()
+
+		return
+	}
+
+	if s == http.StatusOK && !hasValidator(rw.Header()) {
+		rw.digest = sha256.New()
+	}
+
+	if rw.err == nil && rw.isStreaming() {
+		rw.err = errStreaming
+		_ = rw.body.Close()
+
+		if rw.onStreaming != nil {
+			rw.onStreaming()
+		}
+	}
+
+	rw.captureHeader()
+	rw.admit(s)
+	rw.ResponseWriter.WriteHeader(s)
+}
+
+// admit stops capturing the response with status s if it may not be stored.
+func (rw *responseWriter) admit(s int) {
+	if rw.err != nil || rw.decide == nil || rw.decide(s, rw.header) {
+		return
+	}
+
+	rw.err = errNotAdmitted
+	rw.digest = nil
+	_ = rw.body.Close()
+}
+
+// captureHeader keeps the headers of the origin response for storage, then
+// rewrites those sent to the client.
+func (rw *responseWriter) captureHeader() {
+	rw.header = rw.Header().Clone()
+
+	if rw.onHeader != nil {
+		rw.onHeader(rw.Header())
+	}
+}
+
+// captureTrailers adds the trailers set once the body is written to the
+// captured headers, so that the response is not stored.
+func (rw *responseWriter) captureTrailers() {
+	for name, vals := range rw.Header() {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			rw.header[name] = vals
+		}
+	}
+}
+
+// isInformational reports whether s is the status of an interim response,
+// which is followed by the final one.
+func isInformational(s int) bool {
+	return s >= 100 && s < 200 && s != http.StatusSwitchingProtocols
+}
+
+// isStreaming reports whether the response has a streaming content type.
+func (rw *responseWriter) isStreaming() bool {
+	return hasTypePrefix(rw.Header().Get("Content-Type"), rw.streaming)
+}
+
+// hasTypePrefix reports whether the content type ct starts with one of types,
+// ignoring case.
+func hasTypePrefix(ct string, types []string) bool {
+	ct = strings.ToLower(ct)
+	for _, t := range types {
+		if strings.HasPrefix(ct, strings.ToLower(t)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Flush sends any buffered data to the client, if the underlying response
+// writer supports it. The body keeps being captured for caching.
+func (rw *responseWriter) Flush() {
+	if rw.replaced {
+		return
+	}
+
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the next handler take over the connection, for protocol
+// upgrades such as WebSocket. Hijacked responses are never cached.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", rw.ResponseWriter)
+	}
+
+	rw.err = errHijacked
+	_ = rw.body.Close()
+
+	return h.Hijack()
+}
+
+// discardWriter is a response writer that discards everything written to it,
+// used for background requests.
+type discardWriter struct {
+	header http.Header
+}
+
+func newDiscardWriter() *discardWriter {
+	return &discardWriter{header: http.Header{}}
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (d *discardWriter) WriteHeader(int) {}
@@ -1,15 +1,32 @@
 package plugin_simplecache
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
+	// Valid configurations start a vacuum of the cache path, which must not be
+	// a shared directory.
+	dir := createTempDir(t)
+
 	tests := []struct {
 		name    string
 		cfg     *Config
@@ -17,22 +34,111 @@ func TestNew(t *testing.T) {
 	}{
 		{
 			name:    "should error if path is not valid",
-			cfg:     &Config{Path: "/foo/bar", MaxExpiry: 300, Cleanup: 600},
+			cfg:     &Config{Path: "/foo/bar", MaxExpiry: "300", Cleanup: "600"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if maxExpiry < 1",
+			cfg:     &Config{Path: dir, MaxExpiry: "0.5", Cleanup: "600"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if cleanup < 1",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "0.5"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if a bypass cookie pattern is not valid",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "600", BypassCookies: []string{"session["}},
+			wantErr: true,
+		},
+		{
+			name:    "should error if a content type pattern is not valid",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "600", NoCacheContentTypes: []string{"video/["}},
+			wantErr: true,
+		},
+		{
+			name:    "should error if maxExpiry is negative",
+			cfg:     &Config{Path: dir, MaxExpiry: "-1", Cleanup: "600"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if onError is not valid",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "600", OnError: "sometimes"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if admissionSampleRate > 1",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "600", AdmissionSampleRate: 1.5},
+			wantErr: true,
+		},
+		{
+			name:    "should error if seedPath is set without seedHost",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "600", SeedPath: dir, SeedTTL: "1h"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if a bot network is not valid",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "600", BotNetworks: []string{"10.0.0.0/33"}},
+			wantErr: true,
+		},
+		{
+			name: "should error if both tenant sources are set",
+			cfg: &Config{
+				Path: dir, MaxExpiry: "300", Cleanup: "600", TenantHeader: "X-Tenant", TenantClientCert: true,
+				Tenants: []string{"a"},
+			},
 			wantErr: true,
 		},
 		{
-			name:    "should error if maxExpiry <= 1",
-			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 1, Cleanup: 600},
+			name:    "should error if the tenants are not listed",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "600", TenantHeader: "X-Tenant"},
 			wantErr: true,
 		},
 		{
-			name:    "should error if cleanup <= 1",
-			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 1},
+			name:    "should error if the breaker error rate is above 1",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "600", BreakerErrorRate: 1.5},
 			wantErr: true,
 		},
+		{
+			name: "should error if replication peers are set without a token",
+			cfg: &Config{
+				Path: dir, MaxExpiry: "300", Cleanup: "600",
+				Replication: ReplicationConfig{Peers: []string{"http://10.0.0.2/_cache"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "should error if a replication peer is not an absolute URL",
+			cfg: &Config{
+				Path: dir, MaxExpiry: "300", Cleanup: "600",
+				Replication: ReplicationConfig{Peers: []string{"10.0.0.2/_cache"}, Token: "secret"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "should error if both path and paths are set",
+			cfg:     &Config{Path: dir, Paths: []string{dir}, MaxExpiry: "300", Cleanup: "600"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if a path is listed twice",
+			cfg:     &Config{Paths: []string{dir, dir + "/"}, MaxExpiry: "300", Cleanup: "600"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if expiryBuckets is not valid",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "600", ExpiryBuckets: "week"},
+			wantErr: true,
+		},
+		{
+			name:    "should be valid with the vacuum disabled",
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "-1"},
+			wantErr: false,
+		},
 		{
 			name:    "should be valid",
-			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600},
+			cfg:     &Config{Path: dir, MaxExpiry: "300", Cleanup: "600"},
 			wantErr: false,
 		},
 	}
@@ -56,7 +162,7 @@ func TestCache_ServeHTTP(t *testing.T) {
 		rw.WriteHeader(http.StatusOK)
 	}
 
-	cfg := &Config{Path: dir, MaxExpiry: 10, Cleanup: 20, AddStatusHeader: true}
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
 
 	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
 	if err != nil {
@@ -81,6 +187,2151 @@ func TestCache_ServeHTTP(t *testing.T) {
 	}
 }
 
+func TestCache_ServeHTTP_CoalescesMisses(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	release := make(chan struct{})
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("hello"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20"}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			rw := httptest.NewRecorder()
+
+			c.ServeHTTP(rw, req)
+
+			if body := rw.Body.String(); body != "hello" {
+				t.Errorf("unexpected body: want \"hello\", got %q", body)
+			}
+		}()
+	}
+
+	// Give all requests time to join the in-flight call.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("unexpected origin calls: want 1, got %d", n)
+	}
+}
+
+func TestCache_ServeHTTP_GracePeriod(t *testing.T) {
+	dir := createTempDir(t)
+
+	refreshed := make(chan struct{})
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		defer close(refreshed)
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("fresh"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, GracePeriod: "60"}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	// Store an entry that expired 10 seconds ago.
+	data := &cacheData{Status: http.StatusOK, Body: []byte("stale"), Expires: time.Now().Add(-10 * time.Second)}
+
+	b, err := data.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.cache.Set(context.Background(), cacheKey(req), b, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != "stale" {
+		t.Errorf("unexpected cache state: want \"stale\", got: %q", state)
+	}
+
+	if body := rw.Body.String(); body != "stale" {
+		t.Errorf("unexpected body: want \"stale\", got %q", body)
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("entry was not refreshed in the background")
+	}
+
+	// Wait for the refreshed entry to be stored.
+	if call, leader := c.flights.Join(cacheKey(req)); leader {
+		c.flights.Done(cacheKey(req), call, false)
+	} else {
+		<-call.done
+	}
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != "hit" {
+		t.Errorf("unexpected cache state: want \"hit\", got: %q", state)
+	}
+
+	if body := rw.Body.String(); body != "fresh" {
+		t.Errorf("unexpected body: want \"fresh\", got %q", body)
+	}
+}
+
+func TestCache_ServeHTTP_Memory(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("hello"))
+	}
+
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		MemoryBudget: 1024, MemoryItemSize: 1024,
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	// The first hit is read from disk and kept in memory.
+	c.ServeHTTP(httptest.NewRecorder(), req)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err = os.Remove(keyPath(dir, cacheKey(req))); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != "hit" {
+		t.Errorf("unexpected cache state: want \"hit\", got: %q", state)
+	}
+
+	if body := rw.Body.String(); body != "hello" {
+		t.Errorf("unexpected body: want \"hello\", got %q", body)
+	}
+}
+
+func TestCache_ServeHTTP_NegativeCaching(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		cacheControl string
+		wantState    string
+	}{
+		{
+			name:      "should cache 404 without freshness information",
+			status:    http.StatusNotFound,
+			wantState: "hit",
+		},
+		{
+			name:      "should cache 451 without freshness information",
+			status:    http.StatusUnavailableForLegalReasons,
+			wantState: "hit",
+		},
+		{
+			name:         "should not cache 404 with no-store",
+			status:       http.StatusNotFound,
+			cacheControl: "no-store",
+			wantState:    "miss",
+		},
+		{
+			name:      "should not cache 500",
+			status:    http.StatusInternalServerError,
+			wantState: "miss",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := createTempDir(t)
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				if test.cacheControl != "" {
+					rw.Header().Set("Cache-Control", test.cacheControl)
+				}
+				rw.WriteHeader(test.status)
+			}
+
+			cfg := CreateConfig()
+			cfg.Path = dir
+			cfg.NegativeTTL = "5"
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+			c.ServeHTTP(httptest.NewRecorder(), req)
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+
+			if rw.Code != test.status {
+				t.Errorf("unexpected status code: want %d, got %d", test.status, rw.Code)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTP_SpillToDisk(t *testing.T) {
+	dir := createTempDir(t)
+
+	content := strings.Repeat("large content ", 1000)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+
+		for i := 0; i < len(content); i += 100 {
+			_, _ = rw.Write([]byte(content[i : i+100]))
+		}
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, BufferSize: 512}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != "hit" {
+		t.Errorf("unexpected cache state: want \"hit\", got: %q", state)
+	}
+
+	if rw.Body.String() != content {
+		t.Error("unexpected body")
+	}
+
+	// Spill files are removed once the response is stored.
+	matches, err := filepath.Glob(filepath.Join(dir, ".spill-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(matches) > 0 {
+		t.Errorf("unexpected spill files: %v", matches)
+	}
+}
+
+func TestCache_ServeHTTP_MaxItemBytes(t *testing.T) {
+	dir := createTempDir(t)
+
+	content := strings.Repeat("large content ", 100)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+
+		for i := 0; i < len(content); i += 100 {
+			_, _ = rw.Write([]byte(content[i : i+100]))
+		}
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, BufferSize: 256, MaxItemBytes: 512}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != "miss" {
+			t.Errorf("unexpected cache state: want \"miss\", got: %q", state)
+		}
+
+		if rw.Body.String() != content {
+			t.Error("unexpected body")
+		}
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, ".spill-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(matches) > 0 {
+		t.Errorf("unexpected spill files: %v", matches)
+	}
+}
+
+func TestCache_ServeHTTP_StatusHeader(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path:            dir,
+		MaxExpiry:       "10",
+		Cleanup:         "20",
+		AddStatusHeader: true,
+		StatusHeader:    "X-Edge-Cache",
+		StatusHit:       "HIT",
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	for _, want := range []string{"miss", "HIT"} {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("X-Edge-Cache"); state != want {
+			t.Errorf("unexpected cache state: want %q, got: %q", want, state)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != "" {
+			t.Errorf("unexpected default cache status header: %q", state)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_AccessLog(t *testing.T) {
+	dir := createTempDir(t)
+	logPath := filepath.Join(dir, "access.log")
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("hello"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AccessLogPath: logPath}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	c.ServeHTTP(httptest.NewRecorder(), req)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	b, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected access log lines: want 2, got %d", len(lines))
+	}
+
+	for i, want := range []string{"miss", "hit"} {
+		var e accessLogEntry
+		if err = json.Unmarshal([]byte(lines[i]), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Decision != want || e.Key != cacheKey(req) || e.Size != 5 || e.TTL <= 0 {
+			t.Errorf("unexpected access log entry %d: %+v", i, e)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_Flush(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("hello "))
+
+		f, ok := rw.(http.Flusher)
+		if !ok {
+			t.Fatal("expected response writer to implement http.Flusher")
+		}
+		f.Flush()
+
+		_, _ = rw.Write([]byte("world"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	rw := httptest.NewRecorder()
+
+	c.ServeHTTP(rw, req)
+
+	if !rw.Flushed {
+		t.Error("expected response to be flushed")
+	}
+
+	rw = httptest.NewRecorder()
+
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != "hit" {
+		t.Errorf("unexpected cache state: want \"hit\", got: %q", state)
+	}
+
+	if body := rw.Body.String(); body != "hello world" {
+		t.Errorf("unexpected body: want %q, got: %q", "hello world", body)
+	}
+}
+
+func TestCache_ServeHTTP_Hijack(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("unexpected hijack error: %v", err)
+			return
+		}
+
+		defer func() { _ = conn.Close() }()
+
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello")
+		_ = buf.Flush()
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20"}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/some/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(body) != "hello" {
+			t.Errorf("unexpected body: want \"hello\", got %q", body)
+		}
+	}
+
+	// Hijacked responses are not cached.
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("unexpected origin calls: want 2, got %d", n)
+	}
+}
+
+func TestCache_ServeHTTP_Upgrade(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		if _, ok := rw.(*httptest.ResponseRecorder); !ok {
+			t.Errorf("unexpected response writer: want the original writer, got %T", rw)
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusSwitchingProtocols)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{name: "upgrade", header: http.Header{"Upgrade": {"websocket"}}},
+		{name: "connection", header: http.Header{"Connection": {"keep-alive, Upgrade"}}},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			req.Header = test.header
+			rw := httptest.NewRecorder()
+
+			c.ServeHTTP(rw, req)
+
+			if state := rw.Header().Get("Cache-Status"); state != "" {
+				t.Errorf("%s: unexpected cache state: want none, got: %q", test.name, state)
+			}
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("unexpected origin calls: want 4, got %d", n)
+	}
+}
+
+func TestCache_ServeHTTP_Streaming(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		_, _ = rw.Write([]byte("data: hello\n\n"))
+		rw.(http.Flusher).Flush()
+	}
+
+	cfg := CreateConfig()
+	cfg.Path = dir
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/events", nil)
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != "miss" {
+			t.Errorf("unexpected cache state: want \"miss\", got: %q", state)
+		}
+
+		if body := rw.Body.String(); body != "data: hello\n\n" {
+			t.Errorf("unexpected body: got %q", body)
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("unexpected origin calls: want 2, got %d", n)
+	}
+}
+
+func TestCache_ServeHTTP_StreamingNotCoalesced(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	release := make(chan struct{})
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.WriteHeader(http.StatusOK)
+
+		// The first stream stays open until released.
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.Path = dir
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaderDone := make(chan struct{})
+
+	go func() {
+		defer close(leaderDone)
+
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/events", nil))
+	}()
+
+	// Wait for the first stream to start.
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	followerDone := make(chan struct{})
+
+	go func() {
+		defer close(followerDone)
+
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/events", nil))
+	}()
+
+	select {
+	case <-followerDone:
+	case <-time.After(5 * time.Second):
+		t.Error("second stream waited for the first one")
+	}
+
+	close(release)
+	<-leaderDone
+}
+
+func TestCache_ServeHTTP_Corrupted(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	p := keyPath(dir, cacheKey(req))
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := f.Stat()
+	if err == nil {
+		_, err = f.WriteAt([]byte("x"), info.Size()-1)
+	}
+	_ = f.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The corruption is only detected once the body is streamed.
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("unexpected panic: want %v, got %v", http.ErrAbortHandler, r)
+			}
+		}()
+
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	if _, err = os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("expected corrupted entry to be deleted, got: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != cacheMissStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheMissStatus, state)
+	}
+}
+
+func TestCache_ServeHTTP_Trailers(t *testing.T) {
+	tests := []struct {
+		name string
+		next http.HandlerFunc
+	}{
+		{
+			name: "declared",
+			next: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.Header().Set("Trailer", "X-Checksum")
+				_, _ = rw.Write([]byte("hello"))
+				rw.Header().Set("X-Checksum", "abc")
+			},
+		},
+		{
+			name: "prefixed",
+			next: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				_, _ = rw.Write([]byte("hello"))
+				rw.Header().Set(http.TrailerPrefix+"X-Checksum", "abc")
+			},
+		},
+	}
+
+	for _, test := range tests {
+		dir := createTempDir(t)
+
+		cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+		c, err := New(context.Background(), test.next, cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			if state := rw.Header().Get("Cache-Status"); state != "miss" {
+				t.Errorf("%s: unexpected cache state: want \"miss\", got: %q", test.name, state)
+			}
+		}
+	}
+}
+
+func TestCache_ServeHTTP_PartialContent(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Content-Range", "bytes 0-4/11")
+		rw.WriteHeader(http.StatusPartialContent)
+		_, _ = rw.Write([]byte("hello"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != "miss" {
+			t.Errorf("unexpected cache state: want \"miss\", got: %q", state)
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("unexpected origin calls: want 2, got %d", n)
+	}
+}
+
+func TestCache_ServeHTTP_CacheableStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		cacheable []int
+		status    int
+		state     string
+	}{
+		{name: "default ok", status: http.StatusOK, state: "hit"},
+		{name: "default error", status: http.StatusServiceUnavailable, state: "miss"},
+		{name: "configured error", cacheable: []int{503}, status: http.StatusServiceUnavailable, state: "hit"},
+		{name: "configured ok", cacheable: []int{503}, status: http.StatusOK, state: "miss"},
+	}
+
+	for _, test := range tests {
+		dir := createTempDir(t)
+
+		status := test.status
+		next := func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Cache-Control", "max-age=20")
+			rw.WriteHeader(status)
+		}
+
+		cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, CacheableStatus: test.cacheable}
+
+		c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.name, test.state, state)
+		}
+	}
+}
+
+func TestSetAge(t *testing.T) {
+	stored := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		headers http.Header
+		stored  time.Time
+		date    string
+		age     string
+	}{
+		{
+			name:   "no origin headers",
+			stored: stored,
+			date:   "Sun, 13 Sep 2020 12:00:00 GMT",
+			age:    "30",
+		},
+		{
+			name:    "origin headers",
+			headers: http.Header{"Date": {"Sun, 13 Sep 2020 11:59:50 GMT"}, "Age": {"10"}},
+			stored:  stored,
+			date:    "Sun, 13 Sep 2020 11:59:50 GMT",
+			age:     "40",
+		},
+		{
+			name:    "unknown storage time",
+			headers: http.Header{"Age": {"10"}},
+			age:     "10",
+		},
+	}
+
+	for _, test := range tests {
+		h := http.Header{}
+		for name, values := range test.headers {
+			h[name] = values
+		}
+
+		setAge(h, &cacheData{Stored: test.stored}, stored.Add(30*time.Second))
+
+		if date := h.Get("Date"); date != test.date {
+			t.Errorf("%s: unexpected date: want %q, got %q", test.name, test.date, date)
+		}
+
+		if age := h.Get("Age"); age != test.age {
+			t.Errorf("%s: unexpected age: want %q, got %q", test.name, test.age, age)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_Range(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader("hello world"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	tests := []struct {
+		desc       string
+		path       string
+		rangeValue string
+		state      string
+		status     int
+		body       string
+	}{
+		{
+			desc: "stored", path: "/some/path", rangeValue: "bytes=0-4",
+			state: cacheHitStatus, status: http.StatusPartialContent, body: "hello",
+		},
+		{
+			desc: "multiple ranges", path: "/some/path", rangeValue: "bytes=0-1,3-4",
+			state: cacheHitStatus, status: http.StatusOK, body: "hello world",
+		},
+		{
+			desc: "not stored", path: "/other/path", rangeValue: "bytes=6-",
+			state: cacheMissStatus, status: http.StatusPartialContent, body: "world",
+		},
+		{desc: "partial response not stored", path: "/other/path", state: cacheMissStatus, status: http.StatusOK},
+		{
+			desc: "full range", path: "/full/path", rangeValue: "bytes=0-",
+			state: cacheMissStatus, status: http.StatusOK, body: "hello world",
+		},
+		{desc: "full range stored", path: "/full/path", state: cacheHitStatus, status: http.StatusOK, body: "hello world"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+		if test.rangeValue != "" {
+			req.Header.Set("Range", test.rangeValue)
+		}
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s: unexpected status: want %d, got %d", test.desc, test.status, rw.Code)
+		}
+
+		if body := rw.Body.String(); test.body != "" && body != test.body {
+			t.Errorf("%s: unexpected body: want %q, got %q", test.desc, test.body, body)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.desc, test.state, state)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_Options(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		rw.WriteHeader(http.StatusNoContent)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, origin := range []string{"https://a.example", "https://b.example"} {
+		req := httptest.NewRequest(http.MethodOptions, "http://localhost/some/path", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if got := rw.Header().Get("Access-Control-Allow-Origin"); got != origin {
+			t.Errorf("unexpected allowed origin: want %q, got %q", origin, got)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != "" {
+			t.Errorf("unexpected cache state: want none, got: %q", state)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_BypassHeader(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		if v := req.Header.Get("X-Simplecache-Bypass"); v != "" {
+			t.Errorf("unexpected bypass header forwarded to the origin: %q", v)
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		BypassHeader: "X-SimpleCache-Bypass", BypassToken: "secret",
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value string
+		calls int
+		state string
+	}{
+		{value: "secret", calls: 1, state: ""},
+		{value: "", calls: 2, state: cacheMissStatus},
+		{value: "secret", calls: 3, state: ""},
+		{value: "wrong", calls: 3, state: cacheHitStatus},
+		{value: "", calls: 3, state: cacheHitStatus},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		if test.value != "" {
+			req.Header.Set("X-SimpleCache-Bypass", test.value)
+		}
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if calls != test.calls {
+			t.Errorf("request %d: unexpected origin calls: want %d, got %d", i, test.calls, calls)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("request %d: unexpected cache state: want %q, got: %q", i, test.state, state)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_RefreshQuery(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		if req.URL.RawQuery != "a=1&b=2" {
+			t.Errorf("unexpected query forwarded to the origin: want %q, got %q", "a=1&b=2", req.URL.RawQuery)
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = fmt.Fprintf(rw, "body %d", calls)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, RefreshQuery: "cache=false"}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url   string
+		state string
+		body  string
+	}{
+		{url: "/some/path?a=1&b=2", state: cacheMissStatus, body: "body 1"},
+		{url: "/some/path?a=1&cache=false&b=2", state: cacheMissStatus, body: "body 2"},
+		{url: "/some/path?a=1&b=2", state: cacheHitStatus, body: "body 2"},
+		{url: "/some/path?a=1&b=2&cache=true", state: cacheHitStatus, body: "body 2"},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.url, nil)
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("request %d: unexpected cache state: want %q, got: %q", i, test.state, state)
+		}
+
+		if body := rw.Body.String(); body != test.body {
+			t.Errorf("request %d: unexpected body: want %q, got: %q", i, test.body, body)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_BypassCookies(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		BypassCookies: []string{"sessionid", "wordpress_logged_in_*"},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cookie string
+		state  string
+	}{
+		{cookie: "sessionid=abc", state: ""},
+		{cookie: "theme=dark; wordpress_logged_in_0123=user", state: ""},
+		{cookie: "", state: cacheMissStatus},
+		{cookie: "theme=dark; sessionid_old=abc", state: cacheHitStatus},
+		{cookie: "theme=dark; sessionid=abc", state: ""},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		if test.cookie != "" {
+			req.Header.Set("Cookie", test.cookie)
+		}
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("request %d: unexpected cache state: want %q, got: %q", i, test.state, state)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_OnlyIfCached(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cacheControl string
+		status       int
+		calls        int
+	}{
+		{cacheControl: "max-stale, only-if-cached", status: http.StatusGatewayTimeout, calls: 0},
+		{cacheControl: "", status: http.StatusOK, calls: 1},
+		{cacheControl: "only-if-cached", status: http.StatusOK, calls: 1},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		if test.cacheControl != "" {
+			req.Header.Set("Cache-Control", test.cacheControl)
+		}
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("request %d: unexpected status: want %d, got %d", i, test.status, rw.Code)
+		}
+
+		if calls != test.calls {
+			t.Errorf("request %d: unexpected origin calls: want %d, got %d", i, test.calls, calls)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_BypassTypes(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		if _, ok := rw.(*httptest.ResponseRecorder); !ok {
+			t.Errorf("unexpected response writer: want the original writer, got %T", rw)
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := CreateConfig()
+	cfg.Path = dir
+	cfg.Methods = []string{http.MethodPost}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ct := range []string{"application/grpc", "application/grpc+proto", "Application/GRPC"} {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/some.Service/Method", nil)
+		req.Header.Set("Content-Type", ct)
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != "" {
+			t.Errorf("%s: unexpected cache state: want none, got: %q", ct, state)
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("unexpected origin calls: want 3, got %d", n)
+	}
+}
+
+func TestCache_ServeHTTP_Methods(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		state  string
+	}{
+		{method: http.MethodGet, state: cacheMissStatus},
+		{method: http.MethodGet, state: cacheHitStatus},
+		{method: http.MethodHead, state: ""},
+		{method: http.MethodPost, state: ""},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(test.method, "http://localhost/some/path", nil)
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("request %d: unexpected cache state: want %q, got: %q", i, test.state, state)
+		}
+	}
+}
+
+func TestCache_CapExpiry(t *testing.T) {
+	tests := []struct {
+		maxExpiry Duration
+		expiry    time.Duration
+		want      time.Duration
+	}{
+		{maxExpiry: "5m", expiry: time.Minute, want: time.Minute},
+		{maxExpiry: "5m", expiry: time.Hour, want: 5 * time.Minute},
+		{maxExpiry: "0", expiry: 365 * 24 * time.Hour, want: 365 * 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		m := &cache{cfg: &Config{MaxExpiry: test.maxExpiry}}
+
+		if got := m.capExpiry(test.expiry); got != test.want {
+			t.Errorf("unexpected expiry for %s with maxExpiry %q: want %s, got %s",
+				test.expiry, test.maxExpiry, test.want, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_Maintenance(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}
+
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		Maintenance: true, MaintenanceStatus: http.StatusTeapot,
+		Admin: AdminConfig{Path: "/_cache", Tokens: []string{"secret"}},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	// Store an entry expired past its retention, which is kept nonetheless.
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/cached", nil)
+	data := &cacheData{Status: http.StatusOK, Expires: time.Now().Add(-time.Hour), Body: []byte("some body")}
+
+	b, err := data.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.cache.Set(context.Background(), cacheKey(req), b, -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := c.cache.volumes[0].runVacuum(); stats.Deleted != 0 {
+		t.Errorf("unexpected vacuum in maintenance mode: %+v", stats)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		state  string
+	}{
+		{method: http.MethodGet, path: "/cached", status: http.StatusOK, state: cacheStaleStatus},
+		{method: http.MethodGet, path: "/other", status: http.StatusTeapot, state: cacheMissStatus},
+		{method: http.MethodPost, path: "/cached", status: http.StatusTeapot, state: ""},
+	}
+
+	for _, test := range tests {
+		req = httptest.NewRequest(test.method, "http://localhost"+test.path, nil)
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s %s: unexpected status: want %d, got %d", test.method, test.path, test.status, rw.Code)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s %s: unexpected cache state: want %q, got: %q", test.method, test.path, test.state, state)
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("unexpected origin calls: want 0, got %d", n)
+	}
+
+	// Leaving maintenance mode contacts the origin again.
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/_cache/maintenance?enabled=false", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected maintenance status: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/cached", nil))
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("unexpected origin calls: want 1, got %d", n)
+	}
+}
+
+func TestCache_ServeHTTP_ReadOnly(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	// Pre-build the cache with a writable instance.
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/cached", nil)
+	data := &cacheData{Status: http.StatusOK, Expires: time.Now().Add(time.Minute), Body: []byte("some body")}
+
+	b, err := data.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = h.(*cache).cache.Set(context.Background(), cacheKey(req), b, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.ReadOnly = true
+
+	h, err = New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		state string
+		calls int32
+	}{
+		{path: "/cached", state: cacheHitStatus, calls: 0},
+		{path: "/other", state: cacheMissStatus, calls: 1},
+		{path: "/other", state: cacheMissStatus, calls: 2},
+	}
+
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.path, test.state, state)
+		}
+
+		if n := atomic.LoadInt32(&calls); n != test.calls {
+			t.Errorf("%s: unexpected origin calls: want %d, got %d", test.path, test.calls, n)
+		}
+	}
+
+	if err = h.(*cache).cache.Delete(cacheKey(req)); !errors.Is(err, errReadOnly) {
+		t.Errorf("unexpected delete error: want %v, got: %v", errReadOnly, err)
+	}
+}
+
+func TestCache_ServeHTTP_OnError(t *testing.T) {
+	tests := []struct {
+		onError string
+		status  int
+		calls   int32
+	}{
+		{onError: "", status: http.StatusOK, calls: 1},
+		{onError: failOpen, status: http.StatusOK, calls: 1},
+		{onError: failClosed, status: http.StatusServiceUnavailable, calls: 0},
+	}
+
+	for _, test := range tests {
+		dir := createTempDir(t)
+
+		var calls int32
+		next := func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&calls, 1)
+		}
+
+		cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, OnError: test.onError}
+
+		h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Store an entry which cannot be decoded.
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		if err = h.(*cache).cache.Set(context.Background(), cacheKey(req), []byte("garbage"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%q: unexpected status: want %d, got %d", test.onError, test.status, rw.Code)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != cacheErrorStatus {
+			t.Errorf("%q: unexpected cache state: want %q, got: %q", test.onError, cacheErrorStatus, state)
+		}
+
+		if n := atomic.LoadInt32(&calls); n != test.calls {
+			t.Errorf("%q: unexpected origin calls: want %d, got %d", test.onError, test.calls, n)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_MicroCache(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		if cc := req.URL.Query().Get("cc"); cc != "" {
+			rw.Header().Set("Cache-Control", cc)
+		}
+
+		if req.URL.Path == "/missing" {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "300", Cleanup: "20", AddStatusHeader: true, MicroCacheTTL: "2s"}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	tests := []struct {
+		url   string
+		state string
+	}{
+		{url: "/dynamic", state: cacheHitStatus},
+		{url: "/long?cc=max-age=3600", state: cacheHitStatus},
+		{url: "/private?cc=private", state: cacheMissStatus},
+		{url: "/nostore?cc=no-store", state: cacheMissStatus},
+		{url: "/missing", state: cacheMissStatus},
+	}
+
+	for _, test := range tests {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+test.url, nil))
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.url, nil)
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.url, test.state, state)
+		}
+
+		if test.state != cacheHitStatus {
+			continue
+		}
+
+		data, body, lookupErr := c.lookupRequest(req, cacheKey(req))
+		if lookupErr != nil {
+			t.Fatal(lookupErr)
+		}
+		_ = body.Close()
+
+		if ttl := data.Expires.Sub(data.Stored); ttl != 2*time.Second {
+			t.Errorf("%s: unexpected ttl: want %s, got %s", test.url, 2*time.Second, ttl)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_HitHeaders(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Server", "origin")
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20",
+		HitHeaders: map[string]string{
+			"X-Served-By":                 "edge-1",
+			"Access-Control-Allow-Origin": "https://example.com",
+			"Server":                      "",
+		},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	if got := rw.Header().Get("X-Served-By"); got != "" {
+		t.Errorf("unexpected hit header on a miss: %q", got)
+	}
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	want := map[string]string{
+		"X-Served-By":                 "edge-1",
+		"Access-Control-Allow-Origin": "https://example.com",
+		"Server":                      "",
+	}
+
+	for name, value := range want {
+		if got := rw.Header().Get(name); got != value {
+			t.Errorf("unexpected %s header: want %q, got: %q", name, value, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_ClientCacheControl(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		rw.Header().Set("Content-Type", "text/html")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20",
+		ClientCacheControl: []CacheControlRule{{Type: "text/html", Value: "max-age=0, must-revalidate"}},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the miss and the hit are rewritten.
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if cc := rw.Header().Get("Cache-Control"); cc != "max-age=0, must-revalidate" {
+			t.Errorf("unexpected Cache-Control header: want %q, got: %q", "max-age=0, must-revalidate", cc)
+		}
+	}
+
+	// The stored response keeps the origin header.
+	data, body, err := h.(*cache).lookupRequest(req, cacheKey(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = body.Close()
+
+	if cc := http.Header(data.Headers).Get("Cache-Control"); cc != "max-age=3600" {
+		t.Errorf("unexpected stored Cache-Control header: want %q, got: %q", "max-age=3600", cc)
+	}
+}
+
+func TestCache_ServeHTTP_MaxStaleAge(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected origin request for %s", req.URL.Path)
+	}
+
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		Maintenance: true, MaxStaleAge: "10m",
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	tests := []struct {
+		path    string
+		expired time.Duration
+		status  int
+		state   string
+	}{
+		{path: "/recent", expired: time.Minute, status: http.StatusOK, state: cacheStaleStatus},
+		{path: "/old", expired: time.Hour, status: http.StatusServiceUnavailable, state: cacheMissStatus},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+		data := &cacheData{Status: http.StatusOK, Expires: time.Now().Add(-test.expired), Body: []byte("some body")}
+
+		b, err := data.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = c.cache.Set(context.Background(), cacheKey(req), b, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s: unexpected status: want %d, got %d", test.path, test.status, rw.Code)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.path, test.state, state)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_StripHeaders(t *testing.T) {
+	tests := []struct {
+		desc         string
+		stripHeaders []string
+		auth         string
+	}{
+		{desc: "default", stripHeaders: nil, auth: ""},
+		{desc: "disabled", stripHeaders: []string{}, auth: "Bearer secret"},
+	}
+
+	for _, test := range tests {
+		dir := createTempDir(t)
+
+		next := func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Cache-Control", "max-age=20")
+			rw.Header().Set("Authorization", "Bearer secret")
+			rw.Header().Set("X-Kept", "kept")
+			rw.WriteHeader(http.StatusOK)
+		}
+
+		cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", StripHeaders: test.stripHeaders}
+
+		h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		if auth := rw.Header().Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("%s: unexpected Authorization header on the miss: %q", test.desc, auth)
+		}
+
+		rw = httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		if auth := rw.Header().Get("Authorization"); auth != test.auth {
+			t.Errorf("%s: unexpected Authorization header on the hit: want %q, got: %q", test.desc, test.auth, auth)
+		}
+
+		if kept := rw.Header().Get("X-Kept"); kept != "kept" {
+			t.Errorf("%s: unexpected X-Kept header on the hit: %q", test.desc, kept)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_Challenges(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "public, max-age=20")
+
+		switch req.URL.Path {
+		case "/401":
+			rw.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			rw.WriteHeader(http.StatusUnauthorized)
+		case "/407":
+			rw.WriteHeader(http.StatusProxyAuthRequired)
+		case "/challenge":
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="test"`)
+			rw.WriteHeader(http.StatusOK)
+		}
+	}
+
+	// Even settings caching everything do not store challenges.
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		CacheableStatus: []int{http.StatusOK, http.StatusUnauthorized, http.StatusProxyAuthRequired},
+		NegativeTTL:     "10", NegativeStatus: []int{http.StatusUnauthorized, http.StatusProxyAuthRequired},
+		TTLRules:     []TTLRule{{Path: "/*", TTL: "10", Override: true}},
+		StripHeaders: []string{},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/401", "/407", "/challenge"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != cacheMissStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", p, cacheMissStatus, state)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_EarlyHints(t *testing.T) {
+	const link = "</style.css>; rel=preload; as=style"
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Link", link)
+		rw.WriteHeader(http.StatusEarlyHints)
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, state := range []string{cacheMissStatus, cacheHitStatus} {
+		var hints []string
+
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header.Values("Link")...)
+				}
+				return nil
+			},
+		}
+
+		ctx := httptrace.WithClientTrace(context.Background(), trace)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		if got := resp.Header.Get("Cache-Status"); got != state {
+			t.Errorf("unexpected cache state: want %q, got: %q", state, got)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status: want %d, got: %d", state, http.StatusOK, resp.StatusCode)
+		}
+
+		// Runtimes which cannot send interim responses send the hints with
+		// the final response.
+		if !interimResponses {
+			hints = resp.Header.Values("Link")
+		}
+
+		if len(hints) != 1 || hints[0] != link {
+			t.Errorf("%s: unexpected early hints: want %q, got: %q", state, []string{link}, hints)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_ClientGone(t *testing.T) {
+	dir := createTempDir(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("hello"))
+
+		// The client disconnects in the middle of the response.
+		cancel()
+		_, _ = rw.Write([]byte(" world"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != "miss" {
+		t.Errorf("unexpected cache state: want \"miss\", got: %q", state)
+	}
+}
+
+// readerFromResponseRecorder is a response recorder implementing
+// io.ReaderFrom.
+type readerFromResponseRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom int
+}
+
+func (r *readerFromResponseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom++
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestCache_ServeHTTP_ReadFrom(t *testing.T) {
+	tests := []struct {
+		contentType string
+		state       string
+		readFrom    int
+	}{
+		{contentType: "text/plain", state: "hit"},
+		{contentType: "text/event-stream", state: "miss", readFrom: 1},
+	}
+
+	for _, test := range tests {
+		dir := createTempDir(t)
+
+		contentType := test.contentType
+		next := func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Cache-Control", "max-age=20")
+			rw.Header().Set("Content-Type", contentType)
+			_, _ = rw.(io.ReaderFrom).ReadFrom(strings.NewReader("hello"))
+		}
+
+		cfg := CreateConfig()
+		cfg.Path = dir
+
+		c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rw := &readerFromResponseRecorder{ResponseRecorder: httptest.NewRecorder()}
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		if body := rw.Body.String(); body != "hello" {
+			t.Errorf("%s: unexpected body: want \"hello\", got %q", test.contentType, body)
+		}
+
+		if rw.readFrom != test.readFrom {
+			t.Errorf("%s: unexpected ReadFrom calls: want %d, got %d", test.contentType, test.readFrom, rw.readFrom)
+		}
+
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		if state := rec.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.contentType, test.state, state)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_Head(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Content-Length", "5")
+
+		if req.Method != http.MethodHead {
+			_, _ = rw.Write([]byte("hello"))
+		}
+	}
+
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		Methods: []string{http.MethodGet, http.MethodHead},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		state  string
+		body   string
+	}{
+		{method: http.MethodHead, state: "miss"},
+		{method: http.MethodGet, state: "miss", body: "hello"},
+		{method: http.MethodHead, state: "hit"},
+		{method: http.MethodGet, state: "hit", body: "hello"},
+	}
+
+	for i, test := range tests {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(test.method, "http://localhost/some/path", nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%d %s: unexpected cache state: want %q, got: %q", i, test.method, test.state, state)
+		}
+
+		if body := rw.Body.String(); body != test.body {
+			t.Errorf("%d %s: unexpected body: want %q, got %q", i, test.method, test.body, body)
+		}
+	}
+}
+
+var (
+	loadTest    = flag.Duration("loadtest", 0, "run the load test for the given duration")
+	loadClients = flag.Int("loadclients", 16, "number of concurrent load test clients")
+	loadKeys    = flag.Int("loadkeys", 1000, "number of distinct paths requested by the load test")
+)
+
+// TestCache_Load generates load against the cache for the duration given by
+// the -loadtest flag, and reports the throughput and hit ratio.
+func TestCache_Load(t *testing.T) {
+	if *loadTest <= 0 {
+		t.Skip("load test disabled, enable with -loadtest=<duration>")
+	}
+
+	c := newBenchCache(t, bytes.Repeat([]byte("a"), 4096))
+
+	var requests, hits int64
+
+	deadline := time.Now().Add(*loadTest)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < *loadClients; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for n := i; time.Now().Before(deadline); n += *loadClients {
+				req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost/load/%d", n%*loadKeys), nil)
+				rw := httptest.NewRecorder()
+
+				c.ServeHTTP(rw, req)
+
+				atomic.AddInt64(&requests, 1)
+				if rw.Header().Get(cacheHeader) == cacheHitStatus {
+					atomic.AddInt64(&hits, 1)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	t.Logf("%d requests in %s: %.0f req/s, %.1f%% hits", requests, *loadTest,
+		float64(requests)/loadTest.Seconds(), 100*float64(hits)/float64(requests))
+}
+
+func BenchmarkCache_ServeHTTP_Hit(b *testing.B) {
+	benchmarkHit(b, []byte("some random cache content that should be exact"))
+}
+
+func BenchmarkCache_ServeHTTP_LargeBody(b *testing.B) {
+	benchmarkHit(b, bytes.Repeat([]byte("a"), 4*1024*1024))
+}
+
+func benchmarkHit(b *testing.B, body []byte) {
+	b.Helper()
+
+	c := newBenchCache(b, body)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkCache_ServeHTTP_Miss(b *testing.B) {
+	c := newBenchCache(b, []byte("some random cache content that should be exact"))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost/miss/%d", i), nil)
+		c.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkCache_ServeHTTP_ConcurrentMiss(b *testing.B) {
+	c := newBenchCache(b, []byte("some random cache content that should be exact"))
+
+	var n int64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&n, 1)
+
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost/miss/%d", i), nil)
+			c.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+}
+
+func BenchmarkCache_ServeHTTP_VacuumUnderLoad(b *testing.B) {
+	c := newBenchCache(b, []byte("some random cache content that should be exact"))
+
+	for i := 0; i < 1000; i++ {
+		_ = c.cache.Set(context.Background(), fmt.Sprintf("expired-%d", i), []byte("expired"), -time.Minute)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.cache.volumes[0].vacuumOnce()
+			}
+		}
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+// newBenchCache creates a cache in front of an origin always responding with
+// a cacheable body.
+func newBenchCache(tb testing.TB, body []byte) *cache {
+	tb.Helper()
+
+	dir := createTempDir(tb)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=300")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(body)
+	}
+
+	cfg := CreateConfig()
+	cfg.Path = dir
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return h.(*cache)
+}
+
 func createTempDir(tb testing.TB) string {
 	tb.Helper()
 
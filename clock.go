@@ -0,0 +1,18 @@
+package plugin_simplecache
+
+import "time"
+
+// clock tells the time against which entries expire, become stale and leave
+// their grace period, and the time of the access log entries. It is replaced
+// in tests, so that these behaviors are checked without waiting. Latencies,
+// such as the time taken by the origin, are measured with the system clock.
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock of the system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,80 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/traefik/plugin-simplecache/storetest"
+)
+
+// testClock is a clock which only moves when told to.
+type testClock = storetest.Clock
+
+func newTestClock() *testClock {
+	return storetest.NewClock()
+}
+
+func TestCache_ServeHTTP_Clock(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "300", Cleanup: "-1", AddStatusHeader: true, GracePeriod: "60"}
+	clk := newTestClock()
+
+	h, err := newWithClock(context.Background(), http.HandlerFunc(next), cfg, "simplecache", clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	// The entry is fresh for 20 seconds, served stale for 60 more, and kept
+	// as long.
+	tests := []struct {
+		desc    string
+		elapsed time.Duration
+		state   string
+		calls   int32
+	}{
+		{desc: "first request", elapsed: 0, state: cacheMissStatus, calls: 1},
+		{desc: "fresh", elapsed: 19 * time.Second, state: cacheHitStatus, calls: 1},
+		{desc: "stale within the grace period", elapsed: 30 * time.Second, state: cacheStaleStatus, calls: 2},
+		{desc: "refreshed", elapsed: 45 * time.Second, state: cacheHitStatus, calls: 2},
+		{desc: "past the grace period", elapsed: 3 * time.Minute, state: cacheMissStatus, calls: 3},
+	}
+
+	var elapsed time.Duration
+
+	for _, test := range tests {
+		clk.Add(test.elapsed - elapsed)
+		elapsed = test.elapsed
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if test.state == cacheStaleStatus {
+			waitRefresh(c, cacheKey(req))
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.desc, test.state, state)
+		}
+
+		if n := atomic.LoadInt32(&calls); n != test.calls {
+			t.Errorf("%s: unexpected origin calls: want %d, got %d", test.desc, test.calls, n)
+		}
+	}
+}
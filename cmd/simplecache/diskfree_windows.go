@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// diskFree is not supported on Windows.
+func diskFree(string) (int64, error) {
+	return 0, errors.New("disk free space is not supported on windows")
+}
@@ -0,0 +1,459 @@
+// Command simplecache inspects and purges the cache paths of the plugin
+// offline, for operators working directly on the cache volumes, warms the
+// cache through the proxy, and runs the middleware as a standalone reverse
+// proxy, to develop and load test the configuration outside of Traefik.
+//
+// Usage:
+//
+//	simplecache -path <dir> [-path <dir>...] <command> [arguments]
+//
+// The commands are:
+//
+//	list [-stale] [pattern...]     list the entries, with their status, size and TTLs
+//	show [-tenant t] [-headers] <url|file>
+//	                               print the headers and body of an entry
+//	delete [-tenant t] [-n] <url|pattern>...
+//	                               delete the entries of URLs, or matching file name patterns
+//	stats                          report the totals of the cache and the free disk space
+//	warm [-concurrency n] [-rate r] [-connect addr] [-header h]... <sitemap|list>...
+//	                               request the URLs of sitemaps or URL lists through the proxy
+//	serve [-config file] [-listen addr] <upstream>
+//	                               serve the middleware in front of the upstream URL
+//
+// The warm command does not read the cache paths, which can be left out. The
+// serve command reads the middleware configuration from a JSON file, the cache
+// paths given on the command line replacing the configured ones.
+//
+// Patterns are matched against the entry file names, which are made of the
+// request method, host and path, '/' being replaced with '-' and ':' with
+// '_', such as GETexample.com-blog-*.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	simplecache "github.com/traefik/plugin-simplecache"
+)
+
+// errUsage is returned for invalid command lines, once the usage is printed.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// pathList collects the values of a repeated flag.
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pathList) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
+// cli runs a command on the cache paths.
+type cli struct {
+	paths  []string
+	stdout io.Writer
+	stderr io.Writer
+	now    time.Time
+}
+
+// run runs the command line args and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("simplecache", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintln(stderr, "usage: simplecache [-path <dir>...] <command> [arguments]")
+		_, _ = fmt.Fprintln(stderr, "commands: list, show, delete, stats, warm, serve")
+		fs.PrintDefaults()
+	}
+
+	var paths pathList
+	fs.Var(&paths, "path", "cache path, repeated for caches spanning several paths")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 || (len(paths) == 0 && fs.Arg(0) != "warm" && fs.Arg(0) != "serve") {
+		fs.Usage()
+		return 2
+	}
+
+	c := &cli{paths: paths, stdout: stdout, stderr: stderr, now: time.Now()}
+
+	var err error
+
+	switch cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "list":
+		err = c.list(cmdArgs)
+	case "show":
+		err = c.show(cmdArgs)
+	case "delete":
+		err = c.delete(cmdArgs)
+	case "stats":
+		err = c.stats(cmdArgs)
+	case "warm":
+		err = c.warm(cmdArgs)
+	case "serve":
+		err = c.serve(cmdArgs)
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	switch {
+	case errors.Is(err, errUsage):
+		return 2
+	case err != nil:
+		_, _ = fmt.Fprintf(stderr, "simplecache: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// flags returns the flag set of the command name.
+func (c *cli) flags(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(c.stderr, "usage: simplecache %s %s\n", name, usage)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// parse parses args with fs, checking that there are between min and max
+// arguments left, max being unbounded if negative.
+func parse(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		return errUsage
+	}
+
+	return nil
+}
+
+// walk calls fn for every entry of the cache paths whose file name matches
+// one of patterns, or every entry if there are none. Files which cannot be
+// read as entries are reported and skipped.
+func (c *cli) walk(patterns []string, fn func(e *simplecache.StoredEntry) error) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	for _, p := range c.paths {
+		err := simplecache.WalkEntries(p, func(file string) error {
+			if !matchAny(patterns, file) {
+				return nil
+			}
+
+			e, err := simplecache.ReadEntry(file)
+			if err != nil {
+				_, _ = fmt.Fprintf(c.stderr, "simplecache: skipping %s: %v\n", file, err)
+				return nil
+			}
+
+			return fn(e)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchAny reports whether the name of file matches one of patterns, or
+// whether there are no patterns.
+func matchAny(patterns []string, file string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	name := file[strings.LastIndexAny(file, `/\`)+1:]
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// list prints the entries, fresh and stale, with their status, body size,
+// remaining freshness and time until deletion.
+func (c *cli) list(args []string) error {
+	fs := c.flags("list", "[-stale] [pattern...]")
+	staleOnly := fs.Bool("stale", false, "only list the stale entries")
+
+	if err := parse(fs, args, 0, -1); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "NAME\tSTATUS\tSIZE\tFRESH\tEXPIRES")
+
+	err := c.walk(fs.Args(), func(e *simplecache.StoredEntry) error {
+		if !e.Expires.After(c.now) || (*staleOnly && e.FreshUntil.After(c.now)) {
+			return nil
+		}
+
+		_, err := fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n",
+			e.Name(), e.Status, e.BodySize(), c.freshness(e), c.ttl(e.Expires))
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Flush()
+}
+
+// freshness returns how long e stays fresh, or "stale".
+func (c *cli) freshness(e *simplecache.StoredEntry) string {
+	if !e.FreshUntil.After(c.now) {
+		return "stale"
+	}
+
+	return c.ttl(e.FreshUntil)
+}
+
+// ttl returns the time left until t, to the second.
+func (c *cli) ttl(t time.Time) string {
+	return t.Sub(c.now).Truncate(time.Second).String()
+}
+
+// show prints the status and headers of the entry of a URL or file, then its
+// body.
+func (c *cli) show(args []string) error {
+	fs := c.flags("show", "[-tenant t] [-headers] <url|file>")
+	tenant := fs.String("tenant", "", "tenant of the entry, for caches partitioned by tenant")
+	headersOnly := fs.Bool("headers", false, "only print the status and headers")
+
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+
+	files := []string{fs.Arg(0)}
+
+	if strings.Contains(fs.Arg(0), "://") {
+		var err error
+		if files, err = c.entryFiles(*tenant, fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		e, err := simplecache.ReadEntry(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		return c.printEntry(e, *headersOnly)
+	}
+
+	return fmt.Errorf("no entry for %s", fs.Arg(0))
+}
+
+func (c *cli) printEntry(e *simplecache.StoredEntry, headersOnly bool) error {
+	_, _ = fmt.Fprintf(c.stdout, "File: %s\nStored: %s\nFresh: %s\nExpires: %s\nSigned: %t\n\n",
+		e.File, e.Stored.Format(time.RFC3339), c.freshness(e), c.ttl(e.Expires), e.Signed)
+
+	_, _ = fmt.Fprintf(c.stdout, "%d\n", e.Status)
+
+	names := make([]string, 0, len(e.Header))
+	for name := range e.Header {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range e.Header[name] {
+			_, _ = fmt.Fprintf(c.stdout, "%s: %s\n", name, value)
+		}
+	}
+
+	if headersOnly {
+		return nil
+	}
+
+	_, _ = fmt.Fprintln(c.stdout)
+
+	body, err := e.Body()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = body.Close()
+	}()
+
+	_, err = io.Copy(c.stdout, body)
+
+	return err
+}
+
+// entryFiles returns the entry files of the URL on every cache path, as
+// entries may have moved to another path while theirs was failing.
+func (c *cli) entryFiles(tenant, rawURL string) ([]string, error) {
+	var files []string
+
+	for _, p := range c.paths {
+		f, err := simplecache.EntryFiles(p, tenant, rawURL)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, f...)
+	}
+
+	return files, nil
+}
+
+// delete deletes the entries of URLs, and the entries whose file name matches
+// patterns, then prints their number.
+func (c *cli) delete(args []string) error {
+	fs := c.flags("delete", "[-tenant t] [-n] <url|pattern>...")
+	tenant := fs.String("tenant", "", "tenant of the URL entries, for caches partitioned by tenant")
+	dryRun := fs.Bool("n", false, "print the entries which would be deleted, without deleting them")
+
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+
+	var files, patterns []string
+
+	for _, arg := range fs.Args() {
+		if !strings.Contains(arg, "://") {
+			patterns = append(patterns, arg)
+			continue
+		}
+
+		f, err := c.entryFiles(*tenant, arg)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, f...)
+	}
+
+	if len(patterns) > 0 {
+		err := c.walk(patterns, func(e *simplecache.StoredEntry) error {
+			files = append(files, e.File)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var n int
+
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+
+		if *dryRun {
+			_, _ = fmt.Fprintln(c.stdout, file)
+		} else if err := os.Remove(file); err != nil {
+			return err
+		}
+
+		n++
+	}
+
+	if !*dryRun {
+		_, _ = fmt.Fprintf(c.stdout, "%d entries deleted\n", n)
+	}
+
+	return nil
+}
+
+// stats prints the number and size of the entries, fresh, stale and expired,
+// their number by status, and the free disk space of the cache paths.
+func (c *cli) stats(args []string) error {
+	fs := c.flags("stats", "")
+
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	var fresh, stale, expired, signed, size int64
+
+	statuses := make(map[int]int64)
+
+	err := c.walk(nil, func(e *simplecache.StoredEntry) error {
+		switch {
+		case !e.Expires.After(c.now):
+			expired++
+			return nil
+		case e.FreshUntil.After(c.now):
+			fresh++
+		default:
+			stale++
+		}
+
+		if e.Signed {
+			signed++
+		}
+
+		size += e.Size
+		statuses[e.Status]++
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(c.stdout, "Entries: %d (%d fresh, %d stale)\nSize: %d bytes\nSigned: %d\nExpired: %d\n",
+		fresh+stale, fresh, stale, size, signed, expired)
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+
+	sort.Ints(codes)
+
+	for _, code := range codes {
+		_, _ = fmt.Fprintf(c.stdout, "Status %d: %d\n", code, statuses[code])
+	}
+
+	for _, p := range c.paths {
+		if free, err := diskFree(p); err == nil {
+			_, _ = fmt.Fprintf(c.stdout, "Free %s: %d bytes\n", p, free)
+		}
+	}
+
+	return nil
+}
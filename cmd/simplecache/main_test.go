@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	simplecache "github.com/traefik/plugin-simplecache"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Type", "text/plain")
+		_, _ = rw.Write([]byte("body of " + req.URL.Path))
+	}
+
+	cfg := &simplecache.Config{Path: dir, MaxExpiry: "60", Cleanup: "-1"}
+
+	h, err := simplecache.New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/blog/a", "/blog/b", "/about"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+	}
+
+	tests := []struct {
+		desc string
+		args []string
+		code int
+		want []string
+		deny []string
+	}{
+		{desc: "no path", args: []string{"list"}, code: 2},
+		{desc: "unknown command", args: []string{"-path", dir, "nope"}, code: 2},
+		{
+			desc: "list", args: []string{"-path", dir, "list"},
+			want: []string{"GETlocalhost-blog-a", "GETlocalhost-blog-b", "GETlocalhost-about"},
+		},
+		{
+			desc: "list pattern", args: []string{"-path", dir, "list", "GETlocalhost-blog-*"},
+			want: []string{"GETlocalhost-blog-a", "GETlocalhost-blog-b"}, deny: []string{"about"},
+		},
+		{desc: "list stale", args: []string{"-path", dir, "list", "-stale"}, deny: []string{"GETlocalhost"}},
+		{
+			desc: "show", args: []string{"-path", dir, "show", "http://localhost/about"},
+			want: []string{"200\n", "Content-Type: text/plain\n", "\n\nbody of /about"},
+		},
+		{
+			desc: "show headers", args: []string{"-path", dir, "show", "-headers", "http://localhost/about"},
+			want: []string{"Content-Type: text/plain\n"}, deny: []string{"body of"},
+		},
+		{desc: "show missing", args: []string{"-path", dir, "show", "http://localhost/nope"}, code: 1},
+		{
+			desc: "stats", args: []string{"-path", dir, "stats"},
+			want: []string{"Entries: 3 (3 fresh, 0 stale)", "Status 200: 3"},
+		},
+		{
+			desc: "delete dry run", args: []string{"-path", dir, "delete", "-n", "GETlocalhost-blog-*"},
+			want: []string{"GETlocalhost-blog-a", "GETlocalhost-blog-b"},
+		},
+		{
+			desc: "delete pattern", args: []string{"-path", dir, "delete", "GETlocalhost-blog-*"},
+			want: []string{"2 entries deleted"},
+		},
+		{
+			desc: "delete URL", args: []string{"-path", dir, "delete", "http://localhost/about"},
+			want: []string{"1 entries deleted"},
+		},
+		{desc: "empty", args: []string{"-path", dir, "stats"}, want: []string{"Entries: 0 (0 fresh, 0 stale)"}},
+	}
+
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+
+		if code := run(test.args, &stdout, &stderr); code != test.code {
+			t.Errorf("%s: unexpected exit code: want %d, got %d: %s", test.desc, test.code, code, stderr.String())
+		}
+
+		for _, want := range test.want {
+			if !strings.Contains(stdout.String(), want) {
+				t.Errorf("%s: missing %q in output: %s", test.desc, want, stdout.String())
+			}
+		}
+
+		for _, deny := range test.deny {
+			if strings.Contains(stdout.String(), deny) {
+				t.Errorf("%s: unexpected %q in output: %s", test.desc, deny, stdout.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	simplecache "github.com/traefik/plugin-simplecache"
+)
+
+// shutdownTimeout bounds the time given to the requests in flight once the
+// server is asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+// serve runs the middleware in front of an upstream, as a standalone reverse
+// proxy, until it is interrupted.
+func (c *cli) serve(args []string) error {
+	fs := c.flags("serve", "[-config file] [-listen addr] <upstream>")
+	configFile := fs.String("config", "", "JSON file of the middleware configuration, as in the dynamic configuration")
+	listen := fs.String("listen", "localhost:8080", "address to listen on")
+
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+
+	cfg, err := c.loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := newServer(ctx, cfg, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Addr: *listen, Handler: h}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	done := make(chan error, 1)
+
+	go func() {
+		<-stop
+
+		sctx, scancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer scancel()
+
+		done <- srv.Shutdown(sctx)
+	}()
+
+	log.Printf("Serving on %s, proxying to %s", *listen, fs.Arg(0))
+
+	if err = srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return <-done
+}
+
+// loadConfig returns the configuration read from file over the defaults of
+// the middleware, the cache paths given on the command line replacing the
+// configured ones.
+func (c *cli) loadConfig(file string) (*simplecache.Config, error) {
+	cfg := simplecache.CreateConfig()
+
+	if file != "" {
+		f, err := os.Open(filepath.Clean(file))
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			_ = f.Close()
+		}()
+
+		// Unknown options are rejected, so that misspelled ones are not
+		// silently ignored.
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+
+		if err = dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", file, err)
+		}
+	}
+
+	switch len(c.paths) {
+	case 0:
+	case 1:
+		cfg.Path, cfg.Paths = c.paths[0], nil
+	default:
+		cfg.Path, cfg.Paths = "", c.paths
+	}
+
+	return cfg, nil
+}
+
+// newServer returns the middleware configured by cfg, in front of a reverse
+// proxy to upstream. As with Traefik, the Host header of the requests is
+// passed to the upstream, and errors reaching it are answered with a 502.
+func newServer(ctx context.Context, cfg *simplecache.Config, upstream string) (http.Handler, error) {
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream %q: must be an absolute http or https URL", upstream)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.FlushInterval = 100 * time.Millisecond
+
+	return simplecache.New(ctx, proxy, cfg, "simplecache")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	valid := filepath.Join(dir, "valid.json")
+	config := `{"path": "/tmp", "maxExpiry": 60, "ttlRules": [{"path": "/static/*", "ttl": "1h"}]}`
+	if err = ioutil.WriteFile(valid, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	misspelled := filepath.Join(dir, "misspelled.json")
+	if err = ioutil.WriteFile(misspelled, []byte(`{"path": "/tmp", "maxExpiri": "1m"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &cli{}
+
+	cfg, err := c.loadConfig(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Path != "/tmp" || cfg.MaxExpiry != "60" || len(cfg.TTLRules) != 1 {
+		t.Errorf("unexpected configuration: %+v", cfg)
+	}
+
+	// Defaults are kept for the options not set.
+	if cfg.StatusHeader != "Cache-Status" {
+		t.Errorf("unexpected status header: want %q, got: %q", "Cache-Status", cfg.StatusHeader)
+	}
+
+	if _, err = c.loadConfig(misspelled); err == nil {
+		t.Error("unexpected valid configuration with an unknown option")
+	}
+
+	c.paths = []string{"/a", "/b"}
+
+	cfg, err = c.loadConfig(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Path != "" || len(cfg.Paths) != 2 {
+		t.Errorf("unexpected paths: want [/a /b], got %q and %v", cfg.Path, cfg.Paths)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	var requests int
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Header().Set("Cache-Control", "max-age=60")
+		_, _ = rw.Write([]byte("body of " + req.Host + req.URL.Path))
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cfg, err := (&cli{paths: []string{dir}}).loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err = newServer(ctx, cfg, "localhost:1234"); err == nil {
+		t.Error("unexpected valid upstream without a scheme")
+	}
+
+	h, err := newServer(ctx, cfg, upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"miss", "hit"} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/some/path", nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != want {
+			t.Errorf("unexpected cache state: want %q, got: %q", want, state)
+		}
+
+		if body := rw.Body.String(); body != "body of example.com/some/path" {
+			t.Errorf("unexpected body: want %q, got: %q", "body of example.com/some/path", body)
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("unexpected upstream requests: want 1, got %d", requests)
+	}
+
+	upstream.Close()
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/other", nil))
+
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("unexpected status with the upstream down: want %d, got %d", http.StatusBadGateway, rw.Code)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSitemapDepth is the maximum nesting of sitemap indexes.
+const maxSitemapDepth = 3
+
+// maxSitemapSize is the maximum size of a sitemap, uncompressed, per the
+// sitemaps protocol.
+const maxSitemapSize = 50 << 20
+
+// sitemap is a sitemap or a sitemap index.
+type sitemap struct {
+	XMLName  xml.Name
+	URLs     []string `xml:"url>loc"`
+	Sitemaps []string `xml:"sitemap>loc"`
+}
+
+// warmer requests URLs through the proxy, at a bounded rate and concurrency.
+type warmer struct {
+	client      *http.Client
+	concurrency int
+	interval    time.Duration
+	headers     http.Header
+	verbose     bool
+	stdout      io.Writer
+	stderr      io.Writer
+}
+
+// headerList collects the values of a repeated header flag.
+type headerList http.Header
+
+func (h headerList) String() string {
+	return ""
+}
+
+func (h headerList) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q: must be name: value", v)
+	}
+
+	http.Header(h).Add(strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:]))
+
+	return nil
+}
+
+// warm requests the URLs listed by sitemaps or URL lists, given as URLs or
+// files, through the proxy, so that they are cached.
+func (c *cli) warm(args []string) error {
+	fs := c.flags("warm", "[-concurrency n] [-rate r] [-connect addr] [-header h]... <sitemap|list>...")
+	concurrency := fs.Int("concurrency", 4, "number of concurrent requests")
+	rate := fs.Float64("rate", 10, "maximum number of requests per second, 0 for no limit")
+	connect := fs.String("connect", "", "address of the proxy to connect to, instead of the host of each URL")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout of each request")
+	verbose := fs.Bool("v", false, "print the status of every URL")
+
+	headers := headerList{}
+	fs.Var(headers, "header", "header sent with every request, as name: value, repeated for several")
+
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+
+	if *concurrency < 1 || *rate < 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	w := &warmer{
+		client:      newWarmClient(*connect, *timeout),
+		concurrency: *concurrency,
+		headers:     http.Header(headers),
+		verbose:     *verbose,
+		stdout:      c.stdout,
+		stderr:      c.stderr,
+	}
+
+	if *rate > 0 {
+		w.interval = time.Duration(float64(time.Second) / *rate)
+	}
+
+	var urls []string
+
+	for _, src := range fs.Args() {
+		u, err := w.sources(src, 0)
+		if err != nil {
+			return err
+		}
+
+		urls = append(urls, u...)
+	}
+
+	return w.run(urls)
+}
+
+// newWarmClient returns a client connecting to addr, if set, whatever the
+// host of the requested URLs, so that a given proxy is warmed.
+func newWarmClient(addr string, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if addr != "" {
+		dialer := &net.Dialer{Timeout: timeout}
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// sources returns the URLs listed by src, a sitemap, a sitemap index or a
+// list of URLs, one per line, given as a URL or a file.
+func (w *warmer) sources(src string, depth int) ([]string, error) {
+	if depth > maxSitemapDepth {
+		return nil, fmt.Errorf("%s: sitemap indexes nested too deep", src)
+	}
+
+	b, err := w.read(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("<")) {
+		return urlList(b), nil
+	}
+
+	var sm sitemap
+	if err = xml.Unmarshal(b, &sm); err != nil {
+		return nil, fmt.Errorf("%s: invalid sitemap: %w", src, err)
+	}
+
+	urls := trimAll(sm.URLs)
+
+	for _, child := range trimAll(sm.Sitemaps) {
+		u, err := w.sources(child, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		urls = append(urls, u...)
+	}
+
+	return urls, nil
+}
+
+// read returns the content of src, a URL or a file, uncompressed if it is
+// gzipped.
+func (w *warmer) read(src string) ([]byte, error) {
+	var r io.ReadCloser
+
+	if strings.Contains(src, "://") {
+		resp, err := w.client.Get(src)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+
+		r = resp.Body
+	} else {
+		f, err := os.Open(filepath.Clean(src))
+		if err != nil {
+			return nil, err
+		}
+
+		r = f
+	}
+
+	defer func() {
+		_ = r.Close()
+	}()
+
+	br := bufio.NewReader(r)
+
+	var body io.Reader = br
+
+	// Gzipped sitemaps are served as is, without a Content-Encoding.
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+
+		body = gz
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxSitemapSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > maxSitemapSize {
+		return nil, errors.New("sitemap too large")
+	}
+
+	return b, nil
+}
+
+// urlList returns the URLs of a list, one per line, leaving out empty lines
+// and lines starting with #, as in warmup files.
+func urlList(b []byte) []string {
+	var urls []string
+
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		urls = append(urls, line)
+	}
+
+	return urls
+}
+
+func trimAll(values []string) []string {
+	trimmed := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			trimmed = append(trimmed, v)
+		}
+	}
+
+	return trimmed
+}
+
+// run requests urls from concurrency workers, starting a request at most
+// every interval, then prints the totals. It fails if any request failed.
+func (w *warmer) run(urls []string) error {
+	work := make(chan string)
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for u := range work {
+				if !w.fetch(u) {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for i, u := range urls {
+		if tick != nil && i > 0 {
+			<-tick
+		}
+
+		work <- u
+	}
+
+	close(work)
+	wg.Wait()
+
+	_, _ = fmt.Fprintf(w.stdout, "%d URLs requested, %d failed\n", len(urls), failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d URLs failed", failed)
+	}
+
+	return nil
+}
+
+// fetch requests u and reads its response, so that it is stored. It reports
+// whether the response was successful.
+func (w *warmer) fetch(u string) bool {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		_, _ = fmt.Fprintf(w.stderr, "%s: %v\n", u, err)
+		return false
+	}
+
+	for name, values := range w.headers {
+		req.Header[name] = values
+	}
+
+	// The Host header is only sent from the request host.
+	if host := w.headers.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		_, _ = fmt.Fprintf(w.stderr, "%s: %v\n", u, err)
+		return false
+	}
+
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if err != nil {
+		_, _ = fmt.Fprintf(w.stderr, "%s: %v\n", u, err)
+		return false
+	}
+
+	if w.verbose {
+		_, _ = fmt.Fprintf(w.stdout, "%d %s %s\n", resp.StatusCode, resp.Header.Get("Cache-Status"), u)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		_, _ = fmt.Fprintf(w.stderr, "%s: unexpected status %d\n", u, resp.StatusCode)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWarm(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		inFlight int
+		maxIn    int
+		pages    []string
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sitemap.xml", func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprint(rw, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>http://example.com/pages.xml.gz</loc></sitemap>
+</sitemapindex>`)
+	})
+	mux.HandleFunc("/pages.xml.gz", func(rw http.ResponseWriter, req *http.Request) {
+		gz := gzip.NewWriter(rw)
+		_, _ = fmt.Fprint(gz, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc> http://example.com/a </loc></url>
+  <url><loc>http://example.com/b</loc></url>
+  <url><loc>http://example.com/c</loc></url>
+</urlset>`)
+		_ = gz.Close()
+	})
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxIn {
+			maxIn = inFlight
+		}
+		pages = append(pages, req.Host+req.URL.Path+" "+req.Header.Get("X-Warmup"))
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		if req.URL.Path == "/missing" {
+			http.NotFound(rw, req)
+		}
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	list := filepath.Join(dir, "urls.txt")
+	urls := "# pages\n\nhttp://example.com/d\nhttp://example.com/missing\n"
+	if err = ioutil.WriteFile(list, []byte(urls), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	var stdout, stderr bytes.Buffer
+
+	start := time.Now()
+
+	code := run([]string{
+		"warm", "-connect", addr, "-concurrency", "2", "-rate", "100", "-header", "X-Warmup: 1",
+		"http://example.com/sitemap.xml", list,
+	}, &stdout, &stderr)
+
+	if code != 1 {
+		t.Errorf("unexpected exit code: want 1, got %d: %s", code, stderr.String())
+	}
+
+	if !strings.Contains(stdout.String(), "5 URLs requested, 1 failed") {
+		t.Errorf("unexpected output: %s", stdout.String())
+	}
+
+	if !strings.Contains(stderr.String(), "http://example.com/missing: unexpected status 404") {
+		t.Errorf("unexpected errors: %s", stderr.String())
+	}
+
+	// 5 requests at 100 per second start over at least 40ms.
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("unexpected warmup duration: want at least 40ms, got %s", d)
+	}
+
+	if maxIn > 2 {
+		t.Errorf("unexpected concurrency: want at most 2, got %d", maxIn)
+	}
+
+	want := map[string]bool{
+		"example.com/a 1": true, "example.com/b 1": true, "example.com/c 1": true,
+		"example.com/d 1": true, "example.com/missing 1": true,
+	}
+
+	if len(pages) != len(want) {
+		t.Errorf("unexpected pages requested: %v", pages)
+	}
+
+	for _, p := range pages {
+		if !want[p] {
+			t.Errorf("unexpected page requested: %s", p)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package plugin_simplecache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// maxMetaSize is the maximum size of the serialized entry metadata.
+const maxMetaSize = 1 << 20
+
+// errInvalidMeta is returned when entry metadata cannot be decoded.
+var errInvalidMeta = errors.New("invalid metadata")
+
+// excludedHeaders are the headers never stored with an entry, because they
+// are specific to a single response or connection.
+var excludedHeaders = map[string]bool{
+	"Set-Cookie":        true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// encode serializes the entry metadata, prefixed with its length, followed
+// by the raw body so that it can be streamed back without decoding.
+func (d *cacheData) encode() ([]byte, error) {
+	meta, err := d.encodeMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(meta, d.Body...), nil
+}
+
+// encodeMeta serializes the entry metadata, prefixed with its length.
+//
+// The metadata is made of the status, the storage and expiry times and the
+// origin fetch time, followed by the headers sorted by name. Each header is
+// its name followed by its values in their original order. Strings are
+// prefixed with their length and stored as is, so that any byte is preserved.
+// Early hints, if any, follow as their number and their values, so that
+// entries without any keep the same encoding.
+func (d *cacheData) encodeMeta() ([]byte, error) {
+	names := make([]string, 0, len(d.Headers))
+	for name := range d.Headers {
+		if !excludedHeaders[http.CanonicalHeaderKey(name)] {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	b := make([]byte, 4, 512)
+	b = appendUint(b, uint64(d.Status), 2)
+	b = appendTime(b, d.Stored)
+	b = appendTime(b, d.Expires)
+	b = appendUint(b, uint64(d.Delta), 8)
+	b = appendUint(b, uint64(len(names)), 2)
+
+	for _, name := range names {
+		values := d.Headers[name]
+		if len(name) > math.MaxUint16 || len(values) > math.MaxUint16 {
+			return nil, fmt.Errorf("header %q is too large", name)
+		}
+
+		b = appendString(b, name)
+		b = appendUint(b, uint64(len(values)), 2)
+
+		for _, value := range values {
+			b = appendString(b, value)
+		}
+	}
+
+	if len(d.Hints) > math.MaxUint16 {
+		return nil, errors.New("too many early hints")
+	}
+
+	if len(d.Hints) > 0 {
+		b = appendUint(b, uint64(len(d.Hints)), 2)
+
+		for _, hint := range d.Hints {
+			b = appendString(b, hint)
+		}
+	}
+
+	if len(b)-4 > maxMetaSize {
+		return nil, fmt.Errorf("metadata exceeds %d bytes", maxMetaSize)
+	}
+
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// decodeData reads the entry metadata from r, leaving r positioned at the
+// start of the body.
+func decodeData(r io.Reader) (*cacheData, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(l[:])
+	if size > maxMetaSize {
+		return nil, fmt.Errorf("invalid metadata size %d", size)
+	}
+
+	meta := make([]byte, size)
+	if _, err := io.ReadFull(r, meta); err != nil {
+		return nil, err
+	}
+
+	return decodeMeta(meta)
+}
+
+func decodeMeta(b []byte) (*cacheData, error) {
+	d := &metaDecoder{b: b}
+
+	data := &cacheData{
+		Status:  int(d.uint(2)),
+		Stored:  d.time(),
+		Expires: d.time(),
+		Delta:   time.Duration(d.uint(8)),
+	}
+
+	n := int(d.uint(2))
+	data.Headers = make(map[string][]string, n)
+
+	for i := 0; i < n && d.err == nil; i++ {
+		name := d.string()
+
+		values := make([]string, d.uint(2))
+		for j := range values {
+			values[j] = d.string()
+		}
+
+		data.Headers[name] = values
+	}
+
+	if d.err == nil && len(d.b) > 0 {
+		data.Hints = make([]string, d.uint(2))
+		for i := range data.Hints {
+			data.Hints[i] = d.string()
+		}
+	}
+
+	if d.err == nil && len(d.b) > 0 {
+		d.err = errInvalidMeta
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return data, nil
+}
+
+func appendUint(b []byte, v uint64, size int) []byte {
+	for i := 0; i < size; i++ {
+		b = append(b, byte(v>>(8*i)))
+	}
+
+	return b
+}
+
+// appendTime appends t as unix nanoseconds, the zero time being encoded as 0.
+func appendTime(b []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return appendUint(b, 0, 8)
+	}
+
+	return appendUint(b, uint64(t.UnixNano()), 8)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint(b, uint64(len(s)), 4)
+
+	return append(b, s...)
+}
+
+// metaDecoder reads the fields of encoded metadata. Once a read fails, the
+// following ones return zero values and err is set.
+type metaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *metaDecoder) next(n uint64) []byte {
+	if d.err != nil || uint64(len(d.b)) < n {
+		d.err = errInvalidMeta
+		return nil
+	}
+
+	v := d.b[:n]
+	d.b = d.b[n:]
+
+	return v
+}
+
+func (d *metaDecoder) uint(size int) uint64 {
+	b := d.next(uint64(size))
+
+	var v uint64
+	for i := range b {
+		v |= uint64(b[i]) << (8 * i)
+	}
+
+	return v
+}
+
+func (d *metaDecoder) time() time.Time {
+	n := int64(d.uint(8))
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n)
+}
+
+func (d *metaDecoder) string() string {
+	return string(d.next(d.uint(4)))
+}
@@ -0,0 +1,91 @@
+package plugin_simplecache
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCacheData_Encode(t *testing.T) {
+	data := &cacheData{
+		Status: 200,
+		Headers: map[string][]string{
+			"Link":         {"</a.css>; rel=preload", "</b.js>; rel=preload"},
+			"X-Raw":        {"caf\xe9 \xff\x00"},
+			"Content-Type": {"text/plain"},
+			"Set-Cookie":   {"session=secret"},
+			"Connection":   {"keep-alive"},
+		},
+		Body:    []byte("some body"),
+		Stored:  time.Unix(0, 1600000000000000000),
+		Expires: time.Unix(0, 1600000000123456789),
+		Delta:   42 * time.Millisecond,
+		Hints:   []string{"</a.css>; rel=preload"},
+	}
+
+	b, err := data.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(b)
+
+	got, err := decodeData(r)
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+
+	want := map[string][]string{
+		"Link":         {"</a.css>; rel=preload", "</b.js>; rel=preload"},
+		"X-Raw":        {"caf\xe9 \xff\x00"},
+		"Content-Type": {"text/plain"},
+	}
+
+	if !reflect.DeepEqual(got.Headers, want) {
+		t.Errorf("unexpected headers: want %q, got %q", want, got.Headers)
+	}
+
+	if !reflect.DeepEqual(got.Hints, data.Hints) {
+		t.Errorf("unexpected early hints: want %q, got %q", data.Hints, got.Hints)
+	}
+
+	if got.Status != data.Status || !got.Stored.Equal(data.Stored) || !got.Expires.Equal(data.Expires) ||
+		got.Delta != data.Delta {
+		t.Errorf("unexpected metadata: want %+v, got %+v", data, got)
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "some body" {
+		t.Errorf("unexpected body: want %q, got %q", "some body", body)
+	}
+}
+
+func TestDecodeData_Invalid(t *testing.T) {
+	data := &cacheData{Status: 200, Headers: map[string][]string{"Content-Type": {"text/plain"}}}
+
+	meta, err := data.encodeMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		meta []byte
+	}{
+		{name: "truncated", meta: append([]byte{byte(len(meta) - 5), 0, 0, 0}, meta[4:len(meta)-1]...)},
+		{name: "trailing", meta: append([]byte{byte(len(meta) - 3), 0, 0, 0}, append(meta[4:], 0)...)},
+	}
+
+	for _, test := range tests {
+		if _, err := decodeData(bytes.NewReader(test.meta)); !errors.Is(err, errInvalidMeta) {
+			t.Errorf("%s: unexpected decode error: want %v, got %v", test.name, errInvalidMeta, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package plugin_simplecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compressibleTypes are the content types worth compressing.
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+// errNotAcceptable is returned when the content coding of an entry is not
+// accepted by the client. It is handled as a miss.
+var errNotAcceptable = fmt.Errorf("%w: content coding not accepted", errCacheMiss)
+
+// gzipKey returns the key of the gzip variant of an entry.
+func gzipKey(key string) string {
+	return key + "|gzip"
+}
+
+// lookupVariant returns the gzip variant of the entry if the client accepts
+// it and it exists, or the identity variant otherwise.
+func (m *cache) lookupVariant(r *http.Request, key string) (*cacheData, io.ReadCloser, error) {
+	if m.cfg.Compress && acceptsEncoding(r, "gzip") {
+		if data, body, err := m.lookup(r.Context(), gzipKey(key)); err == nil {
+			return data, body, nil
+		}
+	}
+
+	data, body, err := m.lookup(r.Context(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return acceptable(r, data, body)
+}
+
+// acceptable makes sure the client accepts the content coding of the entry,
+// which was stored as sent by the origin. Gzip encoded entries are
+// decompressed for clients not accepting gzip, other content codings are not
+// served to them.
+func acceptable(r *http.Request, data *cacheData, body io.ReadCloser) (*cacheData, io.ReadCloser, error) {
+	ce := http.Header(data.Headers).Get("Content-Encoding")
+	if ce == "" || strings.EqualFold(ce, "identity") || acceptsEncoding(r, ce) {
+		return data, body, nil
+	}
+
+	if !strings.EqualFold(ce, "gzip") {
+		_ = body.Close()
+		return nil, nil, errNotAcceptable
+	}
+
+	gr, err := gzip.NewReader(body)
+	if err != nil {
+		_ = body.Close()
+		return nil, nil, fmt.Errorf("error decompressing cache item: %w", err)
+	}
+
+	identity := data.clone()
+
+	h := http.Header(identity.Headers)
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+
+	return identity, &gunzipReader{Reader: gr, body: body}, nil
+}
+
+// gunzipReader decompresses an entry body, closing it when closed.
+type gunzipReader struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g *gunzipReader) Close() error {
+	_ = g.Reader.Close()
+	return g.body.Close()
+}
+
+// storeGzip compresses an identity encoded entry and stores it as its gzip
+// variant. Brotli variants are not stored, as the standard library, which is
+// all plugins can use, has no brotli encoder.
+func (m *cache) storeGzip(ctx context.Context, key string, data *cacheData, body []byte, retention time.Duration) {
+	var buf bytes.Buffer
+
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(body); err != nil {
+		log.Printf("Error compressing cache item: %v", err)
+		return
+	}
+
+	if err := gw.Close(); err != nil {
+		log.Printf("Error compressing cache item: %v", err)
+		return
+	}
+
+	gz := data.clone()
+
+	h := http.Header(gz.Headers)
+	h.Set("Content-Encoding", "gzip")
+	if h.Get("Content-Length") != "" {
+		h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	}
+
+	if etag := h.Get("ETag"); etag != "" {
+		h.Set("ETag", gzipETag(etag))
+	}
+
+	if err := m.store(ctx, gzipKey(key), gz, buf.Bytes(), retention); err != nil {
+		m.logStoreError(err)
+	}
+}
+
+// gzipETag returns the entity tag of the gzip variant of an entry tagged etag.
+// The bytes differ from those of the identity variant, so the tag is suffixed,
+// for conditional requests not to match the other variant, and weak, for
+// ranges never to match it.
+func gzipETag(etag string) string {
+	opaque := strings.TrimPrefix(etag, "W/")
+	if len(opaque) < 2 || !strings.HasPrefix(opaque, `"`) || !strings.HasSuffix(opaque, `"`) {
+		return etag
+	}
+
+	return `W/` + opaque[:len(opaque)-1] + `-gzip"`
+}
+
+// compressible reports whether the entry is not empty, identity encoded and has a
+// content type worth compressing.
+func compressible(data *cacheData, body []byte) bool {
+	h := http.Header(data.Headers)
+	if len(body) == 0 || h.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	ct := h.Get("Content-Type")
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(ct, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptsEncoding reports whether the request accepts the given content coding.
+// The quality of the coding, if listed, takes precedence over the one of "*".
+func acceptsEncoding(r *http.Request, coding string) bool {
+	wildcard := false
+
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			name, q := parseQuality(part)
+
+			switch {
+			case strings.EqualFold(name, coding):
+				return q > 0
+			case name == "*":
+				wildcard = q > 0
+			}
+		}
+	}
+
+	return wildcard
+}
+
+// parseQuality splits an Accept-* list element into its value and quality.
+func parseQuality(part string) (string, float64) {
+	fields := strings.Split(part, ";")
+	name := strings.TrimSpace(fields[0])
+
+	for _, param := range fields[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+
+		q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+		if err != nil {
+			return name, 0
+		}
+
+		return name, q
+	}
+
+	return name, 1
+}
+
+// addVary adds name to the Vary header if it is not already listed.
+func addVary(headers map[string][]string, name string) {
+	h := http.Header(headers)
+
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+
+	h.Add("Vary", name)
+}
@@ -0,0 +1,194 @@
+package plugin_simplecache
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCache_ServeHTTP_Compress(t *testing.T) {
+	dir := createTempDir(t)
+
+	content := strings.Repeat("some compressible content ", 100)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(content))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, Compress: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	req.Header.Set("Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != "hit" {
+		t.Errorf("unexpected cache state: want \"hit\", got: %q", state)
+	}
+
+	if enc := rw.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("unexpected content encoding: want \"gzip\", got %q", enc)
+	}
+
+	gr, err := gzip.NewReader(rw.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != content {
+		t.Error("unexpected decompressed body")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if enc := rw.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("unexpected content encoding: %q", enc)
+	}
+
+	if rw.Body.String() != content {
+		t.Error("unexpected identity body")
+	}
+
+	if vary := rw.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("unexpected vary header: %q", vary)
+	}
+}
+
+func TestCache_ServeHTTP_AcceptEncoding(t *testing.T) {
+	dir := createTempDir(t)
+
+	content := "some content"
+
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Content-Encoding", req.Header.Get("X-Encoding"))
+
+		if req.Header.Get("X-Encoding") == "gzip" {
+			gw := gzip.NewWriter(rw)
+			_, _ = gw.Write([]byte(content))
+			_ = gw.Close()
+
+			return
+		}
+
+		_, _ = rw.Write([]byte(content))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		state    string
+		calls    int
+	}{
+		{name: "gzip", encoding: "gzip", state: "hit", calls: 1},
+		{name: "br", encoding: "br", state: "miss", calls: 2},
+	}
+
+	for _, test := range tests {
+		calls = 0
+		path := "http://localhost/" + test.name
+
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", test.encoding)
+		req.Header.Set("X-Encoding", test.encoding)
+		c.ServeHTTP(httptest.NewRecorder(), req)
+
+		// The next client does not accept any content coding.
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.name, test.state, state)
+		}
+
+		if enc := rw.Header().Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s: unexpected content encoding: %q", test.name, enc)
+		}
+
+		if body := rw.Body.String(); body != content {
+			t.Errorf("%s: unexpected body: want %q, got %q", test.name, content, body)
+		}
+
+		if calls != test.calls {
+			t.Errorf("%s: unexpected origin calls: want %d, got %d", test.name, test.calls, calls)
+		}
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: false},
+		{header: "gzip", want: true},
+		{header: "deflate, GZIP", want: true},
+		{header: "br, gzip;q=0", want: false},
+		{header: "*;q=0.5", want: true},
+		{header: "gzip;q=0, *", want: false},
+		{header: "*;q=0, gzip", want: true},
+		{header: "identity", want: false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.Header.Set("Accept-Encoding", test.header)
+
+		if got := acceptsEncoding(req, "gzip"); got != test.want {
+			t.Errorf("acceptsEncoding(%q): want %t, got %t", test.header, test.want, got)
+		}
+	}
+}
+
+func TestGzipETag(t *testing.T) {
+	tests := []struct {
+		etag string
+		want string
+	}{
+		{etag: `"abc"`, want: `W/"abc-gzip"`},
+		{etag: `W/"abc"`, want: `W/"abc-gzip"`},
+		{etag: `""`, want: `W/"-gzip"`},
+		{etag: `invalid`, want: `invalid`},
+	}
+
+	for _, test := range tests {
+		if got := gzipETag(test.etag); got != test.want {
+			t.Errorf("gzipETag(%q): want %q, got %q", test.etag, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package plugin_simplecache
+
+import (
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hasValidator reports whether h carries a validator, which conditional
+// requests can be evaluated against.
+func hasValidator(h http.Header) bool {
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// weakETag returns a weak entity tag made of the first bytes of the body
+// digest d.
+func weakETag(d hash.Hash) string {
+	return `W/"` + hex.EncodeToString(d.Sum(nil)[:16]) + `"`
+}
+
+// addValidators gives a stored response without validators a weak entity
+// tag from its body digest d and, if configured, its storage time as
+// modification time.
+func (m *cache) addValidators(h http.Header, d hash.Hash, stored time.Time) {
+	h.Set("ETag", weakETag(d))
+
+	if m.cfg.AddLastModified {
+		h.Set("Last-Modified", stored.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether the stored response with headers h satisfies
+// the conditions of r, in which case the client copy can be reused.
+// If-Modified-Since is only evaluated without If-None-Match, as required by
+// RFC 9110.
+func notModified(r *http.Request, h http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, h.Get("ETag"))
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lm.Truncate(time.Second).After(ims)
+}
+
+// etagMatch reports whether the If-None-Match list inm matches etag, using
+// the weak comparison.
+func etagMatch(inm, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(inm, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeNotModified answers a satisfied conditional request, without the
+// headers describing the body.
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	for _, name := range []string{"Content-Length", "Content-Type", "Content-Range", "Transfer-Encoding"} {
+		h.Del(name)
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,184 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotModified(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	tests := []struct {
+		desc     string
+		method   string
+		header   http.Header
+		stored   http.Header
+		expected bool
+	}{
+		{
+			desc:     "matching entity tag",
+			header:   http.Header{"If-None-Match": {`"a", "b"`}},
+			stored:   http.Header{"Etag": {`"b"`}},
+			expected: true,
+		},
+		{
+			desc:     "weak comparison",
+			header:   http.Header{"If-None-Match": {`W/"a"`}},
+			stored:   http.Header{"Etag": {`"a"`}},
+			expected: true,
+		},
+		{
+			desc:     "any entity tag",
+			header:   http.Header{"If-None-Match": {"*"}},
+			stored:   http.Header{"Etag": {`"a"`}},
+			expected: true,
+		},
+		{
+			desc:   "other entity tag",
+			header: http.Header{"If-None-Match": {`"a"`}},
+			stored: http.Header{"Etag": {`"b"`}},
+		},
+		{
+			desc:   "no entity tag",
+			header: http.Header{"If-None-Match": {`"a"`}},
+			stored: http.Header{"Last-Modified": {lastModified}},
+		},
+		{
+			desc:     "not modified since",
+			header:   http.Header{"If-Modified-Since": {lastModified}},
+			stored:   http.Header{"Last-Modified": {lastModified}},
+			expected: true,
+		},
+		{
+			desc:   "modified since",
+			header: http.Header{"If-Modified-Since": {"Mon, 02 Jan 2006 15:04:04 GMT"}},
+			stored: http.Header{"Last-Modified": {lastModified}},
+		},
+		{
+			desc:   "If-None-Match takes precedence",
+			header: http.Header{"If-None-Match": {`"a"`}, "If-Modified-Since": {lastModified}},
+			stored: http.Header{"Etag": {`"b"`}, "Last-Modified": {lastModified}},
+		},
+		{
+			desc:   "unsafe method",
+			method: http.MethodPost,
+			header: http.Header{"If-None-Match": {"*"}},
+			stored: http.Header{"Etag": {`"a"`}},
+		},
+	}
+
+	for _, test := range tests {
+		method := test.method
+		if method == "" {
+			method = http.MethodGet
+		}
+
+		req := httptest.NewRequest(method, "http://localhost/", nil)
+		req.Header = test.header
+
+		if got := notModified(req, test.stored); got != test.expected {
+			t.Errorf("%s: unexpected result: want %t, got %t", test.desc, test.expected, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_WeakETag(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		if req.URL.Path == "/tagged" {
+			rw.Header().Set("ETag", `"origin"`)
+		}
+
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/untagged", "/tagged"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+
+		etag := rw.Header().Get("ETag")
+
+		switch {
+		case p == "/tagged" && etag != `"origin"`:
+			t.Errorf("%s: unexpected entity tag: want %q, got: %q", p, `"origin"`, etag)
+		case p == "/untagged" && !strings.HasPrefix(etag, `W/"`):
+			t.Errorf("%s: unexpected entity tag: want a weak one, got: %q", p, etag)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil)
+		req.Header.Set("If-None-Match", etag)
+
+		rw = httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusNotModified {
+			t.Errorf("%s: unexpected status: want %d, got %d", p, http.StatusNotModified, rw.Code)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != cacheHitStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", p, cacheHitStatus, state)
+		}
+
+		if rw.Body.Len() != 0 {
+			t.Errorf("%s: unexpected body: %q", p, rw.Body.String())
+		}
+	}
+}
+
+func TestCache_ServeHTTP_AddLastModified(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		if req.URL.Path == "/dated" {
+			rw.Header().Set("Last-Modified", lastModified)
+		}
+
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, AddLastModified: true}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/undated", "/dated"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+
+		modified := rw.Header().Get("Last-Modified")
+
+		switch {
+		case p == "/dated" && modified != lastModified:
+			t.Errorf("%s: unexpected Last-Modified: want %q, got: %q", p, lastModified, modified)
+		case p == "/undated" && modified == "":
+			t.Errorf("%s: missing Last-Modified", p)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil)
+		req.Header.Set("If-Modified-Since", modified)
+
+		rw = httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusNotModified {
+			t.Errorf("%s: unexpected status: want %d, got %d", p, http.StatusNotModified, rw.Code)
+		}
+	}
+}
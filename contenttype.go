@@ -0,0 +1,136 @@
+package plugin_simplecache
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"time"
+)
+
+// TypeTTL caps the expiry of the responses whose content type matches a
+// pattern, whatever the origin claims.
+type TypeTTL struct {
+	Type   string   `json:"type" yaml:"type" toml:"type"`
+	MaxTTL Duration `json:"maxTtl" yaml:"maxTtl" toml:"maxTtl"`
+}
+
+// CacheControlRule sets the Cache-Control header sent to clients with the
+// cached responses whose content type matches a pattern.
+type CacheControlRule struct {
+	Type  string `json:"type" yaml:"type" toml:"type"`
+	Value string `json:"value" yaml:"value" toml:"value"`
+}
+
+// validateCacheControlRules checks the patterns of rules.
+func validateCacheControlRules(rules []CacheControlRule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Type, ""); err != nil {
+			return fmt.Errorf("invalid content type %q: %w", rule.Type, err)
+		}
+	}
+
+	return nil
+}
+
+// clientCacheControl returns the Cache-Control header value of the first rule
+// matching contentType, if any.
+func clientCacheControl(rules []CacheControlRule, contentType string) (string, bool) {
+	if len(rules) == 0 {
+		return "", false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule.Type, mediaType); ok {
+			return rule.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// validateTypeTTLs checks the patterns and maximum TTLs of caps.
+func validateTypeTTLs(caps []TypeTTL) error {
+	for _, c := range caps {
+		if _, err := path.Match(c.Type, ""); err != nil {
+			return fmt.Errorf("invalid content type %q: %w", c.Type, err)
+		}
+
+		d, err := c.MaxTTL.parse()
+		if err != nil {
+			return fmt.Errorf("invalid max ttl of content type %q: %w", c.Type, err)
+		}
+
+		if d <= 0 {
+			return fmt.Errorf("max ttl of content type %q must be greater than 0", c.Type)
+		}
+	}
+
+	return nil
+}
+
+// capTypeExpiry limits expiry to the maximum TTL of the first cap matching
+// contentType, if any.
+func capTypeExpiry(caps []TypeTTL, contentType string, expiry time.Duration) time.Duration {
+	if len(caps) == 0 {
+		return expiry
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return expiry
+	}
+
+	for _, c := range caps {
+		if ok, _ := path.Match(c.Type, mediaType); !ok {
+			continue
+		}
+
+		if maxTTL := c.MaxTTL.Duration(); maxTTL < expiry {
+			return maxTTL
+		}
+
+		return expiry
+	}
+
+	return expiry
+}
+
+// allowedContentType reports whether a response with the given content type
+// may be stored. It must match one of the allow patterns, if any, and none of
+// the deny patterns. Patterns are media types which may contain wildcards,
+// such as image/*.
+func allowedContentType(contentType string, allow, deny []string) bool {
+	if len(allow) == 0 && len(deny) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+
+	if len(allow) > 0 && !matchesMediaType(mediaType, allow) {
+		return false
+	}
+
+	return !matchesMediaType(mediaType, deny)
+}
+
+func matchesMediaType(mediaType string, patterns []string) bool {
+	if mediaType == "" {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+
+	return false
+}
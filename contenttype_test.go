@@ -0,0 +1,105 @@
+package plugin_simplecache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowedContentType(t *testing.T) {
+	allow := []string{"image/*", "application/json"}
+	deny := []string{"image/svg+xml"}
+
+	tests := []struct {
+		contentType string
+		allow       []string
+		deny        []string
+		want        bool
+	}{
+		{contentType: "text/html", want: true},
+		{contentType: "", want: true},
+		{contentType: "image/png", allow: allow, deny: deny, want: true},
+		{contentType: "Application/JSON; charset=utf-8", allow: allow, deny: deny, want: true},
+		{contentType: "image/svg+xml", allow: allow, deny: deny, want: false},
+		{contentType: "text/html", allow: allow, deny: deny, want: false},
+		{contentType: "", allow: allow, want: false},
+		{contentType: "", deny: deny, want: true},
+		{contentType: "video/mp4", deny: []string{"video/*", "text/event-stream"}, want: false},
+		{contentType: "text/event-stream", deny: []string{"video/*", "text/event-stream"}, want: false},
+		{contentType: "text/plain", deny: []string{"video/*", "text/event-stream"}, want: true},
+	}
+
+	for _, test := range tests {
+		if got := allowedContentType(test.contentType, test.allow, test.deny); got != test.want {
+			t.Errorf("unexpected result for %q (allow %q, deny %q): want %v, got %v",
+				test.contentType, test.allow, test.deny, test.want, got)
+		}
+	}
+}
+
+func TestCapTypeExpiry(t *testing.T) {
+	caps := []TypeTTL{
+		{Type: "text/html", MaxTTL: "60s"},
+		{Type: "image/*", MaxTTL: "30d"},
+	}
+
+	tests := []struct {
+		contentType string
+		expiry      time.Duration
+		want        time.Duration
+	}{
+		{contentType: "text/html; charset=utf-8", expiry: 365 * 24 * time.Hour, want: time.Minute},
+		{contentType: "text/html", expiry: 10 * time.Second, want: 10 * time.Second},
+		{contentType: "image/png", expiry: 365 * 24 * time.Hour, want: 30 * 24 * time.Hour},
+		{contentType: "application/json", expiry: time.Hour, want: time.Hour},
+		{contentType: "", expiry: time.Hour, want: time.Hour},
+	}
+
+	for _, test := range tests {
+		if got := capTypeExpiry(caps, test.contentType, test.expiry); got != test.want {
+			t.Errorf("unexpected expiry for %q: want %s, got %s", test.contentType, test.want, got)
+		}
+	}
+}
+
+func TestValidateTypeTTLs(t *testing.T) {
+	tests := []struct {
+		caps    []TypeTTL
+		wantErr bool
+	}{
+		{caps: []TypeTTL{{Type: "text/html", MaxTTL: "60s"}}},
+		{caps: []TypeTTL{{Type: "text/[", MaxTTL: "60s"}}, wantErr: true},
+		{caps: []TypeTTL{{Type: "text/html", MaxTTL: "soon"}}, wantErr: true},
+		{caps: []TypeTTL{{Type: "text/html", MaxTTL: "0"}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		if err := validateTypeTTLs(test.caps); (err != nil) != test.wantErr {
+			t.Errorf("unexpected error for %v: %v", test.caps, err)
+		}
+	}
+}
+
+func TestClientCacheControl(t *testing.T) {
+	rules := []CacheControlRule{
+		{Type: "text/html", Value: "max-age=0, must-revalidate"},
+		{Type: "image/*", Value: "public, max-age=86400"},
+	}
+
+	tests := []struct {
+		contentType string
+		want        string
+		ok          bool
+	}{
+		{contentType: "text/html; charset=utf-8", want: "max-age=0, must-revalidate", ok: true},
+		{contentType: "image/png", want: "public, max-age=86400", ok: true},
+		{contentType: "application/json", ok: false},
+		{contentType: "", ok: false},
+	}
+
+	for _, test := range tests {
+		got, ok := clientCacheControl(rules, test.contentType)
+		if got != test.want || ok != test.ok {
+			t.Errorf("unexpected result for %q: want %q (%t), got %q (%t)", test.contentType, test.want, test.ok, got, ok)
+		}
+	}
+}
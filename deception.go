@@ -0,0 +1,63 @@
+package plugin_simplecache
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// extensionTypes maps static file extensions to the content types responses
+// to paths with these extensions may have.
+var extensionTypes = map[string][]string{
+	".css":   {"text/css"},
+	".js":    {"application/javascript", "text/javascript", "application/x-javascript"},
+	".mjs":   {"application/javascript", "text/javascript"},
+	".json":  {"application/json"},
+	".map":   {"application/json"},
+	".xml":   {"application/xml", "text/xml"},
+	".txt":   {"text/plain"},
+	".png":   {"image/png"},
+	".jpg":   {"image/jpeg"},
+	".jpeg":  {"image/jpeg"},
+	".gif":   {"image/gif"},
+	".webp":  {"image/webp"},
+	".avif":  {"image/avif"},
+	".svg":   {"image/svg+xml"},
+	".ico":   {"image/x-icon", "image/vnd.microsoft.icon"},
+	".woff":  {"font/woff", "application/font-woff"},
+	".woff2": {"font/woff2"},
+	".ttf":   {"font/ttf", "application/x-font-ttf"},
+	".otf":   {"font/otf"},
+	".pdf":   {"application/pdf"},
+	".mp4":   {"video/mp4"},
+	".webm":  {"video/webm"},
+	".mp3":   {"audio/mpeg"},
+	".zip":   {"application/zip"},
+	".wasm":  {"application/wasm"},
+}
+
+// matchesExtension reports whether the content type of a response is one
+// expected for the extension of the requested path. Paths without a known
+// static file extension match any content type.
+//
+// This protects against web cache deception, where a dynamic page is
+// requested under a static looking path such as /account.php/fake.css.
+func matchesExtension(urlPath, contentType string) bool {
+	types, ok := extensionTypes[strings.ToLower(path.Ext(urlPath))]
+	if !ok {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range types {
+		if mediaType == t {
+			return true
+		}
+	}
+
+	return false
+}
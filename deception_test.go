@@ -0,0 +1,65 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchesExtension(t *testing.T) {
+	tests := []struct {
+		path        string
+		contentType string
+		want        bool
+	}{
+		{path: "/style.css", contentType: "text/css; charset=utf-8", want: true},
+		{path: "/app.JS", contentType: "text/javascript", want: true},
+		{path: "/account.php/fake.css", contentType: "text/html; charset=utf-8", want: false},
+		{path: "/account.php/fake.png", contentType: "", want: false},
+		{path: "/account", contentType: "text/html", want: true},
+		{path: "/page.php", contentType: "text/html", want: true},
+	}
+
+	for _, test := range tests {
+		if got := matchesExtension(test.path, test.contentType); got != test.want {
+			t.Errorf("unexpected match for %q with %q: want %t, got %t", test.path, test.contentType, test.want, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_DeceptionCheck(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("private page"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, DeceptionCheck: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		state string
+	}{
+		{path: "/account.php/fake.css", state: "miss"},
+		{path: "/account", state: "hit"},
+	}
+
+	for _, test := range tests {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil))
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("unexpected cache state for %q: want %q, got: %q", test.path, test.state, state)
+		}
+	}
+}
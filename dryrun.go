@@ -0,0 +1,157 @@
+package plugin_simplecache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	dryRunHitDecision  = "dry-run-hit"
+	dryRunMissDecision = "dry-run-miss"
+)
+
+// dryRun records what the cache would have done for the requests served in
+// dry-run mode. The entries that would have been stored are only tracked by
+// key and expiry, in memory, up to maxTrackedKeys of them.
+type dryRun struct {
+	requests int64
+	hits     int64
+	stored   int64
+
+	entries *expiryIndex
+}
+
+// dryRunStats describes the requests served in dry-run mode.
+type dryRunStats struct {
+	Requests int64   `json:"requests"`
+	Hits     int64   `json:"hits"`
+	Stored   int64   `json:"stored"`
+	HitRatio float64 `json:"hitRatio"`
+}
+
+func newDryRun() *dryRun {
+	return &dryRun{entries: newExpiryIndex()}
+}
+
+// Stats returns the statistics of the requests served so far.
+func (d *dryRun) Stats() dryRunStats {
+	stats := dryRunStats{
+		Requests: atomic.LoadInt64(&d.requests),
+		Hits:     atomic.LoadInt64(&d.hits),
+		Stored:   atomic.LoadInt64(&d.stored),
+	}
+
+	if stats.Requests > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(stats.Requests)
+	}
+
+	return stats
+}
+
+// record tracks key as stored until expires. Once maxTrackedKeys are tracked,
+// the expired keys are dropped, then all of them if none has expired.
+func (d *dryRun) record(key string, expires, now int64) {
+	if _, ok := d.entries.Get(key); !ok && d.entries.Len() >= maxTrackedKeys {
+		for _, k := range d.entries.Expired(now) {
+			d.entries.Delete(k)
+		}
+
+		if d.entries.Len() >= maxTrackedKeys {
+			d.entries.Reset()
+		}
+	}
+
+	d.entries.Set(key, expires)
+}
+
+// serveDryRun forwards r to the origin untouched, and records whether its
+// lookup would have hit and whether its response would have been stored.
+func (m *cache) serveDryRun(w http.ResponseWriter, r *http.Request) {
+	now := m.clock.Now()
+	key := m.requestKey(r)
+
+	atomic.AddInt64(&m.dryRun.requests, 1)
+
+	decision := dryRunMissDecision
+	if expires, ok := m.dryRun.entries.Get(key); ok && expires >= now.Unix() {
+		decision = dryRunHitDecision
+		atomic.AddInt64(&m.dryRun.hits, 1)
+	} else if ok {
+		m.dryRun.entries.Delete(key)
+	}
+
+	rw := &statusWriter{ResponseWriter: w, optIn: optInFilter{header: m.cfg.RequireOptInHeader}}
+	m.next.ServeHTTP(rw, r)
+
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+		rw.optIn.Strip(w.Header())
+	}
+
+	expiry, ok := m.cacheable(r, w.Header(), rw.status)
+	if !ok || !rw.optIn.Allowed() || r.Context().Err() != nil {
+		m.logDecision(now, key, decision, 0, rw.size)
+		return
+	}
+
+	m.dryRun.record(key, now.Add(expiry).Unix(), now.Unix())
+	atomic.AddInt64(&m.dryRun.stored, 1)
+
+	m.logDecision(now, key, decision, expiry, rw.size)
+}
+
+// statusWriter is a response writer recording the status and body size of
+// the response it forwards.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+	optIn  optInFilter
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if isInformational(status) {
+		writeInterim(sw.ResponseWriter, status)
+		return
+	}
+
+	if sw.status == 0 {
+		sw.status = status
+		sw.optIn.Strip(sw.Header())
+	}
+
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+
+	n, err := sw.ResponseWriter.Write(p)
+	sw.size += n
+
+	return n, err
+}
+
+// Flush sends any buffered data to the client, if the underlying response
+// writer supports it.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, if the underlying
+// response writer supports it.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", sw.ResponseWriter)
+	}
+
+	return h.Hijack()
+}
@@ -0,0 +1,99 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestCache_ServeHTTP_DryRun(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		if req.URL.Path == "/private" {
+			rw.Header().Set("Cache-Control", "no-store")
+		} else {
+			rw.Header().Set("Cache-Control", "max-age=20")
+		}
+
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, DryRun: true}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	for _, path := range []string{"/some/path", "/some/path", "/some/path", "/private", "/private"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if body := rw.Body.String(); body != "some body" {
+			t.Errorf("%s: unexpected body: want %q, got %q", path, "some body", body)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != "" {
+			t.Errorf("%s: unexpected cache state: want none, got: %q", path, state)
+		}
+	}
+
+	if calls != 5 {
+		t.Errorf("unexpected origin calls: want 5, got %d", calls)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	if _, err = c.cache.Get(context.Background(), cacheKey(req)); !errors.Is(err, errCacheMiss) {
+		t.Errorf("unexpected stored entry: want %v, got %v", errCacheMiss, err)
+	}
+
+	rw := httptest.NewRecorder()
+	c.serveStats(rw, httptest.NewRequest(http.MethodGet, "http://localhost/_cache/stats", nil))
+
+	var status healthStatus
+	if err = json.Unmarshal(rw.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+
+	want := dryRunStats{Requests: 5, Hits: 2, Stored: 3, HitRatio: 0.4}
+	if status.DryRun == nil || *status.DryRun != want {
+		t.Errorf("unexpected dry-run stats: want %+v, got %+v", want, status.DryRun)
+	}
+}
+
+func TestDryRun_Record(t *testing.T) {
+	d := newDryRun()
+
+	// Half of the keys have expired at 10.
+	for i := 0; i < maxTrackedKeys; i++ {
+		d.record(strconv.Itoa(i), int64(i%2)*20, 10)
+	}
+
+	d.record("new", 20, 10)
+
+	if n := d.entries.Len(); n != maxTrackedKeys/2+1 {
+		t.Errorf("unexpected tracked keys once the expired are dropped: want %d, got %d", maxTrackedKeys/2+1, n)
+	}
+
+	for i := 0; d.entries.Len() < maxTrackedKeys; i++ {
+		d.record("more-"+strconv.Itoa(i), 20, 10)
+	}
+
+	d.record("last", 20, 10)
+
+	if n := d.entries.Len(); n != 1 {
+		t.Errorf("unexpected tracked keys once none has expired: want 1, got %d", n)
+	}
+}
@@ -0,0 +1,69 @@
+package plugin_simplecache
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a configured duration. It is either a number of seconds, such
+// as "300", or a duration string with a unit, such as "5m", "12h" or "7d".
+//
+// Durations are strings, so that both forms can be decoded from any
+// configuration provider.
+type Duration string
+
+// UnmarshalJSON accepts both JSON strings and numbers of seconds.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*d = Duration(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("invalid duration %s: %w", b, err)
+	}
+
+	*d = Duration(n)
+
+	return nil
+}
+
+// Duration returns d as a time.Duration, which is zero when d is empty or
+// invalid. Configured durations are validated by New.
+func (d Duration) Duration() time.Duration {
+	v, _ := d.parse()
+	return v
+}
+
+func (d Duration) parse() (time.Duration, error) {
+	s := strings.TrimSpace(string(d))
+	if s == "" {
+		return 0, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	// Days are not supported by time.ParseDuration.
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+
+	return v, nil
+}
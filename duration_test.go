@@ -0,0 +1,65 @@
+package plugin_simplecache
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDuration_Duration(t *testing.T) {
+	tests := []struct {
+		value   Duration
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "300", want: 5 * time.Minute},
+		{value: "1.5", want: 1500 * time.Millisecond},
+		{value: "-1", want: -time.Second},
+		{value: "5m", want: 5 * time.Minute},
+		{value: "12h", want: 12 * time.Hour},
+		{value: "1h30m", want: 90 * time.Minute},
+		{value: "7d", want: 7 * 24 * time.Hour},
+		{value: " 30s ", want: 30 * time.Second},
+		{value: "7 days", wantErr: true},
+		{value: "xd", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := test.value.parse()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.value)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.value, err)
+		}
+
+		if got != test.want || test.value.Duration() != test.want {
+			t.Errorf("%q: unexpected duration: want %s, got %s", test.value, test.want, got)
+		}
+	}
+}
+
+func TestDuration_UnmarshalJSON(t *testing.T) {
+	var cfg Config
+	if err := json.Unmarshal([]byte(`{"maxExpiry": 86400, "cleanup": "5m"}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.MaxExpiry.Duration() != 24*time.Hour {
+		t.Errorf("unexpected maxExpiry: want %s, got %s", 24*time.Hour, cfg.MaxExpiry.Duration())
+	}
+
+	if cfg.Cleanup.Duration() != 5*time.Minute {
+		t.Errorf("unexpected cleanup: want %s, got %s", 5*time.Minute, cfg.Cleanup.Duration())
+	}
+
+	if err := json.Unmarshal([]byte(`{"maxExpiry": true}`), &cfg); err == nil {
+		t.Error("expected an error for an invalid duration")
+	}
+}
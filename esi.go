@@ -0,0 +1,274 @@
+package plugin_simplecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxESIIncludes is the maximum number of includes resolved in a page. Later
+// includes are removed.
+const maxESIIncludes = 32
+
+// defaultESIPageSize is the size above which pages are streamed without
+// resolving their includes, when maxItemBytes sets no limit.
+const defaultESIPageSize = 10 << 20
+
+// esiIncludePattern matches ESI include tags, self-closing or not, and
+// captures their source.
+var esiIncludePattern = regexp.MustCompile(`<esi:include\s[^>]*?src="([^"]*)"[^>]*?>(?:\s*</esi:include>)?`)
+
+type esiFragmentKey struct{}
+
+// isESIFragment reports whether r is the request of an ESI include. Includes
+// are never processed themselves.
+func isESIFragment(r *http.Request) bool {
+	return r.Context().Value(esiFragmentKey{}) != nil
+}
+
+// serveESI serves r from the cache, resolving the ESI includes of HTML pages.
+// Pages are stored with their include tags, and every include is served
+// through the cache, with its own key and expiry, on each request. Pages
+// larger than maxItemBytes are streamed as stored.
+func (m *cache) serveESI(w http.ResponseWriter, r *http.Request) {
+	ew := &esiWriter{ResponseWriter: w, maxSize: m.cfg.MaxItemBytes}
+	if ew.maxSize <= 0 {
+		ew.maxSize = defaultESIPageSize
+	}
+
+	m.serveCached(ew, r)
+
+	if !ew.buffering {
+		return
+	}
+
+	page, ok := ew.page()
+	if !ok {
+		ew.release()
+		return
+	}
+
+	body, n := m.resolveIncludes(r, page)
+
+	h := w.Header()
+	h.Del("Content-Encoding")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+
+	// Assembled pages may embed personalized fragments, so they must not be
+	// stored by shared caches downstream.
+	if n > 0 {
+		h.Set("Cache-Control", "private, no-cache")
+	}
+
+	w.WriteHeader(ew.status)
+	_, _ = w.Write(body)
+}
+
+// dropESIConditions removes the conditions and range of r if its stored
+// entry data, served to w, is an HTML page whose includes are resolved:
+// assembled pages have no validators to evaluate conditions against, nor
+// fixed ranges. Other responses are served as requested.
+func dropESIConditions(w http.ResponseWriter, r *http.Request, data *cacheData) {
+	_, ok := w.(*esiWriter)
+	if !ok || !hasTypePrefix(http.Header(data.Headers).Get("Content-Type"), []string{"text/html"}) {
+		return
+	}
+
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "Range", "If-Range"} {
+		r.Header.Del(name)
+	}
+}
+
+// resolveIncludes replaces the include tags of page with the bodies of their
+// sources. It returns the resulting page and the number of includes
+// resolved.
+func (m *cache) resolveIncludes(r *http.Request, page []byte) ([]byte, int) {
+	var n int
+
+	body := esiIncludePattern.ReplaceAllFunc(page, func(tag []byte) []byte {
+		if n >= maxESIIncludes {
+			return nil
+		}
+		n++
+
+		src := esiIncludePattern.FindSubmatch(tag)[1]
+
+		return m.include(r, string(src))
+	})
+
+	return body, n
+}
+
+// include returns the body of the response to src, requested like r. Sources
+// on another host and unsuccessful responses are replaced by nothing.
+func (m *cache) include(r *http.Request, src string) []byte {
+	ref, err := url.Parse(src)
+	if err != nil {
+		return nil
+	}
+
+	u := r.URL.ResolveReference(ref)
+	if u.Host != "" && u.Host != r.Host {
+		return nil
+	}
+
+	sub := r.Clone(context.WithValue(r.Context(), esiFragmentKey{}, true))
+	sub.Method = http.MethodGet
+	sub.URL = u
+	sub.RequestURI = u.RequestURI()
+	sub.Body = http.NoBody
+	sub.ContentLength = 0
+
+	// The conditions of the page do not apply to its fragments.
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "Accept-Encoding"} {
+		sub.Header.Del(name)
+	}
+
+	fw := &fragmentWriter{header: http.Header{}, maxSize: m.cfg.MaxItemBytes}
+	m.ServeHTTP(fw, sub)
+
+	if fw.status != 0 && fw.status != http.StatusOK || fw.header.Get("Content-Encoding") != "" || fw.tooLarge {
+		return nil
+	}
+
+	return fw.body.Bytes()
+}
+
+// esiWriter buffers successful HTML responses, uncompressed or gzipped, up to
+// maxSize bytes, whose includes are resolved once complete, and passes the
+// others through.
+type esiWriter struct {
+	http.ResponseWriter
+	status      int
+	maxSize     int
+	buffering   bool
+	gzipped     bool
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (ew *esiWriter) WriteHeader(status int) {
+	if isInformational(status) {
+		writeInterim(ew.ResponseWriter, status)
+		return
+	}
+
+	if ew.wroteHeader {
+		return
+	}
+	ew.wroteHeader = true
+
+	h := ew.Header()
+	ce := h.Get("Content-Encoding")
+
+	if status != http.StatusOK || (ce != "" && !strings.EqualFold(ce, "gzip")) ||
+		!hasTypePrefix(h.Get("Content-Type"), []string{"text/html"}) {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	ew.status = status
+	ew.buffering = true
+	ew.gzipped = ce != ""
+
+	// The validators and length of the stored page do not describe the
+	// assembled one.
+	for _, name := range []string{"Content-Length", "ETag", "Last-Modified", "Accept-Ranges"} {
+		h.Del(name)
+	}
+}
+
+func (ew *esiWriter) Write(p []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+
+	if ew.buffering {
+		if ew.body.Len()+len(p) <= ew.maxSize {
+			return ew.body.Write(p)
+		}
+
+		ew.release()
+	}
+
+	return ew.ResponseWriter.Write(p)
+}
+
+// release stops buffering, and writes the response buffered so far as is.
+func (ew *esiWriter) release() {
+	ew.buffering = false
+
+	ew.ResponseWriter.WriteHeader(ew.status)
+	_, _ = ew.ResponseWriter.Write(ew.body.Bytes())
+	ew.body.Reset()
+}
+
+// page returns the buffered page, uncompressed. It reports false if the page
+// cannot be uncompressed within maxSize bytes.
+func (ew *esiWriter) page() ([]byte, bool) {
+	if !ew.gzipped {
+		return ew.body.Bytes(), true
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(ew.body.Bytes()))
+	if err != nil {
+		return nil, false
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(gr, int64(ew.maxSize)+1))
+	if err != nil || len(b) > ew.maxSize {
+		return nil, false
+	}
+
+	return b, true
+}
+
+func (ew *esiWriter) Flush() {
+	if ew.buffering {
+		return
+	}
+
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// fragmentWriter records the response to an include, up to maxSize bytes if
+// maxSize is positive.
+type fragmentWriter struct {
+	header   http.Header
+	status   int
+	maxSize  int
+	tooLarge bool
+	body     bytes.Buffer
+}
+
+func (fw *fragmentWriter) Header() http.Header {
+	return fw.header
+}
+
+func (fw *fragmentWriter) WriteHeader(status int) {
+	if fw.status == 0 && !isInformational(status) {
+		fw.status = status
+	}
+}
+
+func (fw *fragmentWriter) Write(p []byte) (int, error) {
+	if fw.status == 0 {
+		fw.status = http.StatusOK
+	}
+
+	if fw.maxSize > 0 && fw.body.Len()+len(p) > fw.maxSize {
+		fw.tooLarge = true
+		return len(p), nil
+	}
+
+	return fw.body.Write(p)
+}
@@ -0,0 +1,138 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCache_ServeHTTP_ESI(t *testing.T) {
+	const page = `<p><esi:include src="/fragment"/></p><esi:include src="http://evil.example/x"></esi:include>`
+
+	var (
+		fragments int
+		encoding  string
+	)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/page":
+			rw.Header().Set("Cache-Control", "max-age=60")
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = rw.Write([]byte(page))
+		case "/fragment":
+			fragments++
+			rw.Header().Set("Cache-Control", "no-store")
+			_, _ = rw.Write([]byte("hello " + strconv.Itoa(fragments)))
+		case "/large":
+			rw.Header().Set("Content-Type", "text/html")
+			_, _ = rw.Write([]byte(strings.Repeat(" ", 200) + page))
+		case "/data.txt":
+			encoding = req.Header.Get("Accept-Encoding")
+			rw.Header().Set("Cache-Control", "max-age=60")
+			rw.Header().Set("Content-Type", "text/plain")
+			_, _ = rw.Write([]byte(`<esi:include src="/fragment"/>`))
+		}
+	}
+
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, ESI: true, MaxItemBytes: 256,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc   string
+		path   string
+		state  string
+		body   string
+		length string
+	}{
+		{desc: "page miss", path: "/page", state: cacheMissStatus, body: "<p>hello 1</p>", length: "14"},
+		{desc: "page hit", path: "/page", state: cacheHitStatus, body: "<p>hello 2</p>", length: "14"},
+		{desc: "not html", path: "/data.txt", state: cacheMissStatus, body: `<esi:include src="/fragment"/>`},
+		{desc: "too large", path: "/large", state: cacheMissStatus, body: strings.Repeat(" ", 200) + page},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.desc, test.state, state)
+		}
+
+		if body := rw.Body.String(); body != test.body {
+			t.Errorf("%s: unexpected body: want %q, got: %q", test.desc, test.body, body)
+		}
+
+		if length := rw.Header().Get("Content-Length"); test.length != "" && length != test.length {
+			t.Errorf("%s: unexpected content length: want %q, got: %q", test.desc, test.length, length)
+		}
+	}
+
+	if encoding != "gzip" {
+		t.Errorf("unexpected accepted encoding of the text request: want %q, got: %q", "gzip", encoding)
+	}
+}
+
+func TestCache_ServeHTTP_ESI_Gzip(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/page":
+			rw.Header().Set("Cache-Control", "max-age=60")
+			rw.Header().Set("Content-Type", "text/html")
+			rw.Header().Set("ETag", `"v1"`)
+			_, _ = rw.Write([]byte(`<p><esi:include src="/fragment"/></p>`))
+		case "/fragment":
+			rw.Header().Set("Cache-Control", "no-store")
+			_, _ = rw.Write([]byte("hello"))
+		}
+	}
+
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, ESI: true, Compress: true,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/page", nil))
+
+	// The gzip variant is assembled, regardless of the conditions and range
+	// of the request.
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/page", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", `W/"v1-gzip"`)
+	req.Header.Set("Range", "bytes=1-2")
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected status: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	if state := rw.Header().Get("Cache-Status"); state != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+	}
+
+	if ce := rw.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("unexpected content encoding: %q", ce)
+	}
+
+	if body := rw.Body.String(); body != "<p>hello</p>" {
+		t.Errorf("unexpected body: want %q, got: %q", "<p>hello</p>", body)
+	}
+}
@@ -0,0 +1,74 @@
+package plugin_simplecache
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// isGatewayError reports whether status is the one the reverse proxy answers
+// with when the origin cannot be reached: connection refused or reset, or
+// timeout.
+func isGatewayError(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusGatewayTimeout
+}
+
+// originFallback replaces the throttling and gateway error responses of the
+// origin to a request with the entry stored for it, if any.
+type originFallback struct {
+	m   *cache
+	r   *http.Request
+	key string
+
+	data *cacheData
+	body io.ReadCloser
+}
+
+// Replace records the backoff asked by the origin response with the given
+// status and headers, and reports whether it must be replaced by the stored
+// entry, which must not be banned.
+func (f *originFallback) Replace(status int, h http.Header) bool {
+	now := f.m.clock.Now()
+
+	var window time.Duration
+
+	switch until, ok := retryAfter(status, h, now); {
+	case ok && f.m.cfg.ThrottleStaleAge.Duration() > 0:
+		f.m.throttle(f.r.Host, until)
+		window = f.m.cfg.ThrottleStaleAge.Duration()
+	case isGatewayError(status):
+		window = f.m.cfg.OfflineStaleAge.Duration()
+	}
+
+	if window <= 0 {
+		return false
+	}
+
+	data, body, err := f.m.lookupVariant(f.r, f.key)
+	if err != nil {
+		return false
+	}
+
+	expired := data.Expires.Before(now) && (now.Sub(data.Expires) > window || !f.m.staleUsable(data, now))
+	if expired || f.m.rulesFor(f.r).banned(f.r.URL.Path, data.Stored) {
+		_ = body.Close()
+		return false
+	}
+
+	f.data, f.body = data, body
+
+	return true
+}
+
+// serve serves the stored entry in place of the origin response, whose
+// headers are dropped. It returns the number of body bytes written.
+func (f *originFallback) serve(w http.ResponseWriter) int {
+	defer func() { _ = f.body.Close() }()
+
+	h := w.Header()
+	for name := range h {
+		delete(h, name)
+	}
+
+	return f.m.serveData(w, f.r, f.data, f.body, cacheStaleStatus)
+}
@@ -0,0 +1,153 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCache_ServeHTTP_OfflineStaleAge(t *testing.T) {
+	var requests int
+
+	// The reverse proxy answers a 502 when the origin refuses connections.
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, OfflineStaleAge: "10m"}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	for p, expired := range map[string]time.Duration{"/recent": time.Minute, "/old": time.Hour} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil)
+		data := &cacheData{Status: http.StatusOK, Expires: time.Now().Add(-expired), Body: []byte("some body")}
+
+		b, err := data.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = c.cache.Set(context.Background(), cacheKey(req), b, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		desc     string
+		path     string
+		status   int
+		state    string
+		body     string
+		requests int
+	}{
+		{
+			desc: "last known good", path: "/recent",
+			status: http.StatusOK, state: cacheStaleStatus, body: "some body", requests: 1,
+		},
+		{
+			desc: "origin retried", path: "/recent",
+			status: http.StatusOK, state: cacheStaleStatus, body: "some body", requests: 2,
+		},
+		{desc: "too old", path: "/old", status: http.StatusBadGateway, state: cacheMissStatus, requests: 3},
+		{desc: "not stored", path: "/none", status: http.StatusBadGateway, state: cacheMissStatus, requests: 4},
+	}
+
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil))
+
+		if rw.Code != test.status {
+			t.Errorf("%s: unexpected status: want %d, got %d", test.desc, test.status, rw.Code)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.desc, test.state, state)
+		}
+
+		if body := rw.Body.String(); test.body != "" && body != test.body {
+			t.Errorf("%s: unexpected body: want %q, got: %q", test.desc, test.body, body)
+		}
+
+		if requests != test.requests {
+			t.Errorf("%s: unexpected origin requests: want %d, got %d", test.desc, test.requests, requests)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_BannedFallback(t *testing.T) {
+	dir := createTempDir(t)
+	path := filepath.Join(dir, "rules.json")
+
+	// The clock starts at midnight.
+	rules := `{"bans": [{"path": "/news/*", "before": "2020-01-01T00:00:30Z"}]}`
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	status := http.StatusOK
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		if status == http.StatusOK {
+			rw.Header().Set("Cache-Control", "max-age=100")
+			return
+		}
+
+		rw.Header().Set("Retry-After", "30")
+		rw.WriteHeader(status)
+	}
+
+	cfg := &Config{
+		Path: dir, MaxExpiry: "300", Cleanup: "-1", AddStatusHeader: true, RulesFile: path,
+		ThrottleStaleAge: "10m", OfflineStaleAge: "10m",
+	}
+	clk := newTestClock()
+
+	h, err := newWithClock(context.Background(), http.HandlerFunc(next), cfg, "simplecache", clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc   string
+		path   string
+		status int
+	}{
+		{desc: "throttled", path: "/news/throttled", status: http.StatusTooManyRequests},
+		{desc: "offline", path: "/news/offline", status: http.StatusBadGateway},
+	}
+
+	status = http.StatusOK
+
+	for _, test := range tests {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil))
+	}
+
+	clk.Add(40 * time.Second)
+
+	// Banned entries are neither served nor used in place of the origin
+	// response.
+	for _, test := range tests {
+		status = test.status
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil))
+
+		if rw.Code != test.status {
+			t.Errorf("%s: unexpected status: want %d, got %d", test.desc, test.status, rw.Code)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != cacheMissStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.desc, cacheMissStatus, state)
+		}
+	}
+}
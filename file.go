@@ -2,27 +2,182 @@
 package plugin_simplecache
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var errCacheMiss = errors.New("cache miss")
+var (
+	errCacheMiss        = errors.New("cache miss")
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errWritesSuspended  = errors.New("cache writes suspended")
+	errReadOnly         = errors.New("cache is read-only")
+)
+
+// Write suspension states of the file cache.
+const (
+	writesEnabled int32 = iota
+	writesFailed
+)
+
+// suspendTimeout is how long writes stay suspended when the vacuum, which
+// otherwise resumes them, is disabled.
+const suspendTimeout = time.Minute
+
+// failedWriteEviction is the percentage of the indexed files evicted, soonest
+// expiring first, by a vacuum pass run while writes are suspended. The plugin
+// cannot tell a full disk from other write errors, so space is freed after
+// any of them.
+const failedWriteEviction = 10
+
+// tempFilePrefixes start the names of the temporary files written at the root
+// of the cache path: entries being written, and spilled response bodies.
+var tempFilePrefixes = []string{".write-", ".spill-"}
+
+// staleTempAge is the age past which a temporary file is deemed left behind
+// by a crash, and deleted by the vacuum. Other instances sharing the cache
+// path may still be writing younger ones.
+const staleTempAge = time.Hour
+
+// headerSize is the size of the header preceding every cached value.
+const headerSize = 24
+
+// formatVersion is the version of the format of the entry files, written in
+// every entry header. Entries of other versions, including the ones written
+// before entries had a version, are misses, deleted as they are found.
+const formatVersion = 1
+
+// entryMagic starts the header of every entry, followed by its format version.
+const entryMagic = "SCE"
+
+// checksumTable is used to compute the checksum of cached values.
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// entryHeader is the header preceding every cached value, made of the entry
+// magic and format version, the unix expiry timestamp, the CRC-32C checksum
+// and the length of the value.
+type entryHeader struct {
+	version  byte
+	expires  int64
+	checksum uint32
+	length   int64
+}
+
+// encode returns the header in the current format version.
+func (h *entryHeader) encode() []byte {
+	b := make([]byte, headerSize)
+	copy(b[0:3], entryMagic)
+	b[3] = formatVersion
+	binary.LittleEndian.PutUint64(b[4:12], uint64(h.expires))
+	binary.LittleEndian.PutUint32(b[12:16], h.checksum)
+	binary.LittleEndian.PutUint64(b[16:24], uint64(h.length))
+
+	return b
+}
+
+// decodeHeader decodes the header in b. Headers without the entry magic,
+// written before entries had a version, are of version 0.
+func decodeHeader(b []byte) entryHeader {
+	h := entryHeader{
+		expires:  int64(binary.LittleEndian.Uint64(b[4:12])),
+		checksum: binary.LittleEndian.Uint32(b[12:16]),
+		length:   int64(binary.LittleEndian.Uint64(b[16:24])),
+	}
+
+	if string(b[0:3]) == entryMagic {
+		h.version = b[3]
+	}
+
+	return h
+}
+
+// current reports whether the entry is of the current format version, and
+// can be read.
+func (h *entryHeader) current() bool {
+	return h.version == formatVersion
+}
 
 type fileCache struct {
-	path string
-	pm   *pathMutex
+	// resumeAt is the time, in unix nanoseconds, after which suspended
+	// writes resume when the vacuum is disabled. It comes first to be 64-bit
+	// aligned for atomic operations.
+	resumeAt int64
+
+	path        string
+	pm          *pathMutex
+	parallelism int
+
+	// index is populated by the first vacuum pass, which walks the whole
+	// cache path when the cache is created. Once it is complete, later passes
+	// and lookups only look at the index.
+	index   *expiryIndex
+	indexed chan struct{}
+
+	// vacuumMu serializes the vacuum passes.
+	vacuumMu   sync.Mutex
+	statsMu    sync.Mutex
+	lastVacuum vacuumStats
+
+	// suspended holds the write suspension state. Once a write fails, writes
+	// are skipped until the next vacuum pass, which is run right away to free
+	// space, or for suspendTimeout when the vacuum is disabled.
+	suspended int32
+	wake      chan struct{}
+	noVacuum  bool
+
+	// retained is 1 while expired entries are kept, neither deleted nor
+	// reported as misses, such as in maintenance mode.
+	retained int32
+
+	// readOnly disables every write and deletion. It must be set before the
+	// cache is used, and only on caches whose vacuum is disabled.
+	readOnly bool
+
+	// shared is set when other instances, or the command line tool, write to
+	// the cache path. Entries missing from the complete index are then
+	// looked for on disk, instead of being misses. It must be set before the
+	// cache is used.
+	shared bool
+
+	// signer signs the entries, if set. It must be set before the cache is
+	// used.
+	signer *entrySigner
+
+	// buckets partitions the entry files by expiry, if set. The index then
+	// maps the entry paths returned by keyPath, starting with prefix, to the
+	// expiry which names their bucket.
+	buckets *expiryBuckets
+	prefix  string
+
+	// verified holds, by entry path, the files whose value was verified
+	// against its checksum and signature, so that values are only read in
+	// full once to be verified when they are not read sequentially.
+	verifiedMu sync.Mutex
+	verified   map[string]os.FileInfo
+
+	clock clock
 }
 
-func newFileCache(path string, vacuum time.Duration) (*fileCache, error) {
+// newFileCache returns a file cache stored under path, partitioned by buckets
+// if set, vacuumed every vacuum interval until ctx is done, whose entries
+// expire against clk. A vacuum interval of 0 or less disables the vacuum:
+// expired entries are then only deleted when they are read.
+func newFileCache(ctx context.Context, path string, vacuum time.Duration, parallelism int,
+	buckets *expiryBuckets, clk clock) (*fileCache, error) {
 	info, err := os.Stat(path)
 	if err != nil {
 		return nil, fmt.Errorf("invalid cache path: %w", err)
@@ -32,117 +187,1064 @@ func newFileCache(path string, vacuum time.Duration) (*fileCache, error) {
 		return nil, errors.New("path must be a directory")
 	}
 
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
 	fc := &fileCache{
-		path: path,
-		pm:   &pathMutex{lock: map[string]*fileLock{}},
+		path:        path,
+		pm:          &pathMutex{lock: map[string]*fileLock{}},
+		parallelism: parallelism,
+		index:       newExpiryIndex(),
+		indexed:     make(chan struct{}),
+		wake:        make(chan struct{}, 1),
+		noVacuum:    vacuum <= 0,
+		buckets:     buckets,
+		prefix:      entryPrefix(path),
+		verified:    map[string]os.FileInfo{},
+		clock:       clk,
 	}
 
-	go fc.vacuum(vacuum)
+	if !fc.noVacuum {
+		go fc.vacuum(ctx, vacuum)
+	}
 
 	return fc, nil
 }
 
-func (c *fileCache) vacuum(interval time.Duration) {
+// vacuumStats describes a single vacuum pass. Dropped counts the expiry
+// bucket directories deleted at once, whose files are not counted.
+type vacuumStats struct {
+	Start    time.Time
+	Duration time.Duration
+	Scanned  int
+	Deleted  int
+	Dropped  int
+	Errors   int
+}
+
+// record counts a processed file.
+func (s *vacuumStats) record(deleted bool, err error) {
+	switch {
+	case err != nil:
+		s.Errors++
+	case deleted:
+		s.Deleted++
+	}
+}
+
+func (s *vacuumStats) merge(o vacuumStats) {
+	s.Scanned += o.Scanned
+	s.Deleted += o.Deleted
+	s.Dropped += o.Dropped
+	s.Errors += o.Errors
+}
+
+func (c *fileCache) vacuum(ctx context.Context, interval time.Duration) {
 	timer := time.NewTicker(interval)
 	defer timer.Stop()
 
-	for range timer.C {
-		_ = filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
+	c.runVacuum()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-c.wake:
+		}
+
+		stats := c.runVacuum()
+
+		if stats.Duration > interval {
+			log.Printf("Cache vacuum took longer than the cleanup interval (%s)", interval)
+		}
+	}
+}
+
+// runVacuum performs a vacuum pass, then logs and records its statistics.
+// Passes are serialized, so that it can be called outside of the vacuum loop,
+// such as by tests needing a pass complete before they go on.
+func (c *fileCache) runVacuum() vacuumStats {
+	c.vacuumMu.Lock()
+	stats := c.vacuumOnce()
+	c.vacuumMu.Unlock()
+
+	c.statsMu.Lock()
+	c.lastVacuum = stats
+	c.statsMu.Unlock()
+
+	log.Printf("Cache vacuum took %s: %d files scanned, %d deleted, %d skipped due to errors",
+		stats.Duration, stats.Scanned, stats.Deleted, stats.Errors)
+
+	return stats
+}
+
+// LastVacuum returns the statistics of the last completed vacuum pass.
+func (c *fileCache) LastVacuum() vacuumStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	return c.lastVacuum
+}
+
+func (c *fileCache) vacuumOnce() vacuumStats {
+	stats := vacuumStats{Start: time.Now()}
+	c.removeTempFiles(&stats)
+
+	if c.retaining() {
+		return stats
+	}
+
+	state := atomic.LoadInt32(&c.suspended)
+
+	if c.isIndexed() {
+		c.vacuumIndex(&stats)
+	} else {
+		c.vacuumWalk(&stats)
+		close(c.indexed)
+	}
+
+	if state != writesEnabled {
+		c.evict(&stats)
+	}
+
+	// Writes suspended during the pass stay suspended until the next one.
+	if state != writesEnabled && atomic.CompareAndSwapInt32(&c.suspended, state, writesEnabled) {
+		log.Printf("Cache writes resumed")
+	}
+
+	stats.Duration = time.Since(stats.Start)
+
+	return stats
+}
+
+// Retain keeps the expired entries while on, until it is called with false:
+// vacuum passes are skipped, and expired entries are read as any other.
+func (c *fileCache) Retain(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+
+	atomic.StoreInt32(&c.retained, v)
+}
+
+func (c *fileCache) retaining() bool {
+	return atomic.LoadInt32(&c.retained) == 1
+}
+
+// isIndexed reports whether the index holds every cache file.
+func (c *fileCache) isIndexed() bool {
+	select {
+	case <-c.indexed:
+		return true
+	default:
+		return false
+	}
+}
+
+// vacuumIndex deletes the expired files found in the index.
+func (c *fileCache) vacuumIndex(stats *vacuumStats) {
+	now := c.clock.Now().Unix()
+
+	if c.buckets != nil {
+		c.dropBuckets(stats, now)
+	}
+
+	stats.Scanned = c.index.Len()
+
+	stats.merge(c.forEach(c.index.Expired(now), func(path string, s *vacuumStats) {
+		s.record(c.vacuumIndexed(path, now))
+	}))
+}
+
+func (c *fileCache) vacuumIndexed(path string, now int64) (bool, error) {
+	mu := c.pm.MutexAt(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The entry may have been replaced since the index was read.
+	expires, ok := c.index.Get(path)
+	if !ok || expires >= now {
+		return false, nil
+	}
+
+	c.index.Delete(path)
+
+	// The files of expired buckets are deleted with their directory.
+	if c.buckets != nil && c.buckets.endOf(expires) <= now {
+		return true, nil
+	}
+
+	if err := os.Remove(c.filePath(path, expires)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// evict deletes the soonest expiring files of the index, to free space on a
+// disk which may be full.
+func (c *fileCache) evict(stats *vacuumStats) {
+	n := c.index.Len() * failedWriteEviction / 100
+	if n < 1 {
+		n = 1
+	}
+
+	stats.merge(c.forEach(c.index.Soonest(n), func(path string, s *vacuumStats) {
+		s.record(c.evictIndexed(path))
+	}))
+}
+
+func (c *fileCache) evictIndexed(path string) (bool, error) {
+	mu := c.pm.MutexAt(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	expires, ok := c.index.Get(path)
+	if !ok {
+		return false, nil
+	}
+
+	c.index.Delete(path)
+
+	if err := os.Remove(c.filePath(path, expires)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// removeTempFiles deletes the temporary files at the root of the cache path
+// older than staleTempAge, which the crash of a process left behind.
+func (c *fileCache) removeTempFiles(stats *vacuumStats) {
+	infos, err := ioutil.ReadDir(c.path)
+	if err != nil {
+		stats.Errors++
+		return
+	}
+
+	for _, info := range infos {
+		if info.IsDir() || !isTempFile(info.Name()) || time.Since(info.ModTime()) < staleTempAge {
+			continue
+		}
+
+		if err = os.Remove(filepath.Join(c.path, info.Name())); err != nil && !os.IsNotExist(err) {
+			stats.Errors++
+		}
+	}
+}
+
+// isTempFile reports whether name is the name of a temporary file.
+func isTempFile(name string) bool {
+	for _, prefix := range tempFilePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vacuumWalk reads every file under the cache path, deleting the expired
+// ones and indexing the others. The bucket directories left by a partitioned
+// layout are dropped, as their entries cannot be found anymore.
+func (c *fileCache) vacuumWalk(stats *vacuumStats) {
+	if c.buckets != nil {
+		c.vacuumBuckets(stats)
+		return
+	}
+
+	for _, dir := range bucketDirs(c.path) {
+		if err := os.RemoveAll(dir); err != nil {
+			stats.Errors++
+			continue
+		}
+
+		stats.Dropped++
+	}
+
+	c.walk(stats, func(path string, s *vacuumStats) {
+		s.record(c.vacuumFile(path))
+	})
+}
+
+// walk calls fn for every entry file under the cache path. Shard and bucket
+// directories are walked concurrently. Other files and directories are left
+// alone, in case the cache path is shared.
+func (c *fileCache) walk(stats *vacuumStats, fn func(path string, s *vacuumStats)) {
+	infos, err := ioutil.ReadDir(c.path)
+	if err != nil {
+		stats.Errors++
+		return
+	}
+
+	var shards []string
+	for _, info := range infos {
+		if info.IsDir() && isCacheDir(info.Name()) {
+			shards = append(shards, filepath.Join(c.path, info.Name()))
+		}
+	}
+
+	stats.merge(c.forEach(shards, func(shard string, s *vacuumStats) {
+		_ = filepath.Walk(shard, func(path string, info os.FileInfo, err error) error {
 			switch {
 			case err != nil:
-				return err
-			case info.IsDir():
+				s.Errors++
 				return nil
-			}
-
-			mu := c.pm.MutexAt(filepath.Base(path))
-			mu.Lock()
-			defer mu.Unlock()
-
-			// Get the expiry.
-			var t [8]byte
-			f, err := os.Open(filepath.Clean(path))
-			if err != nil {
-				// Just skip the file in this case.
-				return nil // nolint:nilerr // skip
-			}
-			if n, err := f.Read(t[:]); err != nil && n != 8 {
+			case info.IsDir(), !c.isEntryFile(path):
 				return nil
 			}
-			_ = f.Close()
 
-			expires := time.Unix(int64(binary.LittleEndian.Uint64(t[:])), 0)
-			if !expires.Before(time.Now()) {
-				return nil
-			}
+			s.Scanned++
+			fn(path, s)
 
-			// Delete the file.
-			_ = os.Remove(path)
 			return nil
 		})
+	}))
+}
+
+// forEach calls fn for every item from a pool of parallelism goroutines, and
+// returns the merged statistics they collected.
+func (c *fileCache) forEach(items []string, fn func(item string, stats *vacuumStats)) vacuumStats {
+	work := make(chan string)
+	results := make(chan vacuumStats, c.parallelism)
+
+	for i := 0; i < c.parallelism; i++ {
+		go func() {
+			var stats vacuumStats
+			for item := range work {
+				fn(item, &stats)
+			}
+			results <- stats
+		}()
+	}
+
+	for _, item := range items {
+		work <- item
 	}
+	close(work)
+
+	var total vacuumStats
+	for i := 0; i < c.parallelism; i++ {
+		total.merge(<-results)
+	}
+
+	return total
 }
 
-func (c *fileCache) Get(key string) ([]byte, error) {
-	mu := c.pm.MutexAt(key)
-	mu.RLock()
-	defer mu.RUnlock()
+func (c *fileCache) vacuumFile(path string) (bool, error) {
+	mu := c.pm.MutexAt(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Get the expiry.
+	var t [headerSize]byte
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return false, err
+	}
+	n, err := f.Read(t[:])
+	_ = f.Close()
+	if err != nil && n != headerSize {
+		return false, err
+	}
+
+	// Entries of other format versions are deleted, as they cannot be read.
+	h := decodeHeader(t[:])
+	if expires := time.Unix(h.expires, 0); h.current() && !expires.Before(c.clock.Now()) {
+		c.index.Set(path, expires.Unix())
+		return false, nil
+	}
+
+	// Delete the file.
+	if err = os.Remove(path); err != nil {
+		return false, err
+	}
+
+	c.index.Delete(path)
+
+	return true, nil
+}
+
+func (c *fileCache) Get(ctx context.Context, key string) ([]byte, error) {
+	e, err := c.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = e.Close()
+	}()
+
+	b, err := ioutil.ReadAll(&contextReader{ctx: ctx, r: e})
+	switch {
+	case errors.Is(err, errChecksumMismatch) || errors.Is(err, errSignatureMismatch):
+		return nil, errCacheMiss
+	case err != nil:
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+
+	return b, nil
+}
 
+// Open returns a reader over the value stored for key. Entries are replaced
+// atomically, so reads do not lock the entry: a reader keeps reading the value
+// it opened even if the entry is replaced or deleted meanwhile. The value is
+// verified as it is read. Once the index is complete, entries missing from it
+// are misses, unless the cache path is shared: they are then looked for on
+// disk, and indexed.
+func (c *fileCache) Open(ctx context.Context, key string) (*fileEntry, error) {
 	p := keyPath(c.path, key)
-	if info, err := os.Stat(p); err != nil || info.IsDir() {
+
+	indexed := c.isIndexed()
+
+	// Answer misses and expired entries without touching the disk.
+	expires, ok := c.index.Get(p)
+	if indexed && !ok && !c.shared {
+		return nil, errCacheMiss
+	}
+
+	if now := c.clock.Now().Unix(); indexed && ok && expires < now && !c.retaining() {
+		_, _ = c.vacuumIndexed(p, now)
+		return nil, errCacheMiss
+	}
+
+	files := c.files(p)
+	if len(files) == 0 {
+		return nil, errCacheMiss
+	}
+
+	e, err := c.open(key, p, files[0])
+	if err != nil || !indexed || ok {
+		return e, err
+	}
+
+	// Entries unknown to the index may have been written by another instance
+	// sharing the cache path, or by the command line tool, since it was built.
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+	if _, ok = c.index.Get(p); !ok {
+		c.index.Set(p, e.expires.Unix())
+	}
+	mu.Unlock()
+
+	return e, nil
+}
+
+// open opens the entry of key at p, held by file.
+func (c *fileCache) open(key, p, file string) (*fileEntry, error) {
+	if info, err := os.Stat(file); err != nil || info.IsDir() {
 		return nil, errCacheMiss
 	}
 
-	b, err := ioutil.ReadFile(filepath.Clean(p))
+	f, err := os.Open(filepath.Clean(file))
 	if err != nil {
-		return nil, fmt.Errorf("error reading file %q: %w", p, err)
+		return nil, fmt.Errorf("error reading file %q: %w", file, err)
 	}
 
-	expires := time.Unix(int64(binary.LittleEndian.Uint64(b[:8])), 0)
-	if expires.Before(time.Now()) {
-		_ = os.Remove(p)
+	h, sig, err := c.verifyEntry(f)
+	switch {
+	case errors.Is(err, errCacheMiss):
+		c.discard(p, f)
 		return nil, errCacheMiss
+	case err != nil:
+		_ = f.Close()
+		return nil, fmt.Errorf("error reading file %q: %w", file, err)
+	}
+
+	e := &fileEntry{f: f, expires: time.Unix(h.expires, 0), size: h.length, c: c, path: p, header: h, sig: sig}
+	if !c.isVerified(p, f) {
+		e.crc = crc32.New(checksumTable)
+		e.mac = c.signer.mac(key)
 	}
 
-	return b[8:], nil
+	return e, nil
 }
 
-func (c *fileCache) Set(key string, val []byte, expiry time.Duration) error {
-	mu := c.pm.MutexAt(key)
+// setVerified records that the value of the entry at path, read from f, was
+// verified. Once maxTrackedKeys entries are recorded, the records start over.
+func (c *fileCache) setVerified(path string, f *os.File) {
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	c.verifiedMu.Lock()
+	defer c.verifiedMu.Unlock()
+
+	if _, ok := c.verified[path]; !ok && len(c.verified) >= maxTrackedKeys {
+		c.verified = map[string]os.FileInfo{}
+	}
+
+	c.verified[path] = info
+}
+
+// isVerified reports whether the value of the entry at path was verified
+// from the file f, which has not been modified since.
+func (c *fileCache) isVerified(path string, f *os.File) bool {
+	c.verifiedMu.Lock()
+	verified, ok := c.verified[path]
+	c.verifiedMu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	info, err := f.Stat()
+
+	return err == nil && os.SameFile(verified, info) && info.ModTime().Equal(verified.ModTime()) &&
+		info.Size() == verified.Size()
+}
+
+// verifyEntry reads the header and the signature of the entry in f, then
+// checks that the entry is neither of another format version, expired unless
+// retained, nor truncated, which is reported as a miss. f is left positioned
+// at the start of the value, which is checked against its checksum and
+// signature as it is read.
+func (c *fileCache) verifyEntry(f *os.File) (entryHeader, []byte, error) {
+	var t [headerSize]byte
+	if _, err := io.ReadFull(f, t[:]); err != nil {
+		return entryHeader{}, nil, errCacheMiss
+	}
+
+	h := decodeHeader(t[:])
+
+	if !h.current() || (time.Unix(h.expires, 0).Before(c.clock.Now()) && !c.retaining()) {
+		return h, nil, errCacheMiss
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return h, nil, err
+	}
+
+	if info.Size()-headerSize-c.signer.size() != h.length {
+		return h, nil, errCacheMiss
+	}
+
+	sig := make([]byte, c.signer.size())
+	if _, err = io.ReadFull(f, sig); err != nil {
+		return h, nil, errCacheMiss
+	}
+
+	return h, sig, nil
+}
+
+// discard closes f, the file of the entry at path, and deletes the entry,
+// unless it has been replaced since f was opened.
+func (c *fileCache) discard(path string, f *os.File) {
+	defer func() {
+		_ = f.Close()
+	}()
+
+	c.remove(path, f)
+}
+
+// remove deletes the entry at path, unless it has been replaced since f, its
+// file, was opened.
+func (c *fileCache) remove(path string, f *os.File) {
+	if c.readOnly {
+		return
+	}
+
+	mu := c.pm.MutexAt(path)
 	mu.Lock()
 	defer mu.Unlock()
 
-	p := keyPath(c.path, key)
-	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
-		return fmt.Errorf("error creating file path: %w", err)
+	opened, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	current, err := os.Stat(f.Name())
+	if err != nil || !os.SameFile(opened, current) {
+		return
 	}
 
-	f, err := os.OpenFile(filepath.Clean(p), os.O_RDWR|os.O_CREATE, 0600)
+	c.index.Delete(path)
+	_ = os.Remove(f.Name())
+
+	c.verifiedMu.Lock()
+	delete(c.verified, path)
+	c.verifiedMu.Unlock()
+}
+
+func (c *fileCache) Set(ctx context.Context, key string, val []byte, expiry time.Duration) error {
+	return c.SetParts(ctx, key, [][]byte{val}, expiry)
+}
+
+// SetParts stores the concatenation of parts. The entry header and the parts
+// are assembled in a single buffer, so that the entry is written at once.
+func (c *fileCache) SetParts(ctx context.Context, key string, parts [][]byte, expiry time.Duration) error {
+	return c.write(ctx, key, expiry, func(f *os.File, h *entryHeader) error {
+		hash := crc32.New(checksumTable)
+		mac := c.signer.mac(key)
+
+		var length int
+		for _, part := range parts {
+			length += len(part)
+			_, _ = hash.Write(part)
+
+			if mac != nil {
+				_, _ = mac.Write(part)
+			}
+		}
+
+		h.checksum = hash.Sum32()
+		h.length = int64(length)
+
+		buf := make([]byte, 0, headerSize+int(c.signer.size())+length)
+		buf = append(buf, h.encode()...)
+		buf = append(buf, c.signer.sum(mac, h)...)
+		for _, part := range parts {
+			buf = append(buf, part...)
+		}
+
+		_, err := f.Write(buf)
+		return err
+	})
+}
+
+// SetFrom stores the value read from r. Reading r is aborted once ctx is done.
+func (c *fileCache) SetFrom(ctx context.Context, key string, r io.Reader, expiry time.Duration) error {
+	return c.write(ctx, key, expiry, func(f *os.File, h *entryHeader) error {
+		// The header and signature are written once the value is.
+		if _, err := f.Seek(headerSize+c.signer.size(), io.SeekStart); err != nil {
+			return err
+		}
+
+		hash := crc32.New(checksumTable)
+		w := io.MultiWriter(f, hash)
+
+		mac := c.signer.mac(key)
+		if mac != nil {
+			w = io.MultiWriter(f, hash, mac)
+		}
+
+		n, err := io.Copy(w, &contextReader{ctx: ctx, r: r})
+		if err != nil {
+			return err
+		}
+
+		h.checksum = hash.Sum32()
+		h.length = n
+
+		_, err = f.WriteAt(append(h.encode(), c.signer.sum(mac, h)...), 0)
+		return err
+	})
+}
+
+// write stores the entry written by fn, unless writes are suspended. A failed
+// write suspends the following ones, so that a full or broken disk does not
+// cost a failed write on every response.
+func (c *fileCache) write(ctx context.Context, key string, expiry time.Duration,
+	fn func(f *os.File, h *entryHeader) error) error {
+	if c.readOnly {
+		return errReadOnly
+	}
+
+	if state := atomic.LoadInt32(&c.suspended); state != writesEnabled && !c.resume(state) {
+		return errWritesSuspended
+	}
+
+	err := c.writeFile(ctx, key, expiry, fn)
+	if err != nil && ctx.Err() == nil {
+		c.suspend(err)
+	}
+
+	return err
+}
+
+// suspend suspends writes after err. The first error is logged, and vacuum is
+// woken up to free space, in case the disk is full.
+func (c *fileCache) suspend(err error) {
+	if c.noVacuum {
+		atomic.StoreInt64(&c.resumeAt, c.clock.Now().Add(suspendTimeout).UnixNano())
+	}
+
+	if !atomic.CompareAndSwapInt32(&c.suspended, writesEnabled, writesFailed) {
+		return
+	}
+
+	log.Printf("Cache writes suspended: %v", err)
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// resume resumes writes suspended for longer than suspendTimeout when the
+// vacuum is disabled, and reports whether they are resumed.
+func (c *fileCache) resume(state int32) bool {
+	if !c.noVacuum || c.clock.Now().UnixNano() < atomic.LoadInt64(&c.resumeAt) {
+		return false
+	}
+
+	if atomic.CompareAndSwapInt32(&c.suspended, state, writesEnabled) {
+		log.Printf("Cache writes resumed")
+	}
+
+	return true
+}
+
+// writeFile calls fn to write the header and content of the entry to a
+// temporary file, which then atomically replaces the file of the entry.
+// Temporary files are created in the cache root, which is not vacuumed. The
+// entry is not replaced if ctx is done before it is written.
+func (c *fileCache) writeFile(ctx context.Context, key string, expiry time.Duration,
+	fn func(f *os.File, h *entryHeader) error) error {
+	p := keyPath(c.path, key)
+
+	f, err := ioutil.TempFile(c.path, ".write-*")
 	if err != nil {
 		return fmt.Errorf("error creating file: %w", err)
 	}
 
 	defer func() {
 		_ = f.Close()
-	}()
-
-	timestamp := uint64(time.Now().Add(expiry).Unix())
 
-	var t [8]byte
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
 
-	binary.LittleEndian.PutUint64(t[:], timestamp)
+	h := &entryHeader{expires: c.clock.Now().Add(expiry).Unix()}
 
-	if _, err = f.Write(t[:]); err != nil {
+	if err = fn(f, h); err != nil {
 		return fmt.Errorf("error writing file: %w", err)
 	}
 
-	if _, err = f.Write(val); err != nil {
+	if err = f.Close(); err != nil {
 		return fmt.Errorf("error writing file: %w", err)
 	}
 
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+	defer mu.Unlock()
+
+	return c.place(p, f.Name(), h.expires)
+}
+
+// place moves the complete entry file tmp to the file of the entry at p,
+// whose lock must be held, then indexes it. Files of the entry in other
+// expiry buckets are deleted.
+func (c *fileCache) place(p, tmp string, expires int64) error {
+	file := c.filePath(p, expires)
+	previous := c.files(p)
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return fmt.Errorf("error creating file path: %w", err)
+	}
+
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("error replacing file: %w", err)
+	}
+
+	for _, prev := range previous {
+		if prev != file {
+			_ = os.Remove(prev)
+		}
+	}
+
+	c.index.Set(p, expires)
+
 	return nil
 }
 
+func (c *fileCache) Delete(key string) error {
+	if c.readOnly {
+		return errReadOnly
+	}
+
+	p := keyPath(c.path, key)
+
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+	defer mu.Unlock()
+
+	files := c.files(p)
+
+	c.index.Delete(p)
+
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error deleting file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// has reports whether a file holds the entry of key, expired or not.
+func (c *fileCache) has(key string) bool {
+	for _, file := range c.files(keyPath(c.path, key)) {
+		if _, err := os.Stat(file); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Flush deletes every entry of the cache.
+func (c *fileCache) Flush() (vacuumStats, error) {
+	if c.readOnly {
+		return vacuumStats{}, errReadOnly
+	}
+
+	stats := vacuumStats{Start: time.Now()}
+
+	c.walk(&stats, func(path string, s *vacuumStats) {
+		s.record(c.flushFile(path))
+	})
+
+	stats.Duration = time.Since(stats.Start)
+
+	return stats, nil
+}
+
+func (c *fileCache) flushFile(file string) (bool, error) {
+	p := c.entryPath(file)
+
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+	defer mu.Unlock()
+
+	c.index.Delete(p)
+
+	if err := os.Remove(file); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// TriggerVacuum starts a vacuum pass without waiting for the next interval.
+// It reports false if the vacuum is disabled.
+func (c *fileCache) TriggerVacuum() bool {
+	if c.noVacuum {
+		return false
+	}
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// contextReader is a reader failing once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+// fileEntry is a reader over a cached value. The value is checked against
+// its checksum and signature as it is read: the read completing it fails if
+// they do not match, and the entry is deleted.
+type fileEntry struct {
+	f       *os.File
+	expires time.Time
+	size    int64
+
+	c      *fileCache
+	path   string
+	header entryHeader
+	sig    []byte
+
+	// crc and mac hash the value read so far, until it is verified. err is
+	// the verification error, returned by every later read.
+	crc  hash.Hash32
+	mac  hash.Hash
+	read int64
+	err  error
+
+	// pos is the offset set by Seek while the value is not verified, if
+	// seeked. The value is only verified, and the offset of the underlying
+	// file set, by the next read.
+	pos    int64
+	seeked bool
+}
+
+// Expires returns the time after which the entry is deleted.
+func (e *fileEntry) Expires() time.Time {
+	return e.expires
+}
+
+// Size returns the size of the value.
+func (e *fileEntry) Size() (int64, error) {
+	return e.size, nil
+}
+
+func (e *fileEntry) Read(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	if e.seeked {
+		e.seeked = false
+
+		if err := e.verifyRest(); err != nil {
+			return 0, err
+		}
+
+		if _, err := e.f.Seek(e.pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := e.f.Read(p)
+	if e.crc == nil {
+		return n, err
+	}
+
+	_, _ = e.crc.Write(p[:n])
+	if e.mac != nil {
+		_, _ = e.mac.Write(p[:n])
+	}
+
+	e.read += int64(n)
+
+	if e.read < e.size && err == nil {
+		return n, nil
+	}
+
+	// The bytes completing a corrupted value are never returned.
+	if verr := e.verify(); verr != nil {
+		return 0, verr
+	}
+
+	return n, err
+}
+
+// verify checks the value read against the checksum and the signature of the
+// entry, deleting the entry if they do not match.
+func (e *fileEntry) verify() error {
+	crc, mac := e.crc, e.mac
+	e.crc, e.mac = nil, nil
+
+	switch {
+	case e.read != e.size || crc.Sum32() != e.header.checksum:
+		e.err = errChecksumMismatch
+	case mac != nil && !hmac.Equal(e.c.signer.sum(mac, &e.header), e.sig):
+		e.err = errSignatureMismatch
+		log.Printf("Discarding cache file %q: %v", e.f.Name(), e.err)
+	default:
+		e.c.setVerified(e.path, e.f)
+		return nil
+	}
+
+	e.c.remove(e.path, e.f)
+
+	return e.err
+}
+
+// verifyRest reads the rest of the value, if it is not verified yet, then
+// restores the offset of the next read.
+func (e *fileEntry) verifyRest() error {
+	if e.crc == nil {
+		return e.err
+	}
+
+	offset, err := e.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	// Hide WriteTo from io.Copy, which would call verifyRest again.
+	if _, err = io.Copy(ioutil.Discard, struct{ io.Reader }{e}); err != nil {
+		return err
+	}
+
+	_, err = e.f.Seek(offset, io.SeekStart)
+
+	return err
+}
+
+// Seek sets the offset of the next read in the underlying file. The value
+// starts after the entry header, so offsets are relative to the file. Until
+// the value is verified, the offset is only recorded: the next read verifies
+// the value first if it is no longer read sequentially, so that the offset
+// and size of the value are told without reading it.
+func (e *fileEntry) Seek(offset int64, whence int) (int64, error) {
+	if e.crc == nil {
+		if e.err != nil {
+			return 0, e.err
+		}
+
+		return e.f.Seek(offset, whence)
+	}
+
+	cur, err := e.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		if e.seeked {
+			offset += e.pos
+		} else {
+			offset += cur
+		}
+	case io.SeekEnd:
+		offset += headerSize + e.c.signer.size() + e.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	e.pos, e.seeked = offset, offset != cur
+
+	return offset, nil
+}
+
+// WriteTo writes the value to w. Once the value is verified, it hands the
+// underlying file to w if it is an io.ReaderFrom, so that it can use sendfile
+// on supported platforms.
+func (e *fileEntry) WriteTo(w io.Writer) (int64, error) {
+	if e.crc != nil || e.err != nil {
+		return io.Copy(w, struct{ io.Reader }{e})
+	}
+
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(e.f)
+	}
+
+	return io.Copy(w, e.f)
+}
+
+// Close closes the underlying file.
+func (e *fileEntry) Close() error {
+	return e.f.Close()
+}
+
+const hexDigits = "0123456789abcdef"
+
 func keyHash(key string) [4]byte {
 	h := crc32.Checksum([]byte(key), crc32.IEEETable)
 
@@ -153,18 +1255,108 @@ func keyHash(key string) [4]byte {
 	return b
 }
 
+// maxNameLength is the maximum length of a file named after its key, below
+// the 255 bytes limit of most filesystems.
+const maxNameLength = 200
+
+// hashedNamePrefix prefixes the names of files of keys which cannot be used
+// as file names, which are named after the SHA-256 hash of the key instead.
+const hashedNamePrefix = "sha256-"
+
+// keyPath returns the path of the file of key, sharded in directories named
+// after the bytes of its hash. It is called on every request, so the path is
+// built in a single pass and allocation.
 func keyPath(path, key string) string {
 	h := keyHash(key)
-	key = strings.NewReplacer("/", "-", ":", "_").Replace(key)
+	path = filepath.Clean(path)
 
-	return filepath.Join(
-		path,
-		hex.EncodeToString(h[0:1]),
-		hex.EncodeToString(h[1:2]),
-		hex.EncodeToString(h[2:3]),
-		hex.EncodeToString(h[3:4]),
-		key,
-	)
+	safe := safeName(key)
+
+	size := len(path) + 1 + len(h)*3 + len(key)
+	if !safe {
+		size = len(path) + 1 + len(h)*3 + len(hashedNamePrefix) + 2*sha256.Size
+	}
+
+	var b strings.Builder
+	b.Grow(size)
+
+	b.WriteString(path)
+	if !os.IsPathSeparator(path[len(path)-1]) {
+		b.WriteByte(filepath.Separator)
+	}
+
+	for _, c := range h {
+		writeHex(&b, c)
+		b.WriteByte(filepath.Separator)
+	}
+
+	if !safe {
+		b.WriteString(hashedNamePrefix)
+		for _, c := range sha256.Sum256([]byte(key)) {
+			writeHex(&b, c)
+		}
+
+		return b.String()
+	}
+
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; c {
+		case '/':
+			b.WriteByte('-')
+		case ':':
+			b.WriteByte('_')
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// isEntryFile reports whether file is laid out as the file of an entry, which
+// the cache may then delete.
+func (c *fileCache) isEntryFile(file string) bool {
+	rel, err := filepath.Rel(c.path, c.entryPath(file))
+
+	return err == nil && snapshotName(filepath.ToSlash(rel))
+}
+
+// isShard reports whether name is the name of a shard directory, made of the
+// hexadecimal digits of a byte of a key hash.
+func isShard(name string) bool {
+	return len(name) == 2 && strings.Trim(name, hexDigits) == ""
+}
+
+// isCacheDir reports whether name is the name of a directory laid out by the
+// cache at the root of its path: a shard or an expiry bucket.
+func isCacheDir(name string) bool {
+	return isShard(name) || strings.HasPrefix(name, bucketPrefix)
+}
+
+func writeHex(b *strings.Builder, c byte) {
+	b.WriteByte(hexDigits[c>>4])
+	b.WriteByte(hexDigits[c&0x0f])
+}
+
+// safeName reports whether key can be used as a file name once its '/' and
+// ':' characters are replaced. Keys too long or with control characters,
+// backslashes or characters reserved by the platform are not.
+func safeName(key string) bool {
+	if key == "" || key == "." || key == ".." || len(key) > maxNameLength {
+		return false
+	}
+
+	if strings.ContainsAny(key, reservedNameChars) || strings.ContainsAny(key[len(key)-1:], trailingNameChars) {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; c < 0x20 || c == 0x7f || c == '\\' {
+			return false
+		}
+	}
+
+	return true
 }
 
 type pathMutex struct {
@@ -200,16 +1392,7 @@ type fileLock struct {
 	ref     int
 	cleanup func()
 
-	mu sync.RWMutex
-}
-
-func (l *fileLock) RLock() {
-	l.mu.RLock()
-}
-
-func (l *fileLock) RUnlock() {
-	l.mu.RUnlock()
-	l.cleanup()
+	mu sync.Mutex
 }
 
 func (l *fileLock) Lock() {
@@ -3,7 +3,14 @@ package plugin_simplecache
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -14,25 +21,26 @@ const testCacheKey = "GETlocalhost:8080/test/path"
 
 func TestFileCache(t *testing.T) {
 	dir := createTempDir(t)
+	clk := newTestClock()
 
-	fc, err := newFileCache(dir, time.Second)
+	fc, err := newFileCache(context.Background(), dir, 0, 1, nil, clk)
 	if err != nil {
 		t.Errorf("unexpected newFileCache error: %v", err)
 	}
 
-	_, err = fc.Get(testCacheKey)
+	_, err = fc.Get(context.Background(), testCacheKey)
 	if err == nil {
 		t.Error("unexpected cache content")
 	}
 
 	cacheContent := []byte("some random cache content that should be exact")
 
-	err = fc.Set(testCacheKey, cacheContent, time.Second)
+	err = fc.Set(context.Background(), testCacheKey, cacheContent, time.Second)
 	if err != nil {
 		t.Errorf("unexpected cache set error: %v", err)
 	}
 
-	got, err := fc.Get(testCacheKey)
+	got, err := fc.Get(context.Background(), testCacheKey)
 	if err != nil {
 		t.Errorf("unexpected cache get error: %v", err)
 	}
@@ -40,6 +48,286 @@ func TestFileCache(t *testing.T) {
 	if !bytes.Equal(got, cacheContent) {
 		t.Errorf("unexpected cache content: want %s, got %s", cacheContent, got)
 	}
+
+	clk.Add(time.Second)
+
+	if _, err = fc.Get(context.Background(), testCacheKey); err != nil {
+		t.Errorf("unexpected cache get error at the expiry: %v", err)
+	}
+
+	clk.Add(time.Second)
+
+	if _, err = fc.Get(context.Background(), testCacheKey); !errors.Is(err, errCacheMiss) {
+		t.Errorf("unexpected cache get error after the expiry: want %v, got %v", errCacheMiss, err)
+	}
+}
+
+func TestFileCache_SetParts(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, time.Minute, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	parts := [][]byte{[]byte("metadata"), []byte("body")}
+
+	if err = fc.SetParts(context.Background(), testCacheKey, parts, time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	got, err := fc.Get(context.Background(), testCacheKey)
+	if err != nil {
+		t.Fatalf("unexpected cache get error: %v", err)
+	}
+
+	if string(got) != "metadatabody" {
+		t.Errorf("unexpected cache content: want %q, got %q", "metadatabody", got)
+	}
+
+	info, err := os.Stat(keyPath(dir, testCacheKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != headerSize+12 {
+		t.Errorf("unexpected file size: want %d, got %d", headerSize+12, info.Size())
+	}
+}
+
+func TestFileCache_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(f *os.File, size int64) error
+	}{
+		{
+			name: "truncated",
+			corrupt: func(f *os.File, size int64) error {
+				return f.Truncate(size - 1)
+			},
+		},
+		{
+			name: "corrupted",
+			corrupt: func(f *os.File, size int64) error {
+				_, err := f.WriteAt([]byte("x"), size-1)
+				return err
+			},
+		},
+	}
+
+	for _, test := range tests {
+		dir := createTempDir(t)
+
+		fc, err := newFileCache(context.Background(), dir, time.Minute, 1, nil, systemClock{})
+		if err != nil {
+			t.Fatalf("unexpected newFileCache error: %v", err)
+		}
+
+		content := bytes.NewReader([]byte("some cache content"))
+		if err = fc.SetFrom(context.Background(), testCacheKey, content, time.Minute); err != nil {
+			t.Fatalf("unexpected cache set error: %v", err)
+		}
+
+		if _, err = fc.Get(context.Background(), testCacheKey); err != nil {
+			t.Fatalf("unexpected cache get error: %v", err)
+		}
+
+		p := keyPath(dir, testCacheKey)
+
+		f, err := os.OpenFile(p, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = test.corrupt(f, info.Size())
+		_ = f.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = fc.Get(context.Background(), testCacheKey); !errors.Is(err, errCacheMiss) {
+			t.Errorf("%s: unexpected cache get error: want %v, got %v", test.name, errCacheMiss, err)
+		}
+
+		if _, err = os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s: expected invalid entry to be deleted, got: %v", test.name, err)
+		}
+	}
+}
+
+func TestFileCache_Open(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, time.Minute, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	cacheContent := bytes.Repeat([]byte("large cache content "), 1<<16)
+
+	if err = fc.Set(context.Background(), testCacheKey, cacheContent, time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	<-fc.indexed
+
+	e, err := fc.Open(context.Background(), testCacheKey)
+	if err != nil {
+		t.Fatalf("unexpected cache open error: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(e)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+
+	if err = e.Close(); err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+
+	if !bytes.Equal(got, cacheContent) {
+		t.Error("unexpected cache content")
+	}
+
+	if l := len(fc.pm.lock); l > 0 {
+		t.Errorf("unexpected lock length: want 0, got %d", l)
+	}
+}
+
+type readerFromRecorder struct {
+	bytes.Buffer
+	src io.Reader
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.src = src
+	return r.Buffer.ReadFrom(src)
+}
+
+func TestFileEntry_WriteTo(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, time.Minute, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	cacheContent := []byte("some random cache content that should be exact")
+
+	if err = fc.Set(context.Background(), testCacheKey, cacheContent, time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	e, err := fc.Open(context.Background(), testCacheKey)
+	if err != nil {
+		t.Fatalf("unexpected cache open error: %v", err)
+	}
+
+	defer func() { _ = e.Close() }()
+
+	// The value is verified as it is read, then the file is handed over.
+	for _, verified := range []bool{false, true} {
+		if verified {
+			if _, err = e.Seek(headerSize, io.SeekStart); err != nil {
+				t.Fatalf("unexpected seek error: %v", err)
+			}
+		}
+
+		var w readerFromRecorder
+		if _, err = io.Copy(&w, e); err != nil {
+			t.Fatalf("unexpected copy error: %v", err)
+		}
+
+		if _, ok := w.src.(*os.File); ok != verified {
+			t.Errorf("unexpected ReadFrom source of a verified (%t) value: got %T", verified, w.src)
+		}
+
+		if !bytes.Equal(w.Bytes(), cacheContent) {
+			t.Errorf("unexpected cache content: want %s, got %s", cacheContent, w.Bytes())
+		}
+	}
+}
+
+func TestFileEntry_Seek(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, time.Minute, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	cacheContent := []byte("some random cache content that should be exact")
+
+	if err = fc.Set(context.Background(), testCacheKey, cacheContent, time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	e, err := fc.Open(context.Background(), testCacheKey)
+	if err != nil {
+		t.Fatalf("unexpected cache open error: %v", err)
+	}
+
+	// The offset and the size of the value are told without reading it.
+	offset, err := e.Seek(0, io.SeekCurrent)
+	if err != nil || offset != headerSize {
+		t.Fatalf("unexpected current offset: want %d, got %d (%v)", headerSize, offset, err)
+	}
+
+	end, err := e.Seek(0, io.SeekEnd)
+	if err != nil || end-offset != int64(len(cacheContent)) {
+		t.Fatalf("unexpected size: want %d, got %d (%v)", len(cacheContent), end-offset, err)
+	}
+
+	if e.read != 0 || e.crc == nil {
+		t.Fatalf("unexpected verification on seek: %d bytes read", e.read)
+	}
+
+	if _, err = e.Seek(offset+5, io.SeekStart); err != nil {
+		t.Fatalf("unexpected seek error: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(e)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+
+	if want := cacheContent[5:]; !bytes.Equal(got, want) {
+		t.Errorf("unexpected cache content: want %s, got %s", want, got)
+	}
+
+	_ = e.Close()
+
+	// Once verified, the value is not verified again.
+	if e, err = fc.Open(context.Background(), testCacheKey); err != nil {
+		t.Fatalf("unexpected cache open error: %v", err)
+	}
+
+	if e.crc != nil {
+		t.Error("unexpected verification of a verified value")
+	}
+
+	_ = e.Close()
+
+	// Unless it is replaced.
+	if err = fc.Set(context.Background(), testCacheKey, cacheContent, time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	if e, err = fc.Open(context.Background(), testCacheKey); err != nil {
+		t.Fatalf("unexpected cache open error: %v", err)
+	}
+
+	if e.crc == nil {
+		t.Error("unexpected replaced value considered verified")
+	}
+
+	_ = e.Close()
 }
 
 func TestFileCache_ConcurrentAccess(t *testing.T) {
@@ -54,7 +342,7 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 
 	dir := createTempDir(t)
 
-	fc, err := newFileCache(dir, time.Second)
+	fc, err := newFileCache(context.Background(), dir, time.Second, 1, nil, systemClock{})
 	if err != nil {
 		t.Errorf("unexpected newFileCache error: %v", err)
 	}
@@ -69,7 +357,7 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 		defer wg.Done()
 
 		for {
-			got, _ := fc.Get(testCacheKey)
+			got, _ := fc.Get(context.Background(), testCacheKey)
 			if got != nil && !bytes.Equal(got, cacheContent) {
 				panic(fmt.Errorf("unexpected cache content: want %s, got %s", cacheContent, got))
 			}
@@ -86,7 +374,7 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 		defer wg.Done()
 
 		for {
-			err = fc.Set(testCacheKey, cacheContent, time.Second)
+			err = fc.Set(context.Background(), testCacheKey, cacheContent, time.Second)
 			if err != nil {
 				panic(fmt.Errorf("unexpected cache set error: %w", err))
 			}
@@ -102,6 +390,388 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 	wg.Wait()
 }
 
+func TestFileCache_Vacuum(t *testing.T) {
+	dir := createTempDir(t)
+	clk := newTestClock()
+
+	fc, err := newFileCache(context.Background(), dir, time.Minute, 1, nil, clk)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	<-fc.indexed
+
+	if err = fc.Set(context.Background(), "expired", []byte("content"), time.Second); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	clk.Add(2 * time.Second)
+
+	stats := fc.runVacuum()
+	if stats.Scanned != 2 || stats.Deleted != 1 || stats.Errors != 0 {
+		t.Errorf("unexpected vacuum stats: %+v", stats)
+	}
+
+	if _, err = os.Stat(keyPath(dir, "expired")); !os.IsNotExist(err) {
+		t.Errorf("expected expired file to be deleted, got: %v", err)
+	}
+
+	if _, err = fc.Get(context.Background(), testCacheKey); err != nil {
+		t.Errorf("unexpected cache get error: %v", err)
+	}
+
+	// A new cache walks the existing files concurrently to build its index.
+	if err = fc.Set(context.Background(), "expired", []byte("content"), time.Second); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	clk.Add(2 * time.Second)
+
+	// Files which are not laid out as entries are left alone, in case the
+	// cache path is shared.
+	foreign := []string{
+		filepath.Join(dir, "foreign", "file"),
+		filepath.Join(filepath.Dir(filepath.Dir(keyPath(dir, testCacheKey))), "file"),
+	}
+
+	for _, file := range foreign {
+		if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ioutil.WriteFile(file, []byte("foreign"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With the vacuum disabled, the walk only happens when it is run.
+	fc, err = newFileCache(context.Background(), dir, 0, 4, nil, clk)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	stats = fc.runVacuum()
+	if stats.Scanned != 2 || stats.Deleted != 1 || stats.Errors != 0 {
+		t.Errorf("unexpected vacuum stats: %+v", stats)
+	}
+
+	for _, file := range foreign {
+		if _, err = os.Stat(file); err != nil {
+			t.Errorf("unexpected foreign file error: %v", err)
+		}
+	}
+
+	if l := fc.index.Len(); l != 1 {
+		t.Errorf("unexpected index length: want 1, got %d", l)
+	}
+
+	if _, err = fc.Get(context.Background(), testCacheKey); err != nil {
+		t.Errorf("unexpected cache get error: %v", err)
+	}
+}
+
+func TestFileCache_VacuumStops(t *testing.T) {
+	dir := createTempDir(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fc, err := newFileCache(ctx, dir, 10*time.Millisecond, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	<-fc.indexed
+
+	cancel()
+
+	// Let a pending run complete.
+	time.Sleep(50 * time.Millisecond)
+
+	last := fc.LastVacuum().Start
+
+	time.Sleep(50 * time.Millisecond)
+
+	if start := fc.LastVacuum().Start; !start.Equal(last) {
+		t.Errorf("unexpected vacuum run after the context was cancelled at %s", start)
+	}
+}
+
+func TestFileCache_VacuumTempFiles(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, 0, 1, nil, newTestClock())
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	old := time.Now().Add(-2 * staleTempAge)
+
+	files := map[string]bool{".write-1": false, ".spill-1": false, ".write-2": true, "notes": true}
+	for name, kept := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// Young temporary files may still be written by another instance.
+		if name != "notes" && !kept {
+			if err = os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	fc.runVacuum()
+
+	for name, kept := range files {
+		if _, err = os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Errorf("%s: unexpected file state: want kept %t, got %v", name, kept, err)
+		}
+	}
+}
+
+func TestFileCache_IndexedMiss(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, time.Minute, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	<-fc.indexed
+
+	// Files unknown to the complete index are never read.
+	other, err := newFileCache(context.Background(), dir, 0, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = other.Set(context.Background(), testCacheKey, []byte("content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	if _, err = fc.Get(context.Background(), testCacheKey); !errors.Is(err, errCacheMiss) {
+		t.Errorf("unexpected cache get error: want %v, got %v", errCacheMiss, err)
+	}
+
+	// Unless the path is shared: entries written by another instance are then
+	// found, and indexed.
+	fc.shared = true
+
+	wantValue(t, fc, testCacheKey, []byte("content"))
+
+	p := keyPath(dir, testCacheKey)
+
+	if _, ok := fc.index.Get(p); !ok {
+		t.Error("unexpected entry missing from the index")
+	}
+}
+
+func TestFileCache_Cancel(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, time.Minute, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	content := bytes.NewReader([]byte("some cache content"))
+	if err = fc.SetFrom(ctx, testCacheKey, content, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected cache set error: want %v, got %v", context.Canceled, err)
+	}
+
+	if _, err = os.Stat(keyPath(dir, testCacheKey)); !os.IsNotExist(err) {
+		t.Errorf("expected cancelled entry not to be written, got: %v", err)
+	}
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("some cache content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	if _, err = fc.Get(ctx, testCacheKey); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected cache get error: want %v, got %v", context.Canceled, err)
+	}
+
+	// A cancelled read does not discard the entry.
+	if _, err = fc.Get(context.Background(), testCacheKey); err != nil {
+		t.Errorf("unexpected cache get error: %v", err)
+	}
+}
+
+func TestFileCache_ReplaceWhileReading(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, time.Minute, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("old content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	e, err := fc.Open(context.Background(), testCacheKey)
+	if err != nil {
+		t.Fatalf("unexpected cache open error: %v", err)
+	}
+
+	defer func() { _ = e.Close() }()
+
+	// Replacing an entry must not wait for its readers.
+	if err = fc.Set(context.Background(), testCacheKey, []byte("new content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	b, err := ioutil.ReadAll(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "old content" {
+		t.Errorf("unexpected open entry content: want %q, got %q", "old content", b)
+	}
+
+	got, err := fc.Get(context.Background(), testCacheKey)
+	if err != nil {
+		t.Fatalf("unexpected cache get error: %v", err)
+	}
+
+	if string(got) != "new content" {
+		t.Errorf("unexpected cache content: want %q, got %q", "new content", got)
+	}
+
+	tmp, err := filepath.Glob(filepath.Join(dir, ".write-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tmp) > 0 {
+		t.Errorf("unexpected temporary files: %v", tmp)
+	}
+}
+
+func TestFileCache_WriteError(t *testing.T) {
+	dir := createTempDir(t)
+
+	// The vacuum, woken up by the failed write, is run by the test.
+	fc, err := newFileCache(context.Background(), dir, 0, 1, nil, newTestClock())
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	fc.runVacuum()
+
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("some value"), time.Minute); err == nil ||
+		errors.Is(err, errWritesSuspended) {
+		t.Fatalf("unexpected Set error: want a write error, got %v", err)
+	}
+
+	if err = os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes are skipped until the next vacuum pass.
+	if err = fc.Set(context.Background(), testCacheKey, []byte("some value"), time.Minute); !errors.Is(err,
+		errWritesSuspended) {
+		t.Errorf("unexpected Set error: want %v, got %v", errWritesSuspended, err)
+	}
+
+	fc.runVacuum()
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("some value"), time.Minute); err != nil {
+		t.Errorf("unexpected Set error after vacuum: %v", err)
+	}
+}
+
+func TestFileCache_DiskFull(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, time.Hour, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	<-fc.indexed
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("%s%d", testCacheKey, i)
+		if err = fc.Set(context.Background(), key, []byte("some value"), time.Duration(i+1)*time.Hour); err != nil {
+			t.Fatalf("unexpected Set error: %v", err)
+		}
+	}
+
+	// Vacuum is woken up and evicts the soonest expiring entries.
+	fc.suspend(&os.PathError{Op: "write", Path: dir, Err: errors.New("no space left on device")})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fc.LastVacuum().Deleted == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, want := range []bool{false, false, true} {
+		key := fmt.Sprintf("%s%d", testCacheKey, i)
+		if _, ok := fc.index.Get(keyPath(dir, key)); ok != want {
+			t.Errorf("unexpected entry %q: want indexed %v, got %v", key, want, ok)
+		}
+	}
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("some value"), time.Minute); err != nil {
+		t.Errorf("unexpected Set error after vacuum: %v", err)
+	}
+}
+
+func TestFileCache_NoVacuum(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, 0, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("some value"), -time.Second); err != nil {
+		t.Fatalf("unexpected Set error: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if start := fc.LastVacuum().Start; !start.IsZero() {
+		t.Errorf("unexpected vacuum run at %s", start)
+	}
+
+	// Expired entries are deleted when read.
+	if _, err = fc.Get(context.Background(), testCacheKey); !errors.Is(err, errCacheMiss) {
+		t.Errorf("unexpected Get error: want %v, got %v", errCacheMiss, err)
+	}
+
+	if _, err = os.Stat(keyPath(dir, testCacheKey)); !os.IsNotExist(err) {
+		t.Errorf("unexpected expired file: %v", err)
+	}
+
+	// Suspended writes resume after a timeout.
+	fc.suspend(errors.New("write error"))
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("some value"), time.Minute); !errors.Is(err,
+		errWritesSuspended) {
+		t.Errorf("unexpected Set error: want %v, got %v", errWritesSuspended, err)
+	}
+
+	atomic.StoreInt64(&fc.resumeAt, time.Now().UnixNano())
+
+	if err = fc.Set(context.Background(), testCacheKey, []byte("some value"), time.Minute); err != nil {
+		t.Errorf("unexpected Set error after the timeout: %v", err)
+	}
+}
+
 func TestPathMutex(t *testing.T) {
 	pm := &pathMutex{lock: map[string]*fileLock{}}
 
@@ -142,17 +812,74 @@ func TestPathMutex(t *testing.T) {
 func BenchmarkFileCache_Get(b *testing.B) {
 	dir := createTempDir(b)
 
-	fc, err := newFileCache(dir, time.Minute)
+	fc, err := newFileCache(context.Background(), dir, time.Minute, 1, nil, systemClock{})
 	if err != nil {
 		b.Errorf("unexpected newFileCache error: %v", err)
 	}
 
-	_ = fc.Set(testCacheKey, []byte("some random cache content that should be exact"), time.Minute)
+	_ = fc.Set(context.Background(), testCacheKey, []byte("some random cache content that should be exact"), time.Minute)
 
 	b.ReportAllocs()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_, _ = fc.Get(testCacheKey)
+		_, _ = fc.Get(context.Background(), testCacheKey)
+	}
+}
+
+func TestKeyPath(t *testing.T) {
+	tests := []struct {
+		path string
+		key  string
+	}{
+		{path: "/tmp/cache", key: "GETlocalhost/some/path"},
+		{path: "/tmp/cache/", key: "GETlocalhost:8080/some/path"},
+		{path: "./cache", key: "GETlocalhost/"},
+		{path: "/", key: "GETlocalhost/"},
+	}
+
+	for _, test := range tests {
+		if !safeName(test.key) {
+			t.Fatalf("unexpected unsafe key %q", test.key)
+		}
+
+		h := keyHash(test.key)
+		want := filepath.Join(
+			test.path,
+			hex.EncodeToString(h[0:1]),
+			hex.EncodeToString(h[1:2]),
+			hex.EncodeToString(h[2:3]),
+			hex.EncodeToString(h[3:4]),
+			strings.NewReplacer("/", "-", ":", "_").Replace(test.key),
+		)
+
+		if got := keyPath(test.path, test.key); got != want {
+			t.Errorf("unexpected key path: want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestKeyPath_Hashed(t *testing.T) {
+	keys := []string{
+		"GETlocalhost/" + strings.Repeat("a", maxNameLength),
+		"GETlocalhost/some\x00path",
+		"GETlocalhost/some\npath",
+		"GETlocalhost/some\\..\\path",
+	}
+
+	for _, key := range keys {
+		name := filepath.Base(keyPath("/tmp/cache", key))
+
+		if !strings.HasPrefix(name, hashedNamePrefix) || len(name) != len(hashedNamePrefix)+64 {
+			t.Errorf("unexpected file name for key %q: %q", key, name)
+		}
+	}
+}
+
+func BenchmarkKeyPath(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		_ = keyPath("/tmp/cache", testCacheKey)
 	}
 }
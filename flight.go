@@ -0,0 +1,50 @@
+package plugin_simplecache
+
+import "sync"
+
+// flightGroup tracks in-flight origin requests per cache key, so that
+// concurrent misses on the same key are coalesced into a single request.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done   chan struct{}
+	once   sync.Once
+	stored bool
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: map[string]*flightCall{}}
+}
+
+// Join returns the in-flight call for key. The caller is the leader, and is
+// responsible for calling Done, if no call was in flight yet.
+func (g *flightGroup) Join(key string) (*flightCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if c, ok := g.calls[key]; ok {
+		return c, false
+	}
+
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+
+	return c, true
+}
+
+// Done publishes the result of the call to the waiting followers. stored
+// reports whether the response was stored in the cache, so that they can
+// serve it from there. Only the first call to Done has an effect.
+func (g *flightGroup) Done(key string, c *flightCall, stored bool) {
+	c.once.Do(func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+
+		c.stored = stored
+		close(c.done)
+	})
+}
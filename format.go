@@ -0,0 +1,106 @@
+package plugin_simplecache
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// formatFile is the name of the file, at the root of a cache path, holding
+// the format version of its entries.
+const formatFile = ".format"
+
+// checkFormat compares the format version recorded at the root of the cache
+// path with the current one. Entries of another version are misses, deleted
+// by the first vacuum pass or as they are read, which is logged here, then the
+// current version is recorded. Read-only caches only ignore them.
+func (c *fileCache) checkFormat() {
+	p := filepath.Join(c.path, formatFile)
+
+	version, err := readFormat(p)
+	switch {
+	case os.IsNotExist(err) && !c.hasShards():
+		// The cache path is new.
+	case os.IsNotExist(err):
+		c.logFormat("from before format versions")
+	case err != nil:
+		log.Printf("Error reading the format version of cache path %q: %v", c.path, err)
+		return
+	case version == formatVersion:
+		return
+	default:
+		c.logFormat("of format version " + strconv.Itoa(version))
+	}
+
+	if c.readOnly {
+		return
+	}
+
+	if err = writeFormat(c.path, p); err != nil {
+		log.Printf("Error recording the format version of cache path %q: %v", c.path, err)
+	}
+}
+
+func (c *fileCache) logFormat(entries string) {
+	action := "deleted"
+	if c.readOnly {
+		action = "ignored"
+	}
+
+	log.Printf("Cache path %q holds entries %s, which are %s: the current version is %d",
+		c.path, entries, action, formatVersion)
+}
+
+// hasShards reports whether the cache path holds shard or bucket directories,
+// and may then hold entries.
+func (c *fileCache) hasShards() bool {
+	infos, err := ioutil.ReadDir(c.path)
+	if err != nil {
+		return false
+	}
+
+	for _, info := range infos {
+		if info.IsDir() && isCacheDir(info.Name()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readFormat returns the format version recorded in the file at p.
+func readFormat(p string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Clean(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// writeFormat atomically records the current format version in the file at
+// p, under the cache path dir.
+func writeFormat(dir, p string) error {
+	f, err := ioutil.TempFile(dir, ".write-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(strconv.Itoa(formatVersion) + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+
+	return err
+}
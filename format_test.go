@@ -0,0 +1,143 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeLegacyEntry writes the entry of key with the header used before
+// entries had a format version.
+func writeLegacyEntry(t *testing.T, dir, key string, val []byte) string {
+	t.Helper()
+
+	b := make([]byte, 20, 20+len(val))
+	binary.LittleEndian.PutUint64(b[0:8], uint64(time.Now().Add(time.Hour).Unix()))
+	binary.LittleEndian.PutUint32(b[8:12], crc32.Checksum(val, checksumTable))
+	binary.LittleEndian.PutUint64(b[12:20], uint64(len(val)))
+	b = append(b, val...)
+
+	p := keyPath(dir, key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(p, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestEntryHeader(t *testing.T) {
+	h := entryHeader{expires: 1600000000, checksum: 42, length: 1234}
+
+	got := decodeHeader(h.encode())
+	if !got.current() || got.expires != h.expires || got.checksum != h.checksum || got.length != h.length {
+		t.Errorf("unexpected decoded header: want %+v, got %+v", h, got)
+	}
+
+	// Legacy headers start with the expiry.
+	legacy := make([]byte, headerSize)
+	binary.LittleEndian.PutUint64(legacy, uint64(time.Now().Unix()))
+
+	if got = decodeHeader(legacy); got.version != 0 || got.current() {
+		t.Errorf("unexpected legacy header version: want 0, got %d", got.version)
+	}
+}
+
+func TestFileCache_LegacyEntries(t *testing.T) {
+	dir := createTempDir(t)
+
+	read := writeLegacyEntry(t, dir, testCacheKey, []byte("some value"))
+	walked := writeLegacyEntry(t, dir, "walked", []byte("some value"))
+
+	fc, err := newFileCache(context.Background(), dir, 0, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	// Entries of other versions are never served, and deleted when read.
+	if _, err = fc.Get(context.Background(), testCacheKey); !errors.Is(err, errCacheMiss) {
+		t.Errorf("unexpected Get error: want %v, got %v", errCacheMiss, err)
+	}
+
+	if _, err = os.Stat(read); !os.IsNotExist(err) {
+		t.Errorf("unexpected legacy entry left once read: %v", err)
+	}
+
+	// Or by the first vacuum pass.
+	if stats := fc.runVacuum(); stats.Deleted != 1 {
+		t.Errorf("unexpected deleted entries: want 1, got %d", stats.Deleted)
+	}
+
+	if _, err = os.Stat(walked); !os.IsNotExist(err) {
+		t.Errorf("unexpected legacy entry left once vacuumed: %v", err)
+	}
+
+	// Offline tools reject them.
+	inspected := writeLegacyEntry(t, dir, "inspected", []byte("some value"))
+
+	if _, err = ReadEntry(inspected); !errors.Is(err, errInvalidEntry) {
+		t.Errorf("unexpected ReadEntry error: want %v, got %v", errInvalidEntry, err)
+	}
+}
+
+func TestFileCache_CheckFormat(t *testing.T) {
+	tests := []struct {
+		desc     string
+		legacy   bool
+		marker   string
+		readOnly bool
+		want     string
+	}{
+		{desc: "new path", want: "1\n"},
+		{desc: "legacy entries", legacy: true, want: "1\n"},
+		{desc: "older version", legacy: true, marker: "0\n", want: "1\n"},
+		{desc: "current version", marker: "1\n", want: "1\n"},
+		{desc: "read-only", legacy: true, readOnly: true},
+		{desc: "read-only older version", legacy: true, marker: "0\n", readOnly: true, want: "0\n"},
+	}
+
+	for _, test := range tests {
+		dir := createTempDir(t)
+		p := filepath.Join(dir, formatFile)
+
+		if test.legacy {
+			writeLegacyEntry(t, dir, testCacheKey, []byte("some value"))
+		}
+
+		if test.marker != "" {
+			if err := ioutil.WriteFile(p, []byte(test.marker), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		fc, err := newFileCache(context.Background(), dir, 0, 1, nil, systemClock{})
+		if err != nil {
+			t.Fatalf("unexpected newFileCache error: %v", err)
+		}
+
+		fc.readOnly = test.readOnly
+		fc.checkFormat()
+
+		b, err := ioutil.ReadFile(p)
+		if test.want == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: unexpected format file: %q, %v", test.desc, b, err)
+			}
+
+			continue
+		}
+
+		if string(b) != test.want {
+			t.Errorf("%s: unexpected format file: want %q, got: %q (%v)", test.desc, test.want, b, err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package plugin_simplecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const healthProbeKey = "simplecache-health-probe"
+
+// healthProbeInterval is the minimum time between two probes of the cache
+// volumes, which are otherwise written on every health request.
+const healthProbeInterval = 10 * time.Second
+
+// healthReport is the public health state, without any detail.
+type healthReport struct {
+	Status string `json:"status"`
+}
+
+type healthStatus struct {
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	LastVacuum vacuumStats    `json:"lastVacuum"`
+	DryRun     *dryRunStats   `json:"dryRun,omitempty"`
+	Volumes    []volumeStatus `json:"volumes,omitempty"`
+}
+
+// volumeStatus is the state of one of several cache paths.
+type volumeStatus struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthProbe holds the result of the last probe of the cache volumes.
+type healthProbe struct {
+	mu      sync.Mutex
+	checked time.Time
+	errs    []error
+}
+
+// serveHealth reports whether the cache is usable, for load balancers. The
+// details are only served to admins.
+func (m *cache) serveHealth(w http.ResponseWriter, r *http.Request) {
+	var failed int
+
+	errs := m.checkVolumes(r.Context())
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+
+	if failed == len(errs) {
+		writeJSON(w, http.StatusServiceUnavailable, healthReport{Status: "error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, healthReport{Status: "ok"})
+}
+
+// serveStats probes the cache volumes and reports their state. A cache
+// spanning several paths is degraded while some of them fail, and only fails
+// once all of them do.
+func (m *cache) serveStats(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{
+		Status:     "ok",
+		LastVacuum: m.cache.LastVacuum(),
+	}
+
+	if m.dryRun != nil {
+		stats := m.dryRun.Stats()
+		status.DryRun = &stats
+	}
+
+	var failed int
+
+	for i, err := range m.checkVolumes(r.Context()) {
+		v := volumeStatus{Path: m.cache.volumes[i].path, Status: "ok"}
+
+		if err != nil {
+			failed++
+			v.Status = "error"
+			v.Error = err.Error()
+			status.Error = err.Error()
+		}
+
+		status.Volumes = append(status.Volumes, v)
+	}
+
+	if len(status.Volumes) == 1 {
+		status.Volumes = nil
+	}
+
+	code := http.StatusOK
+
+	switch {
+	case failed == len(m.cache.volumes):
+		status.Status = "error"
+		code = http.StatusServiceUnavailable
+	case failed > 0:
+		status.Status = "degraded"
+	}
+
+	writeJSON(w, code, status)
+}
+
+// checkVolumes returns the errors of the last probe of the cache volumes,
+// probing them again once it is older than healthProbeInterval.
+func (m *cache) checkVolumes(ctx context.Context) []error {
+	m.health.mu.Lock()
+	defer m.health.mu.Unlock()
+
+	now := m.clock.Now()
+	if m.health.errs != nil && now.Sub(m.health.checked) < healthProbeInterval {
+		return m.health.errs
+	}
+
+	errs := m.cache.Check(ctx)
+
+	// Probes interrupted by the client are not kept.
+	if ctx.Err() == nil {
+		m.health.errs = errs
+		m.health.checked = now
+	}
+
+	return errs
+}
+
+// Probe writes, reads back and deletes a probe entry. Read-only caches are
+// only checked to be readable.
+func (c *fileCache) Probe(ctx context.Context) error {
+	if c.readOnly {
+		_, err := ioutil.ReadDir(c.path)
+		return err
+	}
+
+	want := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	if err := c.Set(ctx, healthProbeKey, want, time.Minute); err != nil {
+		return err
+	}
+
+	got, err := c.Get(ctx, healthProbeKey)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(got, want) {
+		return errors.New("probe entry content mismatch")
+	}
+
+	return c.Delete(healthProbeKey)
+}
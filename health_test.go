@@ -0,0 +1,71 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestCache_ServeHTTP_Health(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("unexpected call to next handler")
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", HealthPath: "/_health"}
+	clk := newTestClock()
+
+	c, err := newWithClock(context.Background(), http.HandlerFunc(next), cfg, "simplecache", clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/_health", nil)
+	rw := httptest.NewRecorder()
+
+	c.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	var report healthReport
+	if err = json.Unmarshal(rw.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Status != "ok" {
+		t.Errorf("unexpected health report: %s", rw.Body.String())
+	}
+
+	// Break the cache volume by replacing it with a file.
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(dir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last probe is reported until it is due again.
+	for _, want := range []int{http.StatusOK, http.StatusServiceUnavailable} {
+		rw = httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if rw.Code != want {
+			t.Errorf("unexpected status code: want %d, got %d", want, rw.Code)
+		}
+
+		clk.Add(healthProbeInterval)
+	}
+
+	if body := rw.Body.String(); body != `{"status":"error"}` {
+		t.Errorf("unexpected health report: %q", body)
+	}
+}
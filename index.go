@@ -0,0 +1,90 @@
+package plugin_simplecache
+
+import (
+	"sort"
+	"sync"
+)
+
+// expiryIndex keeps the expiry of every known cache file in memory, so that
+// vacuum passes do not need to open each file to find the expired ones.
+type expiryIndex struct {
+	mu      sync.RWMutex
+	entries map[string]int64
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{entries: map[string]int64{}}
+}
+
+// Set records the expiry, as a unix timestamp, of the file at path.
+func (i *expiryIndex) Set(path string, expires int64) {
+	i.mu.Lock()
+	i.entries[path] = expires
+	i.mu.Unlock()
+}
+
+// Get returns the expiry of the file at path.
+func (i *expiryIndex) Get(path string) (int64, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	expires, ok := i.entries[path]
+
+	return expires, ok
+}
+
+func (i *expiryIndex) Delete(path string) {
+	i.mu.Lock()
+	delete(i.entries, path)
+	i.mu.Unlock()
+}
+
+// Reset forgets every file.
+func (i *expiryIndex) Reset() {
+	i.mu.Lock()
+	i.entries = map[string]int64{}
+	i.mu.Unlock()
+}
+
+// Len returns the number of indexed files.
+func (i *expiryIndex) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return len(i.entries)
+}
+
+// Expired returns the paths of the files that expired before now.
+func (i *expiryIndex) Expired(now int64) []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var paths []string
+	for path, expires := range i.entries {
+		if expires < now {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// Soonest returns the paths of the n files expiring first.
+func (i *expiryIndex) Soonest(n int) []string {
+	i.mu.RLock()
+	paths := make([]string, 0, len(i.entries))
+	for path := range i.entries {
+		paths = append(paths, path)
+	}
+
+	sort.Slice(paths, func(a, b int) bool {
+		return i.entries[paths[a]] < i.entries[paths[b]]
+	})
+	i.mu.RUnlock()
+
+	if len(paths) > n {
+		paths = paths[:n]
+	}
+
+	return paths
+}
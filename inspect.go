@@ -0,0 +1,207 @@
+package plugin_simplecache
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errInvalidEntry is returned for files which are not entries, or entries
+// truncated.
+var errInvalidEntry = errors.New("invalid entry")
+
+// StoredEntry is an entry read from a cache path, for tools working on the
+// cache while it is offline, such as cmd/simplecache.
+type StoredEntry struct {
+	// File is the path of the entry file.
+	File string
+	// Expires is the time after which the entry is deleted, including the
+	// time it is kept for once stale.
+	Expires time.Time
+	// Size is the size of the stored value, metadata and body.
+	Size int64
+	// Signed reports whether the entry carries a signature.
+	Signed bool
+
+	Status int
+	Header http.Header
+	// Stored is the time the response was received from the origin, and
+	// FreshUntil the time it becomes stale.
+	Stored     time.Time
+	FreshUntil time.Time
+
+	bodyOffset int64
+	bodySize   int64
+}
+
+// ReadEntry reads the entry stored in file, without its body. Checksums and
+// signatures are not verified.
+func ReadEntry(file string) (*StoredEntry, error) {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var t [headerSize]byte
+	if _, err = io.ReadFull(f, t[:]); err != nil {
+		return nil, errInvalidEntry
+	}
+
+	h := decodeHeader(t[:])
+	if !h.current() {
+		return nil, fmt.Errorf("%w: format version %d, want %d", errInvalidEntry, h.version, formatVersion)
+	}
+
+	sigSize := info.Size() - headerSize - h.length
+	if sigSize != 0 && sigSize != sha256.Size {
+		return nil, errInvalidEntry
+	}
+
+	if _, err = f.Seek(sigSize, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+
+	r := &countingReader{r: io.LimitReader(f, h.length)}
+
+	data, err := decodeData(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidEntry, err)
+	}
+
+	return &StoredEntry{
+		File:       file,
+		Expires:    time.Unix(h.expires, 0),
+		Size:       h.length,
+		Signed:     sigSize > 0,
+		Status:     data.Status,
+		Header:     http.Header(data.Headers),
+		Stored:     data.Stored,
+		FreshUntil: data.Expires,
+		bodyOffset: headerSize + sigSize + r.n,
+		bodySize:   h.length - r.n,
+	}, nil
+}
+
+// Name returns the name of the entry file, made from the entry key.
+func (e *StoredEntry) Name() string {
+	return filepath.Base(e.File)
+}
+
+// BodySize returns the size of the response body.
+func (e *StoredEntry) BodySize() int64 {
+	return e.bodySize
+}
+
+// Body returns a reader over the response body.
+func (e *StoredEntry) Body() (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Clean(e.File))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = f.Seek(e.bodyOffset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, e.bodySize), f}, nil
+}
+
+// WalkEntries calls fn for every entry file under the cache path, including
+// the directories of the tenants, leaving out temporary and format files. The
+// walk stops at the first error returned by fn.
+func WalkEntries(path string, fn func(file string) error) error {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+
+		err = filepath.Walk(filepath.Join(path, info.Name()), func(p string, fi os.FileInfo, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case fi.IsDir(), fi.Name() == formatFile:
+				return nil
+			}
+
+			return fn(p)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EntryFiles returns the files, under the cache path, of the entries of the
+// given URL: the GET and HEAD responses and their gzip variants, within the
+// directory of tenant if it is set, and within every expiry bucket directory.
+func EntryFiles(path, tenant, rawURL string) ([]string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host == "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid URL %q: must have a host and a path", rawURL)
+	}
+
+	if tenant != "" {
+		path = filepath.Join(path, tenantDir(tenant))
+	}
+
+	var files []string
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		key := cacheKey(keyRequest(method, u.Host, u.Path))
+		if tenant != "" {
+			key = tenantKey(tenant, key)
+		}
+
+		files = append(files, keyPath(path, key), keyPath(path, gzipKey(key)))
+
+		for _, dir := range bucketDirs(path) {
+			files = append(files, keyPath(dir, key), keyPath(dir, gzipKey(key)))
+		}
+	}
+
+	return files, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,105 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadEntry(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Content-Type", "text/plain")
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	for _, key := range []string{"", "0123456789abcdef0123456789abcdef"} {
+		dir := createTempDir(t)
+		cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", SigningKey: key}
+
+		h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://Localhost/some/path", nil))
+
+		files, err := EntryFiles(dir, "", "http://localhost/some/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := ReadEntry(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Name() != "GETlocalhost-some-path" || e.Status != http.StatusOK || e.Signed != (key != "") {
+			t.Errorf("unexpected entry: %+v", e)
+		}
+
+		if ct := e.Header.Get("Content-Type"); ct != "text/plain" {
+			t.Errorf("unexpected content type: want %q, got: %q", "text/plain", ct)
+		}
+
+		if d := time.Until(e.FreshUntil); d <= 0 || d > 10*time.Second {
+			t.Errorf("unexpected freshness: %s", d)
+		}
+
+		if e.BodySize() != int64(len("some body")) {
+			t.Errorf("unexpected body size: want %d, got %d", len("some body"), e.BodySize())
+		}
+
+		body, err := e.Body()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadAll(body)
+		_ = body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != "some body" {
+			t.Errorf("unexpected body: want %q, got: %q", "some body", b)
+		}
+
+		var walked []string
+		if err = WalkEntries(dir, func(file string) error {
+			walked = append(walked, file)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(walked) != 1 || walked[0] != files[0] {
+			t.Errorf("unexpected walked files: want [%s], got %v", files[0], walked)
+		}
+	}
+}
+
+func TestReadEntry_Invalid(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(context.Background(), dir, 0, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fc.Set(context.Background(), "not-an-entry", []byte("nope"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ReadEntry(keyPath(dir, "not-an-entry")); err == nil {
+		t.Error("unexpected valid entry")
+	}
+
+	if _, err = EntryFiles(dir, "", "/no/host"); err == nil {
+		t.Error("unexpected valid URL without a host")
+	}
+}
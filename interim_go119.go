@@ -0,0 +1,8 @@
+//go:build go1.19
+// +build go1.19
+
+package plugin_simplecache
+
+// interimResponses reports whether the runtime sends the interim responses
+// written with a 1xx status before the final one.
+const interimResponses = true
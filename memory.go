@@ -0,0 +1,126 @@
+package plugin_simplecache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryCache keeps the most frequently hit small entries in memory, in front
+// of the file cache.
+type memoryCache struct {
+	mu          sync.Mutex
+	budget      int
+	maxItemSize int
+	size        int
+	entries     map[string]*memoryEntry
+	clock       clock
+}
+
+type memoryEntry struct {
+	val     []byte
+	expires time.Time
+	hits    int
+}
+
+func newMemoryCache(budget, maxItemSize int, clk clock) *memoryCache {
+	return &memoryCache{
+		budget:      budget,
+		maxItemSize: maxItemSize,
+		entries:     map[string]*memoryEntry{},
+		clock:       clk,
+	}
+}
+
+// Admits reports whether a value of the given size may be kept in memory.
+func (c *memoryCache) Admits(size int) bool {
+	return size <= c.maxItemSize && size <= c.budget
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if e.expires.Before(c.clock.Now()) {
+		c.delete(key)
+		return nil, false
+	}
+
+	e.hits++
+
+	return e.val, true
+}
+
+// Add keeps val in memory, evicting the least frequently hit entries if the
+// budget is exceeded.
+func (c *memoryCache) Add(key string, val []byte, expires time.Time) {
+	if !c.Admits(len(val)) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.delete(key)
+
+	for c.size+len(val) > c.budget {
+		c.evict()
+	}
+
+	c.entries[key] = &memoryEntry{val: val, expires: expires, hits: 1}
+	c.size += len(val)
+}
+
+func (c *memoryCache) Delete(key string) {
+	c.mu.Lock()
+	c.delete(key)
+	c.mu.Unlock()
+}
+
+// Clear removes every entry.
+func (c *memoryCache) Clear() {
+	c.mu.Lock()
+	c.entries = map[string]*memoryEntry{}
+	c.size = 0
+	c.mu.Unlock()
+}
+
+// DeletePrefix removes the entries whose key starts with prefix.
+func (c *memoryCache) DeletePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.delete(key)
+		}
+	}
+}
+
+func (c *memoryCache) delete(key string) {
+	if e, ok := c.entries[key]; ok {
+		c.size -= len(e.val)
+		delete(c.entries, key)
+	}
+}
+
+// evict removes the least frequently hit entry.
+func (c *memoryCache) evict() {
+	var (
+		victim  string
+		minHits = -1
+	)
+
+	for key, e := range c.entries {
+		if minHits == -1 || e.hits < minHits {
+			victim, minHits = key, e.hits
+		}
+	}
+
+	c.delete(victim)
+}
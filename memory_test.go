@@ -0,0 +1,47 @@
+package plugin_simplecache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	mc := newMemoryCache(10, 5, systemClock{})
+	expires := time.Now().Add(time.Minute)
+
+	mc.Add("too-large", []byte("123456"), expires)
+
+	if _, ok := mc.Get("too-large"); ok {
+		t.Error("unexpected entry larger than the max item size")
+	}
+
+	mc.Add("popular", []byte("12345"), expires)
+	mc.Add("other", []byte("12345"), expires)
+
+	for i := 0; i < 3; i++ {
+		if _, ok := mc.Get("popular"); !ok {
+			t.Fatal("expected popular entry to be cached")
+		}
+	}
+
+	// Adding a new entry evicts the least frequently hit one.
+	mc.Add("new", []byte("12345"), expires)
+
+	if _, ok := mc.Get("other"); ok {
+		t.Error("expected least frequently hit entry to be evicted")
+	}
+
+	if _, ok := mc.Get("popular"); !ok {
+		t.Error("expected popular entry to be kept")
+	}
+
+	if mc.size != 10 {
+		t.Errorf("unexpected memory cache size: want 10, got %d", mc.size)
+	}
+
+	mc.Add("expired", []byte("1"), time.Now().Add(-time.Second))
+
+	if _, ok := mc.Get("expired"); ok {
+		t.Error("unexpected expired entry")
+	}
+}
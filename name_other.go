@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package plugin_simplecache
+
+// reservedNameChars are the characters, besides '/', ':' and '\', not allowed
+// in file names.
+const reservedNameChars = ""
+
+// trailingNameChars are the characters file names cannot end with.
+const trailingNameChars = ""
@@ -0,0 +1,9 @@
+package plugin_simplecache
+
+// reservedNameChars are the characters, besides '/', ':' and '\', not allowed
+// in Windows file names.
+const reservedNameChars = `<>"|?*`
+
+// trailingNameChars are the characters Windows strips from the end of file
+// names, which would make distinct keys share a file.
+const trailingNameChars = ". "
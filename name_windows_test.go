@@ -0,0 +1,24 @@
+package plugin_simplecache
+
+import "testing"
+
+func TestSafeName_Windows(t *testing.T) {
+	tests := []struct {
+		key  string
+		safe bool
+	}{
+		{key: "GETlocalhost/some/path", safe: true},
+		{key: "GETlocalhost/some/path?", safe: false},
+		{key: "GETlocalhost/some*path", safe: false},
+		{key: "GETlocalhost/\"some\"/path", safe: false},
+		{key: "GETlocalhost/<some>|path", safe: false},
+		{key: "GETlocalhost/some/path.", safe: false},
+		{key: "GETlocalhost/some/path ", safe: false},
+	}
+
+	for _, test := range tests {
+		if safe := safeName(test.key); safe != test.safe {
+			t.Errorf("unexpected safe name for key %q: want %t, got %t", test.key, test.safe, safe)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package plugin_simplecache
+
+import "net/http"
+
+// optInFilter tracks whether the origin opted a response in for caching with
+// the opt-in header, which is removed before the response is sent.
+type optInFilter struct {
+	header  string
+	optedIn bool
+}
+
+// Strip records whether h holds the opt-in header, then removes it.
+func (f *optInFilter) Strip(h http.Header) {
+	if f.header == "" {
+		return
+	}
+
+	if h.Get(f.header) != "" {
+		f.optedIn = true
+	}
+
+	h.Del(f.header)
+}
+
+// Allowed reports whether the response may be stored: either no opt-in is
+// required, or the origin opted in.
+func (f *optInFilter) Allowed() bool {
+	return f.header == "" || f.optedIn
+}
@@ -0,0 +1,54 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_ServeHTTP_RequireOptInHeader(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+
+		if req.URL.Path == "/opted-in" {
+			rw.Header().Set("X-Cacheable", "1")
+		}
+
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, RequireOptInHeader: "X-Cacheable"}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		state string
+	}{
+		{path: "/opted-in", state: cacheMissStatus},
+		{path: "/opted-in", state: cacheHitStatus},
+		{path: "/other", state: cacheMissStatus},
+		{path: "/other", state: cacheMissStatus},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("request %d: unexpected cache state: want %q, got: %q", i, test.state, state)
+		}
+
+		if v := rw.Header().Get("X-Cacheable"); v != "" {
+			t.Errorf("request %d: unexpected opt-in header sent to the client: %q", i, v)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package plugin_simplecache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultUnkeyedHeaders returns the request headers removed by default from
+// the requests the cache handles. Origins commonly derive absolute URLs, or
+// even the resource served, from these headers, but they are not part of the
+// cache key, so a single request setting them could poison the entry served to
+// everyone else. X-Forwarded-Server, which Traefik sets to its own host name,
+// is left alone.
+func defaultUnkeyedHeaders() []string {
+	return []string{
+		"X-Forwarded-Host",
+		"X-Host",
+		"X-Original-URL",
+		"X-Rewrite-URL",
+		"X-HTTP-Method-Override",
+		"X-HTTP-Method",
+		"X-Method-Override",
+	}
+}
+
+// removeUnkeyedHeaders removes the unkeyed headers from r before it is
+// forwarded to the origin. X-Forwarded-Host, which Traefik sets, is kept for
+// the origins relying on it, but set to the host of the cache key.
+func removeUnkeyedHeaders(r *http.Request, names []string) {
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+
+		if _, ok := r.Header[name]; ok && name == "X-Forwarded-Host" {
+			r.Header.Set(name, strings.ToLower(r.Host))
+			continue
+		}
+
+		r.Header.Del(name)
+	}
+}
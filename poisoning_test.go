@@ -0,0 +1,69 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCache_ServeHTTP_UnkeyedHeaders(t *testing.T) {
+	tests := []struct {
+		desc           string
+		unkeyedHeaders []string
+		expected       string
+	}{
+		{desc: "default", expected: "https://localhost/"},
+		{desc: "disabled", unkeyedHeaders: []string{}, expected: "https://evil.example/"},
+	}
+
+	for _, test := range tests {
+		var forwarded []string
+
+		next := func(rw http.ResponseWriter, req *http.Request) {
+			forwarded = append(forwarded, req.Header.Get("X-Forwarded-Host"), req.Header.Get("X-Forwarded-Server"))
+
+			host := req.Header.Get("X-Forwarded-Host")
+			if host == "" {
+				host = req.Host
+			}
+
+			rw.Header().Set("Cache-Control", "max-age=20")
+			_, _ = rw.Write([]byte("https://" + host + "/"))
+		}
+
+		cfg := &Config{
+			Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+			UnkeyedHeaders: test.unkeyedHeaders,
+		}
+
+		h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.Header.Set("X-Forwarded-Host", "evil.example")
+		req.Header.Set("X-Forwarded-Server", "traefik-1")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		// The forwarded host is the keyed one, the forwarding server is kept.
+		if want := strings.TrimPrefix(strings.TrimSuffix(test.expected, "/"), "https://"); len(forwarded) != 2 ||
+			forwarded[0] != want || forwarded[1] != "traefik-1" {
+			t.Errorf("%s: unexpected forwarded headers: want [%s traefik-1], got %v", test.desc, want, forwarded)
+		}
+
+		// Host names are case insensitive, so this is the same entry.
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://LOCALHOST/", nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != cacheHitStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.desc, cacheHitStatus, state)
+		}
+
+		if body := rw.Body.String(); body != test.expected {
+			t.Errorf("%s: unexpected body: want %q, got: %q", test.desc, test.expected, body)
+		}
+	}
+}
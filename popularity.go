@@ -0,0 +1,85 @@
+package plugin_simplecache
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxTrackedKeys bounds the number of keys a hitCounter tracks. Once it is
+// reached, all counts are reset.
+const maxTrackedKeys = 100000
+
+// hitCounter counts cache hits per key.
+type hitCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newHitCounter() *hitCounter {
+	return &hitCounter{counts: map[string]int{}}
+}
+
+// Inc increments and returns the hit count of key.
+func (h *hitCounter) Inc(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.counts[key]; !ok && len(h.counts) >= maxTrackedKeys {
+		h.counts = map[string]int{}
+	}
+
+	h.counts[key]++
+
+	return h.counts[key]
+}
+
+func (h *hitCounter) Reset(key string) {
+	h.mu.Lock()
+	delete(h.counts, key)
+	h.mu.Unlock()
+}
+
+// refreshAhead refreshes a popular entry in the background when it is about
+// to expire, so that it never incurs a user visible miss.
+func (m *cache) refreshAhead(r *http.Request, key string, data *cacheData) {
+	if m.cfg.RefreshHits <= 0 {
+		return
+	}
+
+	if m.hits.Inc(key) < m.cfg.RefreshHits {
+		return
+	}
+
+	window := m.cfg.RefreshWindow.Duration()
+	if data.Expires.Sub(m.clock.Now()) > window {
+		return
+	}
+
+	m.hits.Reset(key)
+	m.refresh(r, key)
+}
+
+// randFloat returns a pseudo-random number in [0.0,1.0).
+var randFloat = rand.Float64
+
+// refreshEarly implements probabilistic early expiration (XFetch): as an entry
+// approaches its expiry, requests refresh it in the background with a
+// probability growing with the time it took to compute it.
+func (m *cache) refreshEarly(r *http.Request, key string, data *cacheData) {
+	if m.cfg.XFetchBeta <= 0 || data.Delta <= 0 {
+		return
+	}
+
+	// -log(rand) is exponentially distributed, so the entry is considered
+	// expired early by a random multiple of the time it takes to fetch it.
+	// rand is drawn from (0,1], as the logarithm of 0 is infinite.
+	gap := time.Duration(float64(data.Delta) * m.cfg.XFetchBeta * -math.Log(1-randFloat()))
+	if m.clock.Now().Add(gap).Before(data.Expires) {
+		return
+	}
+
+	m.refresh(r, key)
+}
@@ -0,0 +1,151 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_ServeHTTP_RefreshAhead(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	refreshed := make(chan struct{})
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		defer close(refreshed)
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", RefreshHits: 3, RefreshWindow: "5"}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	// Store an entry expiring within the refresh window.
+	data := &cacheData{Status: http.StatusOK, Expires: time.Now().Add(3 * time.Second)}
+
+	b, err := data.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.cache.Set(context.Background(), cacheKey(req), b, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		c.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("unexpected refresh before reaching the hit threshold: %d calls", n)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case <-refreshed:
+		waitRefresh(c, cacheKey(req))
+	case <-time.After(time.Second):
+		t.Fatal("popular entry was not refreshed ahead of its expiry")
+	}
+}
+
+// waitRefresh waits for the background refresh of key to be stored, so that
+// the cache is not removed while it is written.
+func waitRefresh(c *cache, key string) {
+	call, leader := c.flights.Join(key)
+	if leader {
+		c.flights.Done(key, call, false)
+		return
+	}
+
+	<-call.done
+}
+
+func TestCache_ServeHTTP_XFetch(t *testing.T) {
+	tests := []struct {
+		name        string
+		rand        float64
+		wantRefresh bool
+	}{
+		{
+			name:        "should refresh when the random gap reaches the expiry",
+			rand:        0.9999,
+			wantRefresh: true,
+		},
+		{
+			name:        "should not refresh when the random gap is small",
+			rand:        0.0001,
+			wantRefresh: false,
+		},
+		{
+			name:        "should not refresh when the random number is 0",
+			rand:        0,
+			wantRefresh: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func(f func() float64) { randFloat = f }(randFloat)
+			randFloat = func() float64 { return test.rand }
+
+			dir := createTempDir(t)
+
+			refreshed := make(chan struct{})
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				close(refreshed)
+			}
+
+			cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", XFetchBeta: 1}
+
+			h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := h.(*cache)
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+			// The entry took one second to fetch and expires in five.
+			data := &cacheData{Status: http.StatusOK, Expires: time.Now().Add(5 * time.Second), Delta: time.Second}
+
+			b, err := data.encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = c.cache.Set(context.Background(), cacheKey(req), b, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+
+			c.ServeHTTP(httptest.NewRecorder(), req)
+
+			select {
+			case <-refreshed:
+				if !test.wantRefresh {
+					t.Error("unexpected early refresh")
+				}
+
+				waitRefresh(c, cacheKey(req))
+			case <-time.After(200 * time.Millisecond):
+				if test.wantRefresh {
+					t.Error("expected early refresh")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package plugin_simplecache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnsatisfiableRange is returned when no byte of a range is within the
+// body.
+var errUnsatisfiableRange = errors.New("unsatisfiable range")
+
+// byteRange is a range of bytes of a body, from start to end inclusive.
+type byteRange struct {
+	start, end int64
+}
+
+// parseRange parses the Range header value s for a body of the given size.
+// Only single byte ranges are supported: ok is false for any other range,
+// which must then be ignored.
+func parseRange(s string, size int64) (br byteRange, ok bool, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) || strings.Contains(s, ",") {
+		return byteRange{}, false, nil
+	}
+
+	spec := strings.TrimSpace(s[len(prefix):])
+
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return byteRange{}, false, nil
+	}
+
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	if first == "" {
+		// A suffix range: the last bytes of the body.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, false, nil
+		}
+
+		if n == 0 || size == 0 {
+			return byteRange{}, true, errUnsatisfiableRange
+		}
+
+		if n > size {
+			n = size
+		}
+
+		return byteRange{start: size - n, end: size - 1}, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, nil
+	}
+
+	end := size - 1
+
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, false, nil
+		}
+
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	if start >= size {
+		return byteRange{}, true, errUnsatisfiableRange
+	}
+
+	return byteRange{start: start, end: end}, true, nil
+}
+
+// ifRangeMatch reports whether the If-Range value of r matches the stored
+// response with headers h. Entity tags are compared strongly, so weak ones,
+// including the generated ones, never match, and dates must be equal to the
+// modification time.
+func ifRangeMatch(r *http.Request, h http.Header) bool {
+	v := strings.TrimSpace(r.Header.Get("If-Range"))
+	if v == "" {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(v, "W/"):
+		return false
+	case strings.HasPrefix(v, `"`):
+		// Stored weak entity tags start with W/, so they never match.
+		return v == h.Get("ETag")
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return false
+	}
+
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+
+	return err == nil && t.Truncate(time.Second).Equal(lm.Truncate(time.Second))
+}
+
+// rangeRequested reports whether the range of r must be served from the
+// stored response with headers h: r has a range, without an If-Range
+// validator or with one matching the response. Otherwise, the full response
+// is served.
+func rangeRequested(r *http.Request, h http.Header) bool {
+	return r.Header.Get("Range") != "" && (r.Header.Get("If-Range") == "" || ifRangeMatch(r, h))
+}
+
+// serveRange serves the range requested by r of the stored body, whose
+// headers have been set on w. It reports whether the range could be
+// served; the full response must be served otherwise.
+func serveRange(w http.ResponseWriter, r *http.Request, body io.ReadSeeker) (int, bool) {
+	// Positions are absolute, the body may start after entry metadata.
+	offset, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+
+	end, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+
+	if _, err = body.Seek(offset, io.SeekStart); err != nil {
+		return 0, false
+	}
+
+	size := end - offset
+
+	br, ok, err := parseRange(r.Header.Get("Range"), size)
+	if !ok {
+		return 0, false
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+
+	if errors.Is(err, errUnsatisfiableRange) {
+		h.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+
+		return 0, true
+	}
+
+	if _, err = body.Seek(offset+br.start, io.SeekStart); err != nil {
+		return 0, false
+	}
+
+	length := br.end - br.start + 1
+	h.Set("Content-Range", "bytes "+strconv.FormatInt(br.start, 10)+"-"+strconv.FormatInt(br.end, 10)+"/"+
+		strconv.FormatInt(size, 10))
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	n, _ := io.CopyN(w, body, length)
+
+	return int(n), true
+}
@@ -0,0 +1,129 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected byteRange
+		ok       bool
+		err      error
+	}{
+		{value: "bytes=2-4", expected: byteRange{start: 2, end: 4}, ok: true},
+		{value: "bytes=2-", expected: byteRange{start: 2, end: 9}, ok: true},
+		{value: "bytes=-3", expected: byteRange{start: 7, end: 9}, ok: true},
+		{value: "bytes=-30", expected: byteRange{start: 0, end: 9}, ok: true},
+		{value: "bytes=5-30", expected: byteRange{start: 5, end: 9}, ok: true},
+		{value: "bytes=10-", ok: true, err: errUnsatisfiableRange},
+		{value: "bytes=-0", ok: true, err: errUnsatisfiableRange},
+		{value: "bytes=4-2"},
+		{value: "bytes=0-1,4-5"},
+		{value: "items=0-1"},
+		{value: "bytes=a-b"},
+	}
+
+	for _, test := range tests {
+		br, ok, err := parseRange(test.value, 10)
+		if ok != test.ok || !errors.Is(err, test.err) {
+			t.Errorf("%s: unexpected result: want %t, %v, got %t, %v", test.value, test.ok, test.err, ok, err)
+			continue
+		}
+
+		if err == nil && br != test.expected {
+			t.Errorf("%s: unexpected range: want %+v, got %+v", test.value, test.expected, br)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_IfRange(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	for _, memory := range []bool{false, true} {
+		next := func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Cache-Control", "max-age=20")
+			rw.Header().Set("ETag", `"v1"`)
+			rw.Header().Set("Last-Modified", lastModified)
+			_, _ = rw.Write([]byte("0123456789"))
+		}
+
+		cfg := &Config{Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+		if memory {
+			cfg.MemoryBudget, cfg.MemoryItemSize = 1<<20, 1<<10
+		}
+
+		h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/file", nil))
+
+		tests := []struct {
+			desc         string
+			rangeValue   string
+			ifRange      string
+			status       int
+			state        string
+			body         string
+			contentRange string
+		}{
+			{
+				desc: "matching entity tag", rangeValue: "bytes=2-4", ifRange: `"v1"`,
+				status: http.StatusPartialContent, state: cacheHitStatus, body: "234", contentRange: "bytes 2-4/10",
+			},
+			{
+				desc: "matching date", rangeValue: "bytes=-2", ifRange: lastModified,
+				status: http.StatusPartialContent, state: cacheHitStatus, body: "89", contentRange: "bytes 8-9/10",
+			},
+			{
+				desc: "unsatisfiable", rangeValue: "bytes=20-", ifRange: `"v1"`,
+				status: http.StatusRequestedRangeNotSatisfiable, state: cacheHitStatus, contentRange: "bytes */10",
+			},
+			{
+				desc: "other entity tag", rangeValue: "bytes=2-4", ifRange: `"v0"`,
+				status: http.StatusOK, state: cacheHitStatus, body: "0123456789",
+			},
+			{
+				desc: "weak entity tag", rangeValue: "bytes=2-4", ifRange: `W/"v1"`,
+				status: http.StatusOK, state: cacheHitStatus, body: "0123456789",
+			},
+			{
+				desc: "no If-Range", rangeValue: "bytes=2-4",
+				status: http.StatusPartialContent, state: cacheHitStatus, body: "234", contentRange: "bytes 2-4/10",
+			},
+		}
+
+		for _, test := range tests {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/file", nil)
+			req.Header.Set("Range", test.rangeValue)
+			if test.ifRange != "" {
+				req.Header.Set("If-Range", test.ifRange)
+			}
+
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			if rw.Code != test.status {
+				t.Errorf("%s (memory %t): unexpected status: want %d, got %d", test.desc, memory, test.status, rw.Code)
+			}
+
+			if state := rw.Header().Get("Cache-Status"); state != test.state {
+				t.Errorf("%s (memory %t): unexpected cache state: want %q, got: %q", test.desc, memory, test.state, state)
+			}
+
+			if body := rw.Body.String(); body != test.body {
+				t.Errorf("%s (memory %t): unexpected body: want %q, got: %q", test.desc, memory, test.body, body)
+			}
+
+			if cr := rw.Header().Get("Content-Range"); cr != test.contentRange {
+				t.Errorf("%s (memory %t): unexpected Content-Range: want %q, got: %q", test.desc, memory, test.contentRange, cr)
+			}
+		}
+	}
+}
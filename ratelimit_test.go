@@ -0,0 +1,44 @@
+package plugin_simplecache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_Allow(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.Allow(now); !ok {
+			t.Fatalf("unexpected refusal of request %d within the burst", i)
+		}
+	}
+
+	ok, wait := b.Allow(now)
+	if ok {
+		t.Fatal("unexpected request allowed past the burst")
+	}
+
+	if wait != 500*time.Millisecond {
+		t.Errorf("unexpected wait: want %s, got: %s", 500*time.Millisecond, wait)
+	}
+
+	if ok, _ = b.Allow(now.Add(500 * time.Millisecond)); !ok {
+		t.Error("unexpected refusal once a token was refilled")
+	}
+
+	if ok, _ = b.Allow(now.Add(time.Hour)); !ok {
+		t.Error("unexpected refusal after a long pause")
+	}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ = b.Allow(now.Add(time.Hour)); !ok {
+			t.Fatalf("unexpected refusal of request %d within the refilled burst", i)
+		}
+	}
+
+	if ok, _ = b.Allow(now.Add(time.Hour)); ok {
+		t.Error("unexpected request allowed past the refilled burst")
+	}
+}
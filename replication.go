@@ -0,0 +1,296 @@
+package plugin_simplecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReplicationConfig configures the replication of the stored entries to peer
+// instances, through their admin endpoints.
+type ReplicationConfig struct {
+	Peers []string `json:"peers" yaml:"peers" toml:"peers"`
+	Token string   `json:"token" yaml:"token" toml:"token"`
+}
+
+// replicationQueueSize is the number of replications waiting to be pushed to
+// the peers, past which new ones are dropped.
+const replicationQueueSize = 1024
+
+// replicationTimeout bounds every push to a peer.
+const replicationTimeout = 10 * time.Second
+
+// peerRateLimit and peerBurst limit the pushes received from the peers, per
+// second and at once, separately from the other admin requests: a peer may
+// flush its whole queue at once.
+const (
+	peerRateLimit = 200
+	peerBurst     = replicationQueueSize
+)
+
+// validate checks that the peers are admin endpoint URLs, and that a token is
+// set to authenticate to them.
+func (c ReplicationConfig) validate() error {
+	if len(c.Peers) == 0 {
+		return nil
+	}
+
+	if c.Token == "" {
+		return errors.New("replication.peers requires replication.token")
+	}
+
+	for _, peer := range c.Peers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid replication peer %q: must be an absolute http or https URL", peer)
+		}
+	}
+
+	return nil
+}
+
+// replication is an entry to push to the peers, or to delete from them.
+type replication struct {
+	key     string
+	deleted bool
+}
+
+// replicator pushes the entries stored, and the deletions of purged ones, to
+// the peers, in the background and on a best effort basis: replications are
+// dropped when the queue is full, and not retried when a peer fails. Entries
+// received from peers are stored without being pushed again. A nil replicator
+// replicates nothing.
+type replicator struct {
+	// storeFor returns the storage of the entry of a key, or nil if there is
+	// none.
+	storeFor func(key string) *volumeSet
+	peers    []string
+	token    string
+	client   *http.Client
+	queue    chan replication
+
+	// failing holds the peers whose last push failed. It is only accessed by
+	// the goroutine pushing the replications.
+	failing map[string]bool
+}
+
+func newReplicator(storeFor func(key string) *volumeSet, cfg ReplicationConfig) *replicator {
+	peers := make([]string, 0, len(cfg.Peers))
+	for _, peer := range cfg.Peers {
+		peers = append(peers, strings.TrimSuffix(peer, "/"))
+	}
+
+	return &replicator{
+		storeFor: storeFor,
+		peers:    peers,
+		token:    cfg.Token,
+		client:   &http.Client{Timeout: replicationTimeout},
+		queue:    make(chan replication, replicationQueueSize),
+		failing:  make(map[string]bool),
+	}
+}
+
+// Push queues the replication of the entry of key.
+func (p *replicator) Push(key string) {
+	p.enqueue(replication{key: key})
+}
+
+// Delete queues the deletion of the entry of key from the peers.
+func (p *replicator) Delete(key string) {
+	p.enqueue(replication{key: key, deleted: true})
+}
+
+func (p *replicator) enqueue(r replication) {
+	if p == nil {
+		return
+	}
+
+	select {
+	case p.queue <- r:
+	default:
+	}
+}
+
+// run pushes the queued replications to every peer until ctx is done.
+func (p *replicator) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-p.queue:
+			for _, peer := range p.peers {
+				p.report(peer, p.send(ctx, peer, r))
+			}
+		}
+	}
+}
+
+// send pushes r to peer. Entries expired or replaced meanwhile are not
+// pushed, the entry replacing them is queued on its own.
+func (p *replicator) send(ctx context.Context, peer string, r replication) error {
+	method := http.MethodDelete
+	q := url.Values{"key": {r.key}}
+
+	var (
+		body io.Reader
+		size int64
+	)
+
+	if !r.deleted {
+		s := p.storeFor(r.key)
+		if s == nil {
+			return nil
+		}
+
+		e, err := s.Open(ctx, r.key)
+		if errors.Is(err, errCacheMiss) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = e.Close()
+		}()
+
+		method = http.MethodPut
+		body, size = e, e.size
+		q.Set("expires", strconv.FormatInt(e.Expires().Unix(), 10))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, peer+"/entries?"+q.Encode(), body)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Authorization", "Bearer "+p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// report logs the first failed push to peer, and the first successful one
+// following failures, so that a peer down does not log every entry.
+func (p *replicator) report(peer string, err error) {
+	switch {
+	case err != nil && !p.failing[peer]:
+		p.failing[peer] = true
+		log.Printf("Replication to %s failing: %v", peer, err)
+	case err == nil && p.failing[peer]:
+		delete(p.failing, peer)
+		log.Printf("Replication to %s resumed", peer)
+	}
+}
+
+// serveEntries stores the entries pushed by peers, and deletes the ones they
+// purged. The key query parameter names the entry, and the expires one the
+// unix time after which a pushed entry is deleted.
+func (m *cache) serveEntries(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing key parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Entries of tenants this instance does not serve have nowhere to go.
+	s := m.storeFor(key)
+	if s == nil {
+		http.Error(w, "unknown tenant", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+
+	switch r.Method {
+	case http.MethodPut:
+		if !m.storePushed(w, r, s, key) {
+			return
+		}
+	case http.MethodDelete:
+		err = s.Delete(key)
+	default:
+		w.Header().Set("Allow", http.MethodPut+", "+http.MethodDelete)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if m.memory != nil {
+		m.memory.Delete(key)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storePushed stores the entry of key pushed by a peer in r into s. Entries larger
+// than maxItemBytes allows or which cannot be decoded are refused, and they
+// are kept no longer than the entries stored locally. It reports false if it
+// answered r with an error.
+func (m *cache) storePushed(w http.ResponseWriter, r *http.Request, s *volumeSet, key string) bool {
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid expires parameter", http.StatusBadRequest)
+		return false
+	}
+
+	body := r.Body
+
+	if m.cfg.MaxItemBytes > 0 {
+		// The value holds the metadata, then the body.
+		limit := int64(m.cfg.MaxItemBytes) + 4 + maxMetaSize
+		if r.ContentLength > limit {
+			http.Error(w, errItemTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return false
+		}
+
+		body = http.MaxBytesReader(w, body, limit)
+	}
+
+	ttl := time.Unix(expires, 0).Sub(m.clock.Now())
+	if maxExpiry := m.cfg.MaxExpiry.Duration(); maxExpiry > 0 && ttl > m.retention(maxExpiry) {
+		ttl = m.retention(maxExpiry)
+	}
+
+	if ttl <= 0 {
+		return true
+	}
+
+	var head bytes.Buffer
+	if _, err = decodeData(io.TeeReader(body, &head)); err != nil {
+		http.Error(w, "invalid entry: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if err = s.SetFrom(r.Context(), key, io.MultiReader(&head, body), ttl); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return false
+	}
+
+	return true
+}
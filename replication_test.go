@@ -0,0 +1,161 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache_Replication(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	admin := AdminConfig{Path: "/_cache", Tokens: []string{"secret"}}
+
+	peerCfg := &Config{Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, Admin: admin}
+
+	peer, err := New(context.Background(), http.HandlerFunc(next), peerCfg, "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(peer)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", Admin: admin,
+		Replication: ReplicationConfig{Peers: []string{srv.URL + "/_cache/"}, Token: "secret"},
+	}
+
+	h, err := New(ctx, http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	pc := peer.(*cache)
+
+	if !waitFor(func() bool { return stored(pc, cacheKey(req)) }) {
+		t.Fatal("entry not replicated to the peer")
+	}
+
+	rw := httptest.NewRecorder()
+	peer.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	if state := rw.Header().Get("Cache-Status"); state != cacheHitStatus {
+		t.Errorf("unexpected peer cache state: want %q, got: %q", cacheHitStatus, state)
+	}
+
+	if body := rw.Body.String(); body != "some body" {
+		t.Errorf("unexpected peer body: want %q, got: %q", "some body", body)
+	}
+
+	purge := httptest.NewRequest(http.MethodPost, "http://localhost/_cache/purge?url=/some/path", nil)
+	purge.Header.Set("Authorization", "Bearer secret")
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, purge)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected purge status: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	if !waitFor(func() bool { return !stored(pc, cacheKey(req)) }) {
+		t.Error("purge not replicated to the peer")
+	}
+}
+
+func TestCache_ServeAdmin_Entries(t *testing.T) {
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", MaxItemBytes: 64,
+		Admin: AdminConfig{Path: "/_cache", Tokens: []string{"secret"}, RateLimit: 1, Burst: 1},
+	}
+
+	h, err := New(context.Background(), http.NotFoundHandler(), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := (&cacheData{Status: http.StatusOK, Body: []byte("some body")}).encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expiries are capped to the local ones, and pushes are not limited by
+	// the admin budget.
+	push := "key=k&expires=" + strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)
+
+	tests := []struct {
+		desc   string
+		method string
+		query  string
+		body   string
+		status int
+	}{
+		{desc: "missing key", method: http.MethodPut, query: "expires=1", status: http.StatusBadRequest},
+		{desc: "missing expiry", method: http.MethodPut, query: "key=k", status: http.StatusBadRequest},
+		{desc: "wrong method", method: http.MethodPost, query: "key=k", status: http.StatusMethodNotAllowed},
+		{desc: "push", method: http.MethodPut, query: push, body: string(entry), status: http.StatusNoContent},
+		{desc: "push again", method: http.MethodPut, query: push, body: string(entry), status: http.StatusNoContent},
+		{desc: "invalid entry", method: http.MethodPut, query: push, body: "garbage", status: http.StatusBadRequest},
+		{
+			desc: "too large", method: http.MethodPut, query: push, body: strings.Repeat("x", 2*maxMetaSize),
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{desc: "delete", method: http.MethodDelete, query: "key=k", status: http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "http://localhost/_cache/entries?"+test.query, strings.NewReader(test.body))
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s: unexpected status: want %d, got %d", test.desc, test.status, rw.Code)
+		}
+
+		if test.desc != "push" {
+			continue
+		}
+
+		e, err := h.(*cache).cache.Open(context.Background(), "k")
+		if err != nil {
+			t.Fatalf("unexpected pushed entry error: %v", err)
+		}
+		_ = e.Close()
+
+		if limit := time.Now().Add(11 * time.Second); e.Expires().After(limit) {
+			t.Errorf("unexpected pushed entry expiry: want before %v, got %v", limit, e.Expires())
+		}
+	}
+}
+
+// stored reports whether c holds an entry for key.
+func stored(c *cache, key string) bool {
+	_, err := c.cache.Get(context.Background(), key)
+	return err == nil
+}
+
+// waitFor polls cond until it holds, for up to a second.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+
+	return cond()
+}
@@ -0,0 +1,261 @@
+package plugin_simplecache
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// TTLRule sets the expiry of the responses to the paths matching a pattern.
+type TTLRule struct {
+	Path     string   `json:"path" yaml:"path" toml:"path"`
+	TTL      Duration `json:"ttl" yaml:"ttl" toml:"ttl"`
+	Override bool     `json:"override" yaml:"override" toml:"override"`
+}
+
+// Ban invalidates the entries of the paths matching a pattern which were
+// stored before a time. They are misses, replaced by the next response of the
+// origin.
+type Ban struct {
+	Path   string    `json:"path"`
+	Before time.Time `json:"before"`
+}
+
+// HostConfig overrides the cacheability rules for the requests to some hosts.
+// Rules left empty keep their value from the main configuration.
+type HostConfig struct {
+	Hosts               []string  `json:"hosts" yaml:"hosts" toml:"hosts"`
+	TTLRules            []TTLRule `json:"ttlRules" yaml:"ttlRules" toml:"ttlRules"`
+	BypassCookies       []string  `json:"bypassCookies" yaml:"bypassCookies" toml:"bypassCookies"`
+	CacheContentTypes   []string  `json:"cacheContentTypes" yaml:"cacheContentTypes" toml:"cacheContentTypes"`
+	NoCacheContentTypes []string  `json:"noCacheContentTypes" yaml:"noCacheContentTypes" toml:"noCacheContentTypes"`
+	RefreshQuery        string    `json:"refreshQuery" yaml:"refreshQuery" toml:"refreshQuery"`
+}
+
+// ruleSet holds the cacheability rules, which are set in the configuration and
+// may be replaced by the ones of the rules file.
+type ruleSet struct {
+	TTLRules            []TTLRule    `json:"ttlRules"`
+	BypassCookies       []string     `json:"bypassCookies"`
+	CacheContentTypes   []string     `json:"cacheContentTypes"`
+	NoCacheContentTypes []string     `json:"noCacheContentTypes"`
+	RefreshQuery        string       `json:"refreshQuery"`
+	Hosts               []HostConfig `json:"hosts"`
+
+	// Bans are only set by the rules file, and apply to every host.
+	Bans []Ban `json:"bans"`
+
+	// hosts holds the rules of each of Hosts, merged with the main ones.
+	hosts []hostRules
+}
+
+type hostRules struct {
+	patterns []string
+	rules    *ruleSet
+}
+
+func newRuleSet(cfg *Config) *ruleSet {
+	s := &ruleSet{
+		TTLRules:            cfg.TTLRules,
+		BypassCookies:       cfg.BypassCookies,
+		CacheContentTypes:   cfg.CacheContentTypes,
+		NoCacheContentTypes: cfg.NoCacheContentTypes,
+		RefreshQuery:        cfg.RefreshQuery,
+		Hosts:               cfg.Hosts,
+	}
+	s.resolveHosts()
+
+	return s
+}
+
+// resolveHosts merges the rules of each host configuration with the main ones.
+func (s *ruleSet) resolveHosts() {
+	s.hosts = nil
+
+	for _, hc := range s.Hosts {
+		rules := &ruleSet{
+			TTLRules:            s.TTLRules,
+			BypassCookies:       s.BypassCookies,
+			CacheContentTypes:   s.CacheContentTypes,
+			NoCacheContentTypes: s.NoCacheContentTypes,
+			RefreshQuery:        s.RefreshQuery,
+			Bans:                s.Bans,
+		}
+
+		if hc.TTLRules != nil {
+			rules.TTLRules = hc.TTLRules
+		}
+
+		if hc.BypassCookies != nil {
+			rules.BypassCookies = hc.BypassCookies
+		}
+
+		if hc.CacheContentTypes != nil {
+			rules.CacheContentTypes = hc.CacheContentTypes
+		}
+
+		if hc.NoCacheContentTypes != nil {
+			rules.NoCacheContentTypes = hc.NoCacheContentTypes
+		}
+
+		if hc.RefreshQuery != "" {
+			rules.RefreshQuery = hc.RefreshQuery
+		}
+
+		s.hosts = append(s.hosts, hostRules{patterns: hc.Hosts, rules: rules})
+	}
+}
+
+// forHost returns the rules of the first host configuration matching host,
+// or s if none does. Host patterns may contain wildcards, as in
+// *.example.com, and the port of host is ignored.
+func (s *ruleSet) forHost(host string) *ruleSet {
+	if len(s.hosts) == 0 {
+		return s
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+
+	for _, h := range s.hosts {
+		for _, pattern := range h.patterns {
+			if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+				return h.rules
+			}
+		}
+	}
+
+	return s
+}
+
+// validate checks the syntax of the wildcard patterns and durations of s and
+// of its host configurations, reporting every problem found.
+func (s *ruleSet) validate() error {
+	var errs configErrors
+
+	s.validateRules(&errs, "")
+
+	for _, h := range s.hosts {
+		for _, pattern := range h.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs.add(fmt.Errorf("invalid host %q: %w", pattern, err))
+			}
+		}
+
+		h.rules.validateRules(&errs, fmt.Sprintf("hosts %q: ", h.patterns))
+	}
+
+	return errs.err()
+}
+
+// validateRules records the problems of the rules of s in errs, prefixing
+// them with prefix.
+func (s *ruleSet) validateRules(errs *configErrors, prefix string) {
+	for _, pattern := range s.BypassCookies {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs.add(fmt.Errorf("%sinvalid bypass cookie %q: %w", prefix, pattern, err))
+		}
+	}
+
+	for _, patterns := range [][]string{s.CacheContentTypes, s.NoCacheContentTypes} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs.add(fmt.Errorf("%sinvalid content type %q: %w", prefix, pattern, err))
+			}
+		}
+	}
+
+	for _, ban := range s.Bans {
+		if _, err := path.Match(ban.Path, ""); err != nil {
+			errs.add(fmt.Errorf("%sinvalid ban path %q: %w", prefix, ban.Path, err))
+		}
+
+		if ban.Before.IsZero() {
+			errs.add(fmt.Errorf("%smissing before time of ban %q", prefix, ban.Path))
+		}
+	}
+
+	for _, rule := range s.TTLRules {
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			errs.add(fmt.Errorf("%sinvalid ttl rule path %q: %w", prefix, rule.Path, err))
+		}
+
+		if ttl, err := rule.TTL.parse(); err != nil {
+			errs.add(fmt.Errorf("%sinvalid ttl of rule %q: %w", prefix, rule.Path, err))
+		} else if ttl < 0 {
+			errs.add(fmt.Errorf("%sttl of rule %q must be greater or equal to 0", prefix, rule.Path))
+		}
+	}
+}
+
+// banned reports whether the entry of urlPath stored at the given time is
+// invalidated by a ban.
+func (s *ruleSet) banned(urlPath string, stored time.Time) bool {
+	for _, ban := range s.Bans {
+		if stored.Before(ban.Before) && matchPath(ban.Path, urlPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchRule returns the first rule whose pattern matches urlPath.
+func matchRule(rules []TTLRule, urlPath string) (TTLRule, bool) {
+	for _, rule := range rules {
+		if matchPath(rule.Path, urlPath) {
+			return rule, true
+		}
+	}
+
+	return TTLRule{}, false
+}
+
+// matchPath reports whether urlPath matches pattern. A * matches any sequence
+// of characters within a path segment, except at the end of the pattern where
+// it matches the rest of the path, including its subdirectories.
+func matchPath(pattern, urlPath string) bool {
+	if strings.HasSuffix(pattern, "*") && strings.HasPrefix(urlPath, strings.TrimSuffix(pattern, "*")) {
+		return true
+	}
+
+	ok, _ := path.Match(pattern, urlPath)
+
+	return ok
+}
+
+// ruleExpiry returns the expiry of a response with headers h matching rule,
+// capped by maxExpiry. The rule TTL is used when the origin does not set an
+// expiry, or, when it overrides the origin, in place of its expiry, including
+// for responses not cacheable by default. The no-store and private directives
+// and the responses setting cookies are never overridden. Rules that override
+// the origin with a TTL of 0 disable caching.
+func (m *cache) ruleExpiry(rule TTLRule, status int, h http.Header, reasons []cacheobject.Reason,
+	expireBy time.Time) (time.Duration, bool) {
+	if !containsStatus(m.cfg.CacheableStatus, status) {
+		return 0, false
+	}
+
+	for _, reason := range reasons {
+		if !rule.Override || reason != cacheobject.ReasonResponseUncachableByDefault {
+			return 0, false
+		}
+	}
+
+	switch {
+	case rule.Override && (rule.TTL.Duration() <= 0 || len(h.Values("Set-Cookie")) > 0):
+		return 0, false
+	case rule.Override || expireBy.IsZero():
+		return m.capExpiry(rule.TTL.Duration()), true
+	default:
+		return m.originExpiry(expireBy, h.Get("Content-Type")), true
+	}
+}
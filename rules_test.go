@@ -0,0 +1,165 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{pattern: "/api/*", path: "/api/users", want: true},
+		{pattern: "/api/*", path: "/api/users/1", want: true},
+		{pattern: "/api/*", path: "/api", want: false},
+		{pattern: "/assets/*.css", path: "/assets/main.css", want: true},
+		{pattern: "/assets/*.css", path: "/assets/main.js", want: false},
+		{pattern: "/*/feed", path: "/blog/feed", want: true},
+		{pattern: "/*/feed", path: "/blog/2020/feed", want: false},
+		{pattern: "/about", path: "/about", want: true},
+		{pattern: "/about", path: "/about/team", want: false},
+	}
+
+	for _, test := range tests {
+		if got := matchPath(test.pattern, test.path); got != test.want {
+			t.Errorf("unexpected match of %q against %q: want %v, got %v", test.path, test.pattern, test.want, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_TTLRules(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		if cc := req.URL.Query().Get("cc"); cc != "" {
+			rw.Header().Set("Cache-Control", cc)
+		}
+
+		if req.URL.Query().Get("cookie") != "" {
+			rw.Header().Set("Set-Cookie", "session=1")
+		}
+
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		TTLRules: []TTLRule{
+			{Path: "/api/nocache", TTL: "0", Override: true},
+			{Path: "/api/*", TTL: "30"},
+			{Path: "/assets/*", TTL: "7d", Override: true},
+		},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url   string
+		state string
+	}{
+		{url: "/api/users", state: cacheHitStatus},
+		{url: "/api/private?cc=no-store", state: cacheMissStatus},
+		{url: "/api/nocache?cc=max-age=20", state: cacheMissStatus},
+		{url: "/assets/main.css?cc=max-age=1", state: cacheHitStatus},
+		{url: "/assets/private.css?cc=private", state: cacheMissStatus},
+		{url: "/assets/no-store.css?cc=no-store", state: cacheMissStatus},
+		{url: "/assets/cookie.css?cookie=1", state: cacheMissStatus},
+		{url: "/other", state: cacheMissStatus},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.url, nil)
+			rw := httptest.NewRecorder()
+
+			c.ServeHTTP(rw, req)
+
+			if i == 0 {
+				continue
+			}
+
+			if state := rw.Header().Get("Cache-Status"); state != test.state {
+				t.Errorf("%s: unexpected cache state: want %q, got: %q", test.url, test.state, state)
+			}
+		}
+	}
+
+	// Rule TTLs are capped by maxExpiry.
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/assets/main.css", nil)
+
+	data, body, err := c.(*cache).lookup(context.Background(), cacheKey(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = body.Close()
+
+	if limit := time.Now().Add(11 * time.Second); data.Expires.After(limit) {
+		t.Errorf("unexpected expiry: want before %v, got %v", limit, data.Expires)
+	}
+}
+
+func TestRuleSet_ForHost(t *testing.T) {
+	cfg := &Config{
+		BypassCookies: []string{"sessionid"},
+		RefreshQuery:  "cache=false",
+		Hosts: []HostConfig{
+			{Hosts: []string{"shop.example.com"}, BypassCookies: []string{"cart"}},
+			{Hosts: []string{"*.example.org", "example.org"}, RefreshQuery: "refresh"},
+		},
+	}
+
+	rules := newRuleSet(cfg)
+
+	if err := rules.validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	tests := []struct {
+		host          string
+		bypassCookies []string
+		refreshQuery  string
+	}{
+		{host: "shop.example.com", bypassCookies: []string{"cart"}, refreshQuery: "cache=false"},
+		{host: "Shop.Example.com:8080", bypassCookies: []string{"cart"}, refreshQuery: "cache=false"},
+		{host: "www.example.org", bypassCookies: []string{"sessionid"}, refreshQuery: "refresh"},
+		{host: "example.org", bypassCookies: []string{"sessionid"}, refreshQuery: "refresh"},
+		{host: "example.com", bypassCookies: []string{"sessionid"}, refreshQuery: "cache=false"},
+	}
+
+	for _, test := range tests {
+		got := rules.forHost(test.host)
+
+		if !reflect.DeepEqual(got.BypassCookies, test.bypassCookies) {
+			t.Errorf("%s: unexpected bypass cookies: want %q, got %q", test.host, test.bypassCookies, got.BypassCookies)
+		}
+
+		if got.RefreshQuery != test.refreshQuery {
+			t.Errorf("%s: unexpected refresh query: want %q, got %q", test.host, test.refreshQuery, got.RefreshQuery)
+		}
+	}
+}
+
+func TestRuleSet_Validate_Hosts(t *testing.T) {
+	tests := []struct {
+		name string
+		host HostConfig
+	}{
+		{name: "invalid host", host: HostConfig{Hosts: []string{"[example.com"}}},
+		{name: "invalid rule", host: HostConfig{Hosts: []string{"example.com"}, BypassCookies: []string{"session["}}},
+	}
+
+	for _, test := range tests {
+		if err := newRuleSet(&Config{Hosts: []HostConfig{test.host}}).validate(); err == nil {
+			t.Errorf("%s: expected a validation error", test.name)
+		}
+	}
+}
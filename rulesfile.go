@@ -0,0 +1,139 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ruleSet returns the current cacheability rules.
+func (m *cache) ruleSet() *ruleSet {
+	return m.rules.Load().(*ruleSet)
+}
+
+// rulesFor returns the current cacheability rules for the host of r.
+func (m *cache) rulesFor(r *http.Request) *ruleSet {
+	return m.ruleSet().forHost(r.Host)
+}
+
+// initRules sets the rules from the configuration and, if any, from the rules
+// file, which is then watched for changes until ctx is done.
+func (m *cache) initRules(ctx context.Context) error {
+	base := newRuleSet(m.cfg)
+	m.rules.Store(base)
+
+	if m.cfg.RulesFile == "" {
+		return nil
+	}
+
+	info, err := os.Stat(m.cfg.RulesFile)
+	if err != nil {
+		return fmt.Errorf("error reading rules file: %w", err)
+	}
+
+	rules, err := loadRules(m.cfg.RulesFile, base)
+	if err != nil {
+		return err
+	}
+
+	m.rules.Store(rules)
+
+	if interval := m.cfg.RulesReload.Duration(); interval > 0 {
+		go m.watchRules(ctx, base, info, interval)
+	}
+
+	return nil
+}
+
+// watchRules reloads the rules file whenever its size or modification time
+// changes, checking every interval. Invalid files are logged and ignored, the
+// previous rules being kept.
+func (m *cache) watchRules(ctx context.Context, base *ruleSet, last os.FileInfo, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(m.cfg.RulesFile)
+		if err != nil {
+			log.Printf("Error reading rules file: %v", err)
+			continue
+		}
+
+		if info.Size() == last.Size() && info.ModTime().Equal(last.ModTime()) {
+			continue
+		}
+
+		last = info
+
+		rules, err := loadRules(m.cfg.RulesFile, base)
+		if err != nil {
+			log.Printf("Error reloading rules file: %v", err)
+			continue
+		}
+
+		m.rules.Store(rules)
+		log.Printf("Rules file reloaded")
+	}
+}
+
+// loadRules reads the JSON rules file at path. The rules it sets replace the
+// ones of base, which are kept otherwise. YAML is not supported, as plugins are
+// limited to the standard library, which has no YAML decoder.
+func loadRules(path string, base *ruleSet) (*ruleSet, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules file: %w", err)
+	}
+
+	var file ruleSet
+	if err = json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("error parsing rules file: %w", err)
+	}
+
+	rules := *base
+
+	if file.TTLRules != nil {
+		rules.TTLRules = file.TTLRules
+	}
+
+	if file.BypassCookies != nil {
+		rules.BypassCookies = file.BypassCookies
+	}
+
+	if file.CacheContentTypes != nil {
+		rules.CacheContentTypes = file.CacheContentTypes
+	}
+
+	if file.NoCacheContentTypes != nil {
+		rules.NoCacheContentTypes = file.NoCacheContentTypes
+	}
+
+	if file.RefreshQuery != "" {
+		rules.RefreshQuery = file.RefreshQuery
+	}
+
+	if file.Hosts != nil {
+		rules.Hosts = file.Hosts
+	}
+
+	rules.Bans = file.Bans
+
+	rules.resolveHosts()
+
+	if err = rules.validate(); err != nil {
+		return nil, fmt.Errorf("invalid rules file: %w", err)
+	}
+
+	return &rules, nil
+}
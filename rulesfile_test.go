@@ -0,0 +1,201 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadRules(t *testing.T) {
+	dir := createTempDir(t)
+
+	base := &ruleSet{
+		BypassCookies:     []string{"sessionid"},
+		CacheContentTypes: []string{"image/*"},
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    *ruleSet
+		wantErr bool
+	}{
+		{
+			name:    "should replace the rules set in the file",
+			content: `{"bypassCookies": ["wordpress_logged_in_*"], "ttlRules": [{"path": "/api/*", "ttl": "30s"}]}`,
+			want: &ruleSet{
+				BypassCookies:     []string{"wordpress_logged_in_*"},
+				CacheContentTypes: []string{"image/*"},
+				TTLRules:          []TTLRule{{Path: "/api/*", TTL: "30s"}},
+			},
+		},
+		{
+			name:    "should clear the rules set empty in the file",
+			content: `{"cacheContentTypes": []}`,
+			want:    &ruleSet{BypassCookies: []string{"sessionid"}, CacheContentTypes: []string{}},
+		},
+		{
+			name:    "should error on bans without a time",
+			content: `{"bans": [{"path": "/news/*"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "should error on invalid JSON",
+			content: `{"bypassCookies": `,
+			wantErr: true,
+		},
+		{
+			name:    "should error on invalid rules",
+			content: `{"ttlRules": [{"path": "/api/*", "ttl": "1 week"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "should error on negative ttls",
+			content: `{"ttlRules": [{"path": "/api/*", "ttl": "-30s"}]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "rules.json")
+			if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadRules(path, base)
+			if test.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("unexpected rules: want %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_RulesFile_Reload(t *testing.T) {
+	dir := createTempDir(t)
+	path := filepath.Join(dir, "rules.json")
+
+	if err := ioutil.WriteFile(path, []byte(`{"bypassCookies": ["sessionid"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := func(rw http.ResponseWriter, req *http.Request) {}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", RulesFile: path, RulesReload: "10ms"}
+
+	h, err := New(ctx, http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	if got := c.ruleSet().BypassCookies; !reflect.DeepEqual(got, []string{"sessionid"}) {
+		t.Fatalf("unexpected bypass cookies: want %q, got %q", []string{"sessionid"}, got)
+	}
+
+	// Invalid files are ignored.
+	if err = ioutil.WriteFile(path, []byte(`{"bypassCookies": ["session["]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if got := c.ruleSet().BypassCookies; !reflect.DeepEqual(got, []string{"sessionid"}) {
+		t.Fatalf("unexpected bypass cookies after an invalid change: want %q, got %q", []string{"sessionid"}, got)
+	}
+
+	want := []string{"sessionid", "wordpress_logged_in_*"}
+	if err = ioutil.WriteFile(path, []byte(`{"bypassCookies": ["sessionid", "wordpress_logged_in_*"]}`),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(c.ruleSet().BypassCookies, want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := c.ruleSet().BypassCookies; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected bypass cookies after reload: want %q, got %q", want, got)
+	}
+}
+
+func TestCache_RulesFile_Bans(t *testing.T) {
+	dir := createTempDir(t)
+	path := filepath.Join(dir, "rules.json")
+
+	// The clock starts at midnight.
+	rules := `{"bans": [{"path": "/news/*", "before": "2020-01-01T00:00:30Z"}]}`
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.Header().Set("Cache-Control", "max-age=100")
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "300", Cleanup: "-1", AddStatusHeader: true, RulesFile: path}
+	clk := newTestClock()
+
+	h, err := newWithClock(context.Background(), http.HandlerFunc(next), cfg, "simplecache", clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(urlPath string) string {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+urlPath, nil))
+
+		return rw.Header().Get("Cache-Status")
+	}
+
+	get("/news/a")
+	get("/other")
+
+	clk.Add(40 * time.Second)
+
+	tests := []struct {
+		desc  string
+		path  string
+		state string
+	}{
+		{desc: "banned entry", path: "/news/a", state: cacheMissStatus},
+		{desc: "entry stored after the ban", path: "/news/a", state: cacheHitStatus},
+		{desc: "other entry", path: "/other", state: cacheHitStatus},
+	}
+
+	for _, test := range tests {
+		if state := get(test.path); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got %q", test.desc, test.state, state)
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("unexpected origin calls: want 3, got %d", n)
+	}
+}
@@ -0,0 +1,113 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// seed stores every file under dir in the cache, as the response to the
+// request for its relative path on the seed host. Index files are also stored
+// as the response to their directory. It returns the number of files stored.
+func (m *cache) seed(ctx context.Context, dir string) (int, error) {
+	var seeded int
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if m.cfg.MaxItemBytes > 0 && info.Size() > int64(m.cfg.MaxItemBytes) {
+			log.Printf("Skipping seed file %q: %v", p, errItemTooLarge)
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		if err = m.seedFile(ctx, p, "/"+filepath.ToSlash(rel)); err != nil {
+			return err
+		}
+
+		seeded++
+
+		return nil
+	})
+	if err != nil {
+		return seeded, fmt.Errorf("error seeding the cache from %q: %w", dir, err)
+	}
+
+	return seeded, nil
+}
+
+// seedFile stores the file at p as the response to urlPath.
+func (m *cache) seedFile(ctx context.Context, p, urlPath string) error {
+	body, err := ioutil.ReadFile(filepath.Clean(p))
+	if err != nil {
+		return err
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(urlPath))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+
+	ttl := m.cfg.SeedTTL.Duration()
+	now := m.clock.Now()
+
+	data := &cacheData{
+		Status:  http.StatusOK,
+		Headers: http.Header{"Content-Type": []string{contentType}},
+		Stored:  now,
+		Expires: now.Add(ttl),
+	}
+
+	digest := sha256.New()
+	_, _ = digest.Write(body)
+	m.addValidators(data.Headers, digest, now)
+
+	retention := m.retention(ttl)
+
+	paths := []string{urlPath}
+	if path.Base(urlPath) == "index.html" {
+		paths = append(paths, strings.TrimSuffix(urlPath, "index.html"))
+	}
+
+	for _, u := range paths {
+		key := m.requestKey(keyRequest(http.MethodGet, m.cfg.SeedHost, u))
+		if err = m.store(ctx, key, data, body, retention); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// seedAtStartup seeds the cache from the seed directory, logging the outcome.
+func (m *cache) seedAtStartup(ctx context.Context) {
+	n, err := m.seed(ctx, m.cfg.SeedPath)
+	if err != nil {
+		log.Printf("Cache seeding failed after %d files: %v", n, err)
+		return
+	}
+
+	log.Printf("Cache seeding done: %d files stored", n)
+}
@@ -0,0 +1,84 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCache_Seed(t *testing.T) {
+	seedDir := createTempDir(t)
+
+	files := map[string]string{
+		"index.html":       "<html>home</html>",
+		"about/index.html": "<html>about</html>",
+		"assets/main.css":  "body {}",
+	}
+
+	for name, content := range files {
+		p := filepath.Join(seedDir, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		SeedHost: "Example.com", SeedTTL: "1h",
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := h.(*cache).seed(context.Background(), seedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(files) {
+		t.Errorf("unexpected number of seeded files: want %d, got %d", len(files), n)
+	}
+
+	tests := []struct {
+		path        string
+		body        string
+		contentType string
+	}{
+		{path: "/", body: "<html>home</html>", contentType: "text/html; charset=utf-8"},
+		{path: "/about/", body: "<html>about</html>", contentType: "text/html; charset=utf-8"},
+		{path: "/about/index.html", body: "<html>about</html>", contentType: "text/html; charset=utf-8"},
+		{path: "/assets/main.css", body: "body {}", contentType: "text/css; charset=utf-8"},
+	}
+
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com"+test.path, nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != cacheHitStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.path, cacheHitStatus, state)
+		}
+
+		if body := rw.Body.String(); body != test.body {
+			t.Errorf("%s: unexpected body: want %q, got: %q", test.path, test.body, body)
+		}
+
+		if ct := rw.Header().Get("Content-Type"); ct != test.contentType {
+			t.Errorf("%s: unexpected content type: want %q, got: %q", test.path, test.contentType, ct)
+		}
+	}
+}
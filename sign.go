@@ -0,0 +1,72 @@
+package plugin_simplecache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// errSignatureMismatch is returned for entries whose signature is invalid,
+// such as entries written by someone else than the cache.
+var errSignatureMismatch = errors.New("signature mismatch")
+
+// minSigningKeySize is the minimum size of a signing key.
+const minSigningKeySize = 32
+
+// entrySigner signs the entries with HMAC-SHA256, so that entries injected in
+// the cache path by someone without the signing key are never served. The
+// signature covers the entry key, value and header, and follows the header.
+// A nil signer signs nothing.
+type entrySigner struct {
+	key []byte
+}
+
+// newEntrySigner returns a signer using key, or nil if key is empty.
+func newEntrySigner(key string) *entrySigner {
+	if key == "" {
+		return nil
+	}
+
+	return &entrySigner{key: []byte(key)}
+}
+
+// size returns the size of the signatures.
+func (s *entrySigner) size() int64 {
+	if s == nil {
+		return 0
+	}
+
+	return sha256.Size
+}
+
+// mac returns the MAC of the entry of key, to be fed its value, or nil if s
+// is nil.
+func (s *entrySigner) mac(key string) hash.Hash {
+	if s == nil {
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+
+	// The key is length-prefixed, so that it cannot run into the value.
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(key)))
+	_, _ = mac.Write(n[:])
+	_, _ = mac.Write([]byte(key))
+
+	return mac
+}
+
+// sum returns the signature of the entry whose value was fed to mac, once its
+// header h is complete.
+func (s *entrySigner) sum(mac hash.Hash, h *entryHeader) []byte {
+	if s == nil {
+		return nil
+	}
+
+	_, _ = mac.Write(h.encode())
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,106 @@
+package plugin_simplecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+const testSigningKey = "0123456789abcdef0123456789abcdef"
+
+func newSignedFileCache(t *testing.T, dir, key string) *fileCache {
+	t.Helper()
+
+	fc, err := newFileCache(context.Background(), dir, 0, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	fc.signer = newEntrySigner(key)
+
+	return fc
+}
+
+func TestFileCache_Signed(t *testing.T) {
+	dir := createTempDir(t)
+	fc := newSignedFileCache(t, dir, testSigningKey)
+
+	want := []byte("some signed content")
+
+	if err := fc.SetParts(context.Background(), "parts", [][]byte{want[:4], want[4:]}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fc.SetFrom(context.Background(), "stream", bytes.NewReader(want), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"parts", "stream"} {
+		got, err := fc.Get(context.Background(), key)
+		if err != nil {
+			t.Fatalf("%s: unexpected cache get error: %v", key, err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: unexpected cache content: want %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestFileCache_Signed_Forged(t *testing.T) {
+	dir := createTempDir(t)
+	fc := newSignedFileCache(t, dir, testSigningKey)
+
+	forgers := []struct {
+		desc string
+		fc   *fileCache
+	}{
+		{desc: "unsigned", fc: newSignedFileCache(t, dir, "")},
+		{desc: "other key", fc: newSignedFileCache(t, dir, "fedcba9876543210fedcba9876543210")},
+	}
+
+	for _, forger := range forgers {
+		if err := forger.fc.Set(context.Background(), testCacheKey, []byte("forged"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fc.Get(context.Background(), testCacheKey); !errors.Is(err, errCacheMiss) {
+			t.Errorf("%s: unexpected error: want %v, got %v", forger.desc, errCacheMiss, err)
+		}
+	}
+}
+
+func TestFileCache_Signed_Moved(t *testing.T) {
+	dir := createTempDir(t)
+	fc := newSignedFileCache(t, dir, testSigningKey)
+
+	if err := fc.Set(context.Background(), "GETlocalhost/public", []byte("public"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fc.Set(context.Background(), "GETlocalhost/private", []byte("private"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// A valid entry copied to the path of another key is not served.
+	b, err := ioutil.ReadFile(keyPath(dir, "GETlocalhost/private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(keyPath(dir, "GETlocalhost/public"), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fc.Get(context.Background(), "GETlocalhost/public"); !errors.Is(err, errCacheMiss) {
+		t.Errorf("unexpected error: want %v, got %v", errCacheMiss, err)
+	}
+
+	if _, err = os.Stat(keyPath(dir, "GETlocalhost/public")); !os.IsNotExist(err) {
+		t.Errorf("unexpected forged entry left: %v", err)
+	}
+}
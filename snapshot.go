@@ -0,0 +1,278 @@
+package plugin_simplecache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errInvalidSnapshot is returned for snapshots which are not gzipped tar
+// archives of cache entries.
+var errInvalidSnapshot = errors.New("invalid snapshot")
+
+// snapshotStats are the statistics of an import.
+type snapshotStats struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// Export writes a snapshot of the cache to w: a gzipped tar archive of the
+// entry files, as laid out under the cache paths out of any expiry bucket.
+// Entries are exported as stored, signatures included, and expired ones are
+// left out. It returns the number of entries exported.
+func (s *volumeSet) Export(ctx context.Context, w io.Writer) (int, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	var n int
+
+	for _, v := range s.volumes {
+		exported, err := v.export(ctx, tw)
+		n += exported
+
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return n, err
+	}
+
+	return n, gz.Close()
+}
+
+// export adds the entries of the cache to tw, and returns their number.
+func (c *fileCache) export(ctx context.Context, tw *tar.Writer) (int, error) {
+	var n int
+
+	err := filepath.Walk(c.path, func(p string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			// The entry was deleted meanwhile.
+			return nil
+		case err != nil:
+			return err
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case info.IsDir(), filepath.Dir(p) == filepath.Clean(c.path):
+			// Files at the root are temporary files and the format file.
+			return nil
+		}
+
+		ok, err := c.exportFile(tw, p)
+		if ok {
+			n++
+		}
+
+		return err
+	})
+
+	return n, err
+}
+
+// exportFile adds the entry held by the file p to tw, unless it has expired,
+// is of another format version or has been deleted. Entries are named by
+// their path out of any expiry bucket, so that snapshots can be imported
+// whatever the layout. Entries are replaced atomically, so the file is read
+// without locking it.
+func (c *fileCache) exportFile(tw *tar.Writer, p string) (bool, error) {
+	f, err := os.Open(filepath.Clean(p))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	var t [headerSize]byte
+	if _, err = io.ReadFull(f, t[:]); err != nil {
+		return false, nil
+	}
+
+	if h := decodeHeader(t[:]); !h.current() || time.Unix(h.expires, 0).Before(c.clock.Now()) {
+		return false, nil
+	}
+
+	rel, err := filepath.Rel(c.path, c.entryPath(p))
+	if err != nil {
+		return false, err
+	}
+
+	hdr := &tar.Header{
+		Name:    filepath.ToSlash(rel),
+		Mode:    0600,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return false, err
+	}
+
+	if _, err = tw.Write(t[:]); err != nil {
+		return false, err
+	}
+
+	if _, err = io.CopyN(tw, f, info.Size()-headerSize); err != nil {
+		return false, fmt.Errorf("error exporting %q: %w", rel, err)
+	}
+
+	return true, nil
+}
+
+// Import restores the entries of a snapshot written by Export, replacing the
+// entries of the same keys. Snapshots do not depend on the number of paths:
+// the path of every entry is picked from its name. Expired, truncated and
+// misplaced entries are skipped. Entries are not verified beyond their size,
+// as their keys are not known: corrupted entries, and entries signed with
+// another key, are discarded when they are read.
+func (s *volumeSet) Import(ctx context.Context, r io.Reader) (snapshotStats, error) {
+	var stats snapshotStats
+
+	if s.volumes[0].readOnly {
+		return stats, errReadOnly
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return stats, fmt.Errorf("%w: %v", errInvalidSnapshot, err)
+	}
+
+	tr := tar.NewReader(gz)
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, fmt.Errorf("%w: %v", errInvalidSnapshot, err)
+		}
+
+		// Archives made with tar from the cache path name entries from "./".
+		name := strings.TrimPrefix(hdr.Name, "./")
+
+		switch {
+		case hdr.Typeflag == tar.TypeDir:
+			continue
+		case hdr.Typeflag != tar.TypeReg || !snapshotName(name):
+			stats.Skipped++
+			continue
+		}
+
+		c := s.volumeOf(name)
+
+		ok, err := c.importFile(filepath.Join(c.path, filepath.FromSlash(name)), hdr.Size, tr)
+		if err != nil {
+			return stats, err
+		}
+
+		if ok {
+			stats.Imported++
+		} else {
+			stats.Skipped++
+		}
+	}
+}
+
+// importFile writes the entry of size bytes read from r to a temporary file,
+// which then atomically replaces the file of the entry at p, unless the entry
+// has expired, is of another format version or its size does not match its
+// header.
+func (c *fileCache) importFile(p string, size int64, r io.Reader) (ok bool, err error) {
+	var t [headerSize]byte
+	if size < headerSize+c.signer.size() {
+		return false, nil
+	}
+
+	if _, err = io.ReadFull(r, t[:]); err != nil {
+		return false, fmt.Errorf("%w: %v", errInvalidSnapshot, err)
+	}
+
+	h := decodeHeader(t[:])
+	if !h.current() || size-headerSize-c.signer.size() != h.length || time.Unix(h.expires, 0).Before(c.clock.Now()) {
+		return false, nil
+	}
+
+	f, err := ioutil.TempFile(c.path, ".write-*")
+	if err != nil {
+		return false, fmt.Errorf("error creating file: %w", err)
+	}
+
+	defer func() {
+		_ = f.Close()
+
+		if !ok {
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(t[:]); err != nil {
+		return false, fmt.Errorf("error writing file: %w", err)
+	}
+
+	if _, err = io.CopyN(f, r, size-headerSize); err != nil {
+		return false, fmt.Errorf("error writing file: %w", err)
+	}
+
+	if err = f.Close(); err != nil {
+		return false, fmt.Errorf("error writing file: %w", err)
+	}
+
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err = c.place(p, f.Name(), h.expires); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// snapshotName reports whether name is the path of an entry file relative to
+// the cache path: four shard directories named after the bytes of the key
+// hash, then the file name.
+func snapshotName(name string) bool {
+	if path.Clean(name) != name {
+		return false
+	}
+
+	parts := strings.Split(name, "/")
+	if len(parts) != len(keyHash(""))+1 {
+		return false
+	}
+
+	for _, dir := range parts[:len(parts)-1] {
+		if !isShard(dir) {
+			return false
+		}
+	}
+
+	file := parts[len(parts)-1]
+
+	return file != "" && file != "." && file != ".." && !strings.ContainsAny(file, reservedNameChars+"\\")
+}
@@ -0,0 +1,193 @@
+package plugin_simplecache
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSnapshotName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "0a/1b/2c/3d/GETlocalhost-a", want: true},
+		{name: "0a/1b/2c/3d/sha256-00", want: true},
+		{name: "0a/1b/2c/GETlocalhost-a"},
+		{name: "0a/1b/2c/3d/4e/GETlocalhost-a"},
+		{name: "0A/1b/2c/3d/GETlocalhost-a"},
+		{name: "0a/1b/2c/zz/GETlocalhost-a"},
+		{name: "/0a/1b/2c/GETlocalhost-a"},
+		{name: "0a/1b/../3d/GETlocalhost-a"},
+		{name: "0a/1b/2c/3d/.."},
+		{name: "0a/1b/2c/3d/"},
+		{name: ".write-1234"},
+	}
+
+	for _, test := range tests {
+		if got := snapshotName(test.name); got != test.want {
+			t.Errorf("%q: want %t, got %t", test.name, test.want, got)
+		}
+	}
+}
+
+func TestCache_ServeAdmin_Snapshot(t *testing.T) {
+	var requests int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("body of " + req.URL.Path))
+	}
+
+	newCache := func() http.Handler {
+		cfg := &Config{
+			Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+			SigningKey: "0123456789abcdef0123456789abcdef",
+			Admin:      AdminConfig{Path: "/_cache", Tokens: []string{"secret"}},
+		}
+
+		h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return h
+	}
+
+	src := newCache()
+	for _, p := range []string{"/a", "/b"} {
+		src.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+	}
+
+	// An expired entry is left out of the snapshot.
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/expired", nil)
+	if err := src.(*cache).cache.Set(context.Background(), cacheKey(req), []byte("expired"), -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/_cache/export", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rw := httptest.NewRecorder()
+	src.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected export status: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	if ct := rw.Header().Get("Content-Type"); ct != "application/gzip" {
+		t.Errorf("unexpected export content type: want %q, got: %q", "application/gzip", ct)
+	}
+
+	dst := newCache()
+
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/_cache/import", bytes.NewReader(rw.Body.Bytes()))
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rw = httptest.NewRecorder()
+	dst.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected import status: want %d, got %d: %s", http.StatusOK, rw.Code, rw.Body.String())
+	}
+
+	var stats snapshotStats
+	if err := json.Unmarshal(rw.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Imported != 2 || stats.Skipped != 0 {
+		t.Errorf("unexpected import stats: want 2 imported, got %+v", stats)
+	}
+
+	requests = 0
+
+	for _, p := range []string{"/a", "/b"} {
+		rw = httptest.NewRecorder()
+		dst.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost"+p, nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != cacheHitStatus {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", p, cacheHitStatus, state)
+		}
+
+		if body := rw.Body.String(); body != "body of "+p {
+			t.Errorf("%s: unexpected body: want %q, got: %q", p, "body of "+p, body)
+		}
+	}
+
+	if requests != 0 {
+		t.Errorf("unexpected origin requests: want 0, got %d", requests)
+	}
+}
+
+func TestCache_ServeAdmin_ImportInvalid(t *testing.T) {
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20",
+		Admin: AdminConfig{Path: "/_cache", Tokens: []string{"secret"}},
+	}
+
+	h, err := New(context.Background(), http.NotFoundHandler(), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var traversal bytes.Buffer
+
+	gz := gzip.NewWriter(&traversal)
+	tw := tar.NewWriter(gz)
+	body := make([]byte, headerSize)
+
+	if err = tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0700}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tw.WriteHeader(&tar.Header{Name: "../../escaped", Mode: 0600, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = tw.Write(body)
+	_ = tw.Close()
+	_ = gz.Close()
+
+	tests := []struct {
+		desc   string
+		body   []byte
+		status int
+		want   snapshotStats
+	}{
+		{desc: "not gzipped", body: []byte("nope"), status: http.StatusBadRequest},
+		{desc: "path traversal", body: traversal.Bytes(), status: http.StatusOK, want: snapshotStats{Skipped: 1}},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/_cache/import", bytes.NewReader(test.body))
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s: unexpected status: want %d, got %d", test.desc, test.status, rw.Code)
+			continue
+		}
+
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		var stats snapshotStats
+		if err = json.Unmarshal(rw.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+
+		if stats != test.want {
+			t.Errorf("%s: unexpected stats: want %+v, got %+v", test.desc, test.want, stats)
+		}
+	}
+}
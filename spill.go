@@ -0,0 +1,99 @@
+package plugin_simplecache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spillBuffer buffers up to limit bytes in memory, and transparently spills
+// to a temporary file in dir beyond that.
+type spillBuffer struct {
+	dir   string
+	limit int
+	mem   []byte
+	file  *os.File
+	size  int64
+}
+
+func newSpillBuffer(dir string, limit int) *spillBuffer {
+	return &spillBuffer{dir: dir, limit: limit}
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && len(b.mem)+len(p) > b.limit {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.file == nil {
+		b.mem = append(b.mem, p...)
+		b.size += int64(len(p))
+
+		return len(p), nil
+	}
+
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+
+	return n, err
+}
+
+func (b *spillBuffer) spill() error {
+	f, err := ioutil.TempFile(b.dir, ".spill-")
+	if err != nil {
+		return fmt.Errorf("error creating spill file: %w", err)
+	}
+
+	b.file = f
+
+	if _, err = f.Write(b.mem); err != nil {
+		return fmt.Errorf("error writing spill file: %w", err)
+	}
+
+	b.mem = nil
+
+	return nil
+}
+
+// Len returns the number of buffered bytes.
+func (b *spillBuffer) Len() int64 {
+	return b.size
+}
+
+// Bytes returns the buffered bytes if they were not spilled to disk.
+func (b *spillBuffer) Bytes() ([]byte, bool) {
+	return b.mem, b.file == nil
+}
+
+// Reader returns a reader over the buffered bytes.
+func (b *spillBuffer) Reader() (io.Reader, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.mem), nil
+	}
+
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("error reading spill file: %w", err)
+	}
+
+	return b.file, nil
+}
+
+// Close releases the buffer, deleting its spill file if any.
+func (b *spillBuffer) Close() error {
+	b.mem = nil
+
+	if b.file == nil {
+		return nil
+	}
+
+	f := b.file
+	b.file = nil
+
+	_ = f.Close()
+
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,55 @@
+package plugin_simplecache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	dir := createTempDir(t)
+
+	b := newSpillBuffer(dir, 8)
+
+	for _, p := range []string{"0123", "4567", "89"} {
+		if _, err := b.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := b.Bytes(); ok {
+		t.Error("expected buffer to be spilled to disk")
+	}
+
+	if b.Len() != 10 {
+		t.Errorf("unexpected buffer length: want 10, got %d", b.Len())
+	}
+
+	r, err := b.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "0123456789" {
+		t.Errorf("unexpected buffer content: %q", got)
+	}
+
+	name := b.file.Name()
+
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected spill file to be deleted, got: %v", err)
+	}
+
+	if err = b.Close(); err != nil {
+		t.Errorf("unexpected error closing buffer twice: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// store is the interface of the entry storages: the file cache of a single
+// path, and the set of file caches spanning several paths. Storages must pass
+// the conformance suite of the storetest package, so that they can be swapped
+// for one another. Entries are opaque values, which expire expiry after they
+// are set, against the clock of the storage.
+type store interface {
+	// Get returns the value of key, or errCacheMiss if there is none or it
+	// expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Open returns a reader streaming the value of key, verified as it is
+	// read, or errCacheMiss if there is none or it expired.
+	Open(ctx context.Context, key string) (*fileEntry, error)
+	// Set stores val under key, replacing any previous value. Values set
+	// with a negative expiry are never returned.
+	Set(ctx context.Context, key string, val []byte, expiry time.Duration) error
+	// SetParts stores the concatenation of parts.
+	SetParts(ctx context.Context, key string, parts [][]byte, expiry time.Duration) error
+	// SetFrom stores the value read from r, leaving any previous value in
+	// place if it fails.
+	SetFrom(ctx context.Context, key string, r io.Reader, expiry time.Duration) error
+	// Delete deletes the value of key, if any.
+	Delete(key string) error
+	// Flush deletes every value.
+	Flush() (vacuumStats, error)
+}
+
+var (
+	_ store = (*fileCache)(nil)
+	_ store = (*volumeSet)(nil)
+)
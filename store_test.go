@@ -0,0 +1,110 @@
+package plugin_simplecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/traefik/plugin-simplecache/storetest"
+)
+
+// storeFactory returns an empty store telling the time from clk.
+type storeFactory func(t *testing.T, clk clock) store
+
+// testStore runs the conformance suite of storetest against the stores
+// returned by newStore.
+func testStore(t *testing.T, newStore storeFactory) {
+	t.Helper()
+
+	storetest.Run(t, func(t *testing.T, clk *storetest.Clock) storetest.Store {
+		t.Helper()
+
+		return storeAdapter{s: newStore(t, clk)}
+	}, errCacheMiss)
+}
+
+// storeAdapter exposes a store through the interface of the conformance
+// suite.
+type storeAdapter struct {
+	s store
+}
+
+func (a storeAdapter) Get(ctx context.Context, key string) ([]byte, error) {
+	return a.s.Get(ctx, key)
+}
+
+func (a storeAdapter) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	e, err := a.s.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (a storeAdapter) Set(ctx context.Context, key string, val []byte, expiry time.Duration) error {
+	return a.s.Set(ctx, key, val, expiry)
+}
+
+func (a storeAdapter) SetParts(ctx context.Context, key string, parts [][]byte, expiry time.Duration) error {
+	return a.s.SetParts(ctx, key, parts, expiry)
+}
+
+func (a storeAdapter) SetFrom(ctx context.Context, key string, r io.Reader, expiry time.Duration) error {
+	return a.s.SetFrom(ctx, key, r, expiry)
+}
+
+func (a storeAdapter) Delete(key string) error {
+	return a.s.Delete(key)
+}
+
+func (a storeAdapter) Flush() (int, error) {
+	stats, err := a.s.Flush()
+	return stats.Deleted, err
+}
+
+func TestFileCache_Store(t *testing.T) {
+	testStore(t, func(t *testing.T, clk clock) store {
+		t.Helper()
+
+		fc, err := newFileCache(context.Background(), createTempDir(t), 0, 1, nil, clk)
+		if err != nil {
+			t.Fatalf("unexpected newFileCache error: %v", err)
+		}
+
+		return fc
+	})
+}
+
+func TestVolumeSet_Store(t *testing.T) {
+	testStore(t, func(t *testing.T, clk clock) store {
+		t.Helper()
+
+		s, err := newVolumeSet(context.Background(), []string{createTempDir(t), createTempDir(t)}, 0, 1, nil, clk)
+		if err != nil {
+			t.Fatalf("unexpected newVolumeSet error: %v", err)
+		}
+
+		return s
+	})
+}
+
+// wantValue checks that the value of key is want, or that there is none if
+// want is nil.
+func wantValue(t *testing.T, s store, key string, want []byte) {
+	t.Helper()
+
+	got, err := s.Get(context.Background(), key)
+
+	switch {
+	case want == nil && !errors.Is(err, errCacheMiss):
+		t.Errorf("%s: unexpected Get result: want %v, got %q and %v", key, errCacheMiss, got, err)
+	case want != nil && err != nil:
+		t.Errorf("%s: unexpected Get error: %v", key, err)
+	case want != nil && !bytes.Equal(got, want):
+		t.Errorf("%s: unexpected value: want %q, got %q", key, want, got)
+	}
+}
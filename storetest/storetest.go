@@ -0,0 +1,466 @@
+// Package storetest provides the conformance suite of the entry storages of
+// the cache. Every storage must pass it, so that storages can be swapped for
+// one another: a new storage is covered by a test calling Run with a function
+// returning an empty instance.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKey is the key used by the scenarios handling a single entry.
+const testKey = "GETlocalhost:8080/test/path"
+
+// Store is the interface of the storages under test. Entries are opaque
+// values, which expire expiry after they are set, against the clock of the
+// storage.
+type Store interface {
+	// Get returns the value of key, or the miss error given to Run if there
+	// is none or it expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Open returns a reader streaming the value of key, or the miss error
+	// given to Run if there is none or it expired.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Set stores val under key, replacing any previous value. Values set
+	// with a negative expiry are never returned.
+	Set(ctx context.Context, key string, val []byte, expiry time.Duration) error
+	// SetParts stores the concatenation of parts.
+	SetParts(ctx context.Context, key string, parts [][]byte, expiry time.Duration) error
+	// SetFrom stores the value read from r, leaving any previous value in
+	// place if it fails.
+	SetFrom(ctx context.Context, key string, r io.Reader, expiry time.Duration) error
+	// Delete deletes the value of key, if any.
+	Delete(key string) error
+	// Flush deletes every value, and returns the number of values deleted.
+	Flush() (int, error)
+}
+
+// Factory returns an empty store telling the time from clk.
+type Factory func(t *testing.T, clk *Clock) Store
+
+// Clock is a clock which only moves when told to.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a clock set at the start of 2020.
+func NewClock() *Clock {
+	return &Clock{now: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Add moves the clock forward by d.
+func (c *Clock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// suite runs the scenarios against a store.
+type suite struct {
+	s       Store
+	clk     *Clock
+	errMiss error
+}
+
+// scenarios are the behaviors every store must have.
+var scenarios = []struct {
+	name string
+	run  func(t *testing.T, s *suite)
+}{
+	{name: "miss", run: testMiss},
+	{name: "set and get", run: testSetGet},
+	{name: "replace", run: testReplace},
+	{name: "keys", run: testKeys},
+	{name: "expiry", run: testExpiry},
+	{name: "set parts", run: testSetParts},
+	{name: "set from", run: testSetFrom},
+	{name: "set from failing", run: testSetFromFailing},
+	{name: "open", run: testOpen},
+	{name: "open replaced", run: testOpenReplaced},
+	{name: "delete", run: testDelete},
+	{name: "flush", run: testFlush},
+	{name: "concurrent writes", run: testConcurrency},
+}
+
+// Run runs the conformance scenarios against the stores returned by newStore,
+// one per scenario. Misses are reported by errors matching errMiss.
+func Run(t *testing.T, newStore Factory, errMiss error) {
+	t.Helper()
+
+	for _, scenario := range scenarios {
+		scenario := scenario
+
+		t.Run(scenario.name, func(t *testing.T) {
+			clk := NewClock()
+			scenario.run(t, &suite{s: newStore(t, clk), clk: clk, errMiss: errMiss})
+		})
+	}
+}
+
+// wantValue checks that both Get and Open return want as the value of key, or
+// a miss if want is nil.
+func (s *suite) wantValue(t *testing.T, key string, want []byte) {
+	t.Helper()
+
+	got, err := s.s.Get(context.Background(), key)
+	s.check(t, "Get", key, want, got, err)
+
+	r, err := s.s.Open(context.Background(), key)
+	if err == nil {
+		got, err = ioutil.ReadAll(r)
+		_ = r.Close()
+	}
+
+	s.check(t, "Open", key, want, got, err)
+}
+
+func (s *suite) check(t *testing.T, method, key string, want, got []byte, err error) {
+	t.Helper()
+
+	switch {
+	case want == nil && !errors.Is(err, s.errMiss):
+		t.Errorf("%s: unexpected %s result: want %v, got %q and %v", key, method, s.errMiss, got, err)
+	case want != nil && err != nil:
+		t.Errorf("%s: unexpected %s error: %v", key, method, err)
+	case want != nil && !bytes.Equal(got, want):
+		t.Errorf("%s: unexpected %s value: want %q, got %q", key, method, want, got)
+	}
+}
+
+func testMiss(t *testing.T, s *suite) {
+	s.wantValue(t, testKey, nil)
+}
+
+func testSetGet(t *testing.T, s *suite) {
+	if err := s.s.Set(context.Background(), testKey, []byte("some value"), time.Minute); err != nil {
+		t.Fatalf("unexpected Set error: %v", err)
+	}
+
+	s.wantValue(t, testKey, []byte("some value"))
+
+	// Empty values are values.
+	if err := s.s.Set(context.Background(), "empty", []byte{}, time.Minute); err != nil {
+		t.Fatalf("unexpected Set error: %v", err)
+	}
+
+	s.wantValue(t, "empty", []byte{})
+}
+
+func testReplace(t *testing.T, s *suite) {
+	for _, val := range []string{"a longer first value", "second"} {
+		if err := s.s.Set(context.Background(), testKey, []byte(val), time.Minute); err != nil {
+			t.Fatalf("unexpected Set error: %v", err)
+		}
+	}
+
+	s.wantValue(t, testKey, []byte("second"))
+}
+
+func testKeys(t *testing.T, s *suite) {
+	keys := []string{
+		testKey,
+		testKey + "?query=value&other=1",
+		"GETlocalhost/path with spaces/ünicode",
+		"GETlocalhost/" + strings.Repeat("long/", 100),
+		"HEADlocalhost:8080/test/path",
+	}
+
+	for _, key := range keys {
+		if err := s.s.Set(context.Background(), key, []byte("value of "+key), time.Minute); err != nil {
+			t.Fatalf("%s: unexpected Set error: %v", key, err)
+		}
+	}
+
+	// Keys are distinct, however close.
+	for _, key := range keys {
+		s.wantValue(t, key, []byte("value of "+key))
+	}
+}
+
+func testExpiry(t *testing.T, s *suite) {
+	if err := s.s.Set(context.Background(), testKey, []byte("some value"), 10*time.Second); err != nil {
+		t.Fatalf("unexpected Set error: %v", err)
+	}
+
+	if err := s.s.Set(context.Background(), "expired", []byte("some value"), -time.Second); err != nil {
+		t.Fatalf("unexpected Set error: %v", err)
+	}
+
+	s.wantValue(t, "expired", nil)
+
+	s.clk.Add(10 * time.Second)
+	s.wantValue(t, testKey, []byte("some value"))
+
+	s.clk.Add(time.Second)
+	s.wantValue(t, testKey, nil)
+
+	// Expired values can be set again.
+	if err := s.s.Set(context.Background(), testKey, []byte("new value"), time.Minute); err != nil {
+		t.Fatalf("unexpected Set error: %v", err)
+	}
+
+	s.wantValue(t, testKey, []byte("new value"))
+}
+
+func testSetParts(t *testing.T, s *suite) {
+	parts := [][]byte{[]byte("metadata"), {}, []byte("body")}
+
+	if err := s.s.SetParts(context.Background(), testKey, parts, time.Minute); err != nil {
+		t.Fatalf("unexpected SetParts error: %v", err)
+	}
+
+	s.wantValue(t, testKey, []byte("metadatabody"))
+}
+
+func testSetFrom(t *testing.T, s *suite) {
+	val := bytes.Repeat([]byte("0123456789"), 100000)
+
+	if err := s.s.SetFrom(context.Background(), testKey, bytes.NewReader(val), time.Minute); err != nil {
+		t.Fatalf("unexpected SetFrom error: %v", err)
+	}
+
+	s.wantValue(t, testKey, val)
+}
+
+func testSetFromFailing(t *testing.T, s *suite) {
+	if err := s.s.Set(context.Background(), testKey, []byte("previous value"), time.Minute); err != nil {
+		t.Fatalf("unexpected Set error: %v", err)
+	}
+
+	errRead := errors.New("read error")
+	r := io.MultiReader(strings.NewReader("partial value"), &failingReader{err: errRead})
+
+	if err := s.s.SetFrom(context.Background(), testKey, r, time.Minute); !errors.Is(err, errRead) {
+		t.Errorf("unexpected SetFrom error: want %v, got %v", errRead, err)
+	}
+
+	s.wantValue(t, testKey, []byte("previous value"))
+
+	// Values read from a reader aborted with its context are not stored
+	// either.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := s.s.SetFrom(ctx, "aborted", strings.NewReader("some value"), time.Minute); err == nil {
+		t.Error("unexpected SetFrom success with a cancelled context")
+	}
+
+	s.wantValue(t, "aborted", nil)
+}
+
+// failingReader fails every read with err.
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func testOpen(t *testing.T, s *suite) {
+	val := bytes.Repeat([]byte("0123456789"), 100000)
+
+	if err := s.s.Set(context.Background(), testKey, val, time.Minute); err != nil {
+		t.Fatalf("unexpected Set error: %v", err)
+	}
+
+	r, err := s.s.Open(context.Background(), testKey)
+	if err != nil {
+		t.Fatalf("unexpected Open error: %v", err)
+	}
+
+	defer func() { _ = r.Close() }()
+
+	// Values are streamed in pieces of any size.
+	var got bytes.Buffer
+
+	buf := make([]byte, 4093)
+
+	for {
+		n, err := r.Read(buf)
+		got.Write(buf[:n])
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected Read error: %v", err)
+		}
+	}
+
+	if !bytes.Equal(got.Bytes(), val) {
+		t.Errorf("unexpected streamed value of %d bytes, want %d", got.Len(), len(val))
+	}
+}
+
+func testOpenReplaced(t *testing.T, s *suite) {
+	if err := s.s.Set(context.Background(), testKey, []byte("first value"), time.Minute); err != nil {
+		t.Fatalf("unexpected Set error: %v", err)
+	}
+
+	r, err := s.s.Open(context.Background(), testKey)
+	if err != nil {
+		t.Fatalf("unexpected Open error: %v", err)
+	}
+
+	defer func() { _ = r.Close() }()
+
+	if err = s.s.Set(context.Background(), testKey, []byte("second value"), time.Minute); err != nil {
+		t.Fatalf("unexpected Set error: %v", err)
+	}
+
+	if err = s.s.Delete(testKey); err != nil {
+		t.Fatalf("unexpected Delete error: %v", err)
+	}
+
+	// An opened value is read whole, whatever happens to its entry meanwhile.
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected Read error: %v", err)
+	}
+
+	if string(got) != "first value" {
+		t.Errorf("unexpected value of the opened entry: want %q, got %q", "first value", got)
+	}
+}
+
+func testDelete(t *testing.T, s *suite) {
+	for _, key := range []string{testKey, "kept"} {
+		if err := s.s.Set(context.Background(), key, []byte("some value"), time.Minute); err != nil {
+			t.Fatalf("unexpected Set error: %v", err)
+		}
+	}
+
+	if err := s.s.Delete(testKey); err != nil {
+		t.Fatalf("unexpected Delete error: %v", err)
+	}
+
+	s.wantValue(t, testKey, nil)
+	s.wantValue(t, "kept", []byte("some value"))
+
+	// Deleting a missing value is not an error.
+	if err := s.s.Delete(testKey); err != nil {
+		t.Errorf("unexpected Delete error for a missing value: %v", err)
+	}
+}
+
+func testFlush(t *testing.T, s *suite) {
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("%s%d", testKey, i)
+		if err := s.s.Set(context.Background(), key, []byte("some value"), time.Minute); err != nil {
+			t.Fatalf("unexpected Set error: %v", err)
+		}
+	}
+
+	deleted, err := s.s.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush error: %v", err)
+	}
+
+	if deleted != 10 {
+		t.Errorf("unexpected flushed values: want 10, got %d", deleted)
+	}
+
+	for i := 0; i < 10; i++ {
+		s.wantValue(t, fmt.Sprintf("%s%d", testKey, i), nil)
+	}
+
+	// The store is usable once flushed.
+	if err = s.s.Set(context.Background(), testKey, []byte("some value"), time.Minute); err != nil {
+		t.Fatalf("unexpected Set error after Flush: %v", err)
+	}
+
+	s.wantValue(t, testKey, []byte("some value"))
+}
+
+func testConcurrency(t *testing.T, s *suite) {
+	values := [][]byte{
+		bytes.Repeat([]byte("a"), 10000),
+		bytes.Repeat([]byte("b"), 20000),
+		bytes.Repeat([]byte("c"), 5000),
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				val := values[(i+j)%len(values)]
+				if err := s.s.Set(context.Background(), testKey, val, time.Minute); err != nil {
+					t.Errorf("unexpected Set error: %v", err)
+					return
+				}
+
+				// Readers see a whole value, never a mix of several.
+				if err := readWhole(s.s, values); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// readWhole checks that both Get and Open return one of values.
+func readWhole(s Store, values [][]byte) error {
+	got, err := s.Get(context.Background(), testKey)
+	if err != nil {
+		return fmt.Errorf("unexpected Get error: %w", err)
+	}
+
+	if !isOneOf(got, values) {
+		return fmt.Errorf("unexpected torn value of %d bytes from Get", len(got))
+	}
+
+	r, err := s.Open(context.Background(), testKey)
+	if err != nil {
+		return fmt.Errorf("unexpected Open error: %w", err)
+	}
+
+	defer func() { _ = r.Close() }()
+
+	if got, err = ioutil.ReadAll(r); err != nil {
+		return fmt.Errorf("unexpected Read error: %w", err)
+	}
+
+	if !isOneOf(got, values) {
+		return fmt.Errorf("unexpected torn value of %d bytes from Open", len(got))
+	}
+
+	return nil
+}
+
+func isOneOf(b []byte, values [][]byte) bool {
+	for _, val := range values {
+		if bytes.Equal(b, val) {
+			return true
+		}
+	}
+
+	return false
+}
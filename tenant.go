@@ -0,0 +1,158 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tenantKeyPrefix starts the keys of the entries of a tenant, and the names of
+// the directories holding them.
+const tenantKeyPrefix = "tenant-"
+
+// partitioned reports whether the cache is partitioned by tenant.
+func (m *cache) partitioned() bool {
+	return m.cfg.TenantHeader != "" || m.cfg.TenantClientCert
+}
+
+// tenant returns the tenant r belongs to: the common name of its TLS client
+// certificate, or the value of the tenant header. It returns an empty string
+// if r does not identify its tenant, or names a tenant which is not
+// configured.
+func (m *cache) tenant(r *http.Request) string {
+	var tenant string
+
+	switch {
+	case m.cfg.TenantClientCert:
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			tenant = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+	default:
+		tenant = r.Header.Get(m.cfg.TenantHeader)
+	}
+
+	if _, ok := m.tenants[tenantID(tenant)]; !ok {
+		return ""
+	}
+
+	return tenant
+}
+
+// requestKey returns the key of the entry for r, within the partition of its
+// tenant if the cache is partitioned.
+func (m *cache) requestKey(r *http.Request) string {
+	key := cacheKey(r)
+	if !m.partitioned() {
+		return key
+	}
+
+	return tenantKey(m.tenant(r), key)
+}
+
+// tenantID returns the hash of tenant. The hash has a fixed length, so no
+// tenant name, however chosen, can produce the key or the directory of
+// another tenant.
+func tenantID(tenant string) string {
+	sum := sha256.Sum256([]byte(tenant))
+	return hex.EncodeToString(sum[:])
+}
+
+// tenantKey prefixes key with the hash of tenant.
+func tenantKey(tenant, key string) string {
+	return tenantKeyPrefix + tenantID(tenant) + "-" + key
+}
+
+// tenantDir returns the name of the directory holding the entries of tenant,
+// under every cache path.
+func tenantDir(tenant string) string {
+	return tenantKeyPrefix + tenantID(tenant)
+}
+
+// newTenantStores returns the storage of every configured tenant, by tenant
+// hash. Each tenant has a directory of its own under every cache path, so that
+// its entries can be flushed, exported and vacuumed on their own.
+func newTenantStores(ctx context.Context, cfg *Config, paths []string, vacuum time.Duration,
+	clk clock) (map[string]*volumeSet, error) {
+	stores := make(map[string]*volumeSet, len(cfg.Tenants))
+
+	for _, tenant := range cfg.Tenants {
+		dirs := make([]string, 0, len(paths))
+
+		for _, p := range paths {
+			dir := filepath.Join(p, tenantDir(tenant))
+			if !cfg.ReadOnly {
+				if err := os.MkdirAll(dir, 0o700); err != nil {
+					return nil, fmt.Errorf("error creating the directory of tenant %q: %w", tenant, err)
+				}
+			}
+
+			dirs = append(dirs, dir)
+		}
+
+		s, err := openVolumes(ctx, cfg, dirs, vacuum, clk)
+		if err != nil {
+			return nil, fmt.Errorf("error opening the storage of tenant %q: %w", tenant, err)
+		}
+
+		stores[tenantID(tenant)] = s
+	}
+
+	return stores, nil
+}
+
+// storeFor returns the storage of the entry of key: the one of its tenant for
+// the keys of a tenant. It returns nil for the keys of an unknown tenant.
+func (m *cache) storeFor(key string) *volumeSet {
+	if !strings.HasPrefix(key, tenantKeyPrefix) {
+		return m.cache
+	}
+
+	id := key[len(tenantKeyPrefix):]
+	if len(id) < 2*sha256.Size {
+		return nil
+	}
+
+	return m.tenants[id[:2*sha256.Size]]
+}
+
+// tenantStore returns the storage of the tenant named by the tenant query
+// parameter of r, or the shared storage if the cache is not partitioned. It
+// writes an error and returns nil if the tenant is missing or unknown.
+func (m *cache) tenantStore(w http.ResponseWriter, r *http.Request) *volumeSet {
+	if !m.partitioned() {
+		return m.cache
+	}
+
+	tenant := r.URL.Query().Get("tenant")
+	if tenant == "" {
+		http.Error(w, "missing tenant parameter", http.StatusBadRequest)
+		return nil
+	}
+
+	s, ok := m.tenants[tenantID(tenant)]
+	if !ok {
+		http.Error(w, "unknown tenant", http.StatusBadRequest)
+		return nil
+	}
+
+	return s
+}
+
+// stores returns every storage of the cache: the shared one, then the ones
+// of the tenants.
+func (m *cache) stores() []*volumeSet {
+	stores := make([]*volumeSet, 0, 1+len(m.tenants))
+	stores = append(stores, m.cache)
+
+	for _, s := range m.tenants {
+		stores = append(stores, s)
+	}
+
+	return stores
+}
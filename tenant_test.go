@@ -0,0 +1,194 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCache_ServeHTTP_TenantHeader(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte(req.Header.Get("X-Tenant")))
+	}
+
+	dir := createTempDir(t)
+	cfg := &Config{
+		Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		TenantHeader: "X-Tenant", Tenants: []string{"a", "b", "c"},
+		Admin:        AdminConfig{Path: "/_cache", Tokens: []string{"secret"}},
+		MemoryBudget: 1024, MemoryItemSize: 1024,
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	admin := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/_cache/"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	get("a")
+	get("b")
+
+	tests := []struct {
+		desc   string
+		tenant string
+		state  string
+		body   string
+	}{
+		{desc: "tenant a", tenant: "a", state: cacheHitStatus, body: "a"},
+		{desc: "tenant b", tenant: "b", state: cacheHitStatus, body: "b"},
+		{desc: "new tenant", tenant: "c", state: cacheMissStatus, body: "c"},
+		{desc: "unknown tenant", tenant: "d", state: "", body: "d"},
+		{desc: "no tenant", state: ""},
+	}
+
+	for _, test := range tests {
+		rw := get(test.tenant)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.desc, test.state, state)
+		}
+
+		if body := rw.Body.String(); body != test.body {
+			t.Errorf("%s: unexpected body: want %q, got: %q", test.desc, test.body, body)
+		}
+	}
+
+	// Each tenant has a directory of its own.
+	for _, tenant := range []string{"a", "b"} {
+		files, err := EntryFiles(dir, tenant, "http://localhost/some/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = os.Stat(files[0]); err != nil {
+			t.Errorf("unexpected entry file error of tenant %s: %v", tenant, err)
+		}
+
+		if !strings.HasPrefix(files[0], filepath.Join(dir, tenantDir(tenant))) {
+			t.Errorf("unexpected entry file of tenant %s outside of its directory: %s", tenant, files[0])
+		}
+	}
+
+	for _, query := range []string{"purge?url=/some/path", "purge?url=/some/path&tenant=d", "import"} {
+		if rw := admin(query); rw.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status of %s: want %d, got %d", query, http.StatusBadRequest, rw.Code)
+		}
+	}
+
+	if rw := admin("purge?url=/some/path&tenant=a"); rw.Code != http.StatusOK {
+		t.Fatalf("unexpected purge status: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	if state := get("a").Header().Get("Cache-Status"); state != cacheMissStatus {
+		t.Errorf("unexpected cache state of the purged tenant: want %q, got: %q", cacheMissStatus, state)
+	}
+
+	if state := get("b").Header().Get("Cache-Status"); state != cacheHitStatus {
+		t.Errorf("unexpected cache state of another tenant: want %q, got: %q", cacheHitStatus, state)
+	}
+
+	// Flushes can be scoped to a tenant, in memory too.
+	get("a")
+
+	if rw := admin("flush?tenant=b"); rw.Code != http.StatusOK {
+		t.Fatalf("unexpected flush status: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	memory := h.(*cache).memory
+	for tenant, want := range map[string]bool{"a": true, "b": false} {
+		var found bool
+		for key := range memory.entries {
+			found = found || strings.HasPrefix(key, tenantKey(tenant, ""))
+		}
+
+		if found != want {
+			t.Errorf("unexpected entries of tenant %s kept in memory after the flush: want %t, got %t", tenant, want, found)
+		}
+	}
+
+	for tenant, state := range map[string]string{"a": cacheHitStatus, "b": cacheMissStatus} {
+		if got := get(tenant).Header().Get("Cache-Status"); got != state {
+			t.Errorf("unexpected cache state of tenant %s after the flush: want %q, got: %q", tenant, state, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_TenantClientCert(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+	}
+
+	cfg := &Config{
+		Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true,
+		TenantClientCert: true, Tenants: []string{"a", "b"},
+	}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(cn string) string {
+		req := httptest.NewRequest(http.MethodGet, "https://localhost/some/path", nil)
+		req.TLS = &tls.ConnectionState{}
+		if cn != "" {
+			req.TLS.PeerCertificates = []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}}
+		}
+
+		// The header is ignored when tenants come from client certificates.
+		req.Header.Set("X-Tenant", "a")
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		return rw.Header().Get("Cache-Status")
+	}
+
+	get("a")
+
+	tests := []struct {
+		desc  string
+		cn    string
+		state string
+	}{
+		{desc: "same certificate", cn: "a", state: cacheHitStatus},
+		{desc: "other certificate", cn: "b", state: cacheMissStatus},
+		{desc: "unknown certificate", cn: "c", state: ""},
+		{desc: "no certificate", state: ""},
+	}
+
+	for _, test := range tests {
+		if state := get(test.cn); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.desc, test.state, state)
+		}
+	}
+}
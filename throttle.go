@@ -0,0 +1,115 @@
+package plugin_simplecache
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxThrottleBackoff caps the time the origin is considered throttling after
+// asking to retry later.
+const maxThrottleBackoff = 10 * time.Minute
+
+// maxThrottledHosts bounds the number of hosts an originThrottle tracks. Once
+// it is reached, the hosts no longer throttling are dropped, then all of them
+// if they all still are.
+const maxThrottledHosts = 10000
+
+// errThrottled is set on responses replaced by a stored one because the
+// origin is throttling.
+var errThrottled = errors.New("origin throttling")
+
+// retryAfter returns the time until which a 429 or 503 response with headers
+// h asks clients not to retry, and false for other responses.
+func retryAfter(status int, h http.Header, now time.Time) (time.Time, bool) {
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return time.Time{}, false
+	}
+
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return time.Time{}, false
+	}
+
+	var until time.Time
+
+	if seconds, err := strconv.Atoi(v); err == nil {
+		until = now.Add(time.Duration(seconds) * time.Second)
+	} else if until, err = http.ParseTime(v); err != nil {
+		return time.Time{}, false
+	}
+
+	if !until.After(now) {
+		return time.Time{}, false
+	}
+
+	if limit := now.Add(maxThrottleBackoff); until.After(limit) {
+		until = limit
+	}
+
+	return until, true
+}
+
+// originThrottle tracks, per host, the time until which the origin asked not
+// to be contacted, so that a host throttling does not hold back the others.
+type originThrottle struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newOriginThrottle() *originThrottle {
+	return &originThrottle{until: map[string]time.Time{}}
+}
+
+// Set records that the origin of host is throttling until the given time.
+func (t *originThrottle) Set(host string, until, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cur, ok := t.until[host]
+	if !ok && len(t.until) >= maxThrottledHosts {
+		for h, u := range t.until {
+			if !u.After(now) {
+				delete(t.until, h)
+			}
+		}
+
+		if len(t.until) >= maxThrottledHosts {
+			t.until = map[string]time.Time{}
+		}
+	}
+
+	if until.After(cur) {
+		t.until[host] = until
+	}
+}
+
+// Throttled reports whether the origin of host asked not to be contacted at
+// now.
+func (t *originThrottle) Throttled(host string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return now.Before(t.until[host])
+}
+
+// throttle records that the origin of host is throttling until the given
+// time.
+func (m *cache) throttle(host string, until time.Time) {
+	m.throttles.Set(host, until, m.clock.Now())
+}
+
+// throttled reports whether the origin of host asked not to be contacted at
+// now.
+func (m *cache) throttled(host string, now time.Time) bool {
+	return m.cfg.ThrottleStaleAge.Duration() > 0 && m.throttles.Throttled(host, now)
+}
+
+// throttledFor reports whether the expired entry data of host may be served
+// because its origin is throttling.
+func (m *cache) throttledFor(host string, data *cacheData, now time.Time) bool {
+	return m.throttled(host, now) && now.Sub(data.Expires) <= m.cfg.ThrottleStaleAge.Duration()
+}
@@ -0,0 +1,119 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		desc     string
+		status   int
+		value    string
+		expected time.Time
+		ok       bool
+	}{
+		{desc: "seconds", status: http.StatusServiceUnavailable, value: "30", expected: now.Add(30 * time.Second), ok: true},
+		{
+			desc: "date", status: http.StatusTooManyRequests, value: now.Add(time.Minute).Format(http.TimeFormat),
+			expected: now.Add(time.Minute), ok: true,
+		},
+		{desc: "capped", status: http.StatusTooManyRequests, value: "86400", expected: now.Add(maxThrottleBackoff), ok: true},
+		{desc: "past", status: http.StatusServiceUnavailable, value: "0"},
+		{desc: "invalid", status: http.StatusServiceUnavailable, value: "soon"},
+		{desc: "missing", status: http.StatusServiceUnavailable},
+		{desc: "other status", status: http.StatusInternalServerError, value: "30"},
+	}
+
+	for _, test := range tests {
+		h := http.Header{}
+		if test.value != "" {
+			h.Set("Retry-After", test.value)
+		}
+
+		until, ok := retryAfter(test.status, h, now)
+		if ok != test.ok || !until.Equal(test.expected) {
+			t.Errorf("%s: unexpected result: want %s, %t, got %s, %t", test.desc, test.expected, test.ok, until, ok)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_ThrottleStaleAge(t *testing.T) {
+	var requests int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Header().Set("Retry-After", "30")
+		http.Error(rw, "busy", http.StatusServiceUnavailable)
+	}
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, ThrottleStaleAge: "10m"}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	for u, expired := range map[string]time.Duration{
+		"localhost/recent": time.Minute, "localhost/old": time.Hour, "other.example/recent": time.Minute,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+u, nil)
+		data := &cacheData{Status: http.StatusOK, Expires: time.Now().Add(-expired), Body: []byte("some body")}
+
+		b, err := data.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = c.cache.Set(context.Background(), cacheKey(req), b, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		desc     string
+		host     string
+		path     string
+		status   int
+		state    string
+		requests int
+	}{
+		{desc: "throttling response replaced", path: "/recent", status: http.StatusOK, state: cacheStaleStatus, requests: 1},
+		{desc: "served while throttled", path: "/recent", status: http.StatusOK, state: cacheStaleStatus, requests: 1},
+		{desc: "too old", path: "/old", status: http.StatusServiceUnavailable, state: cacheMissStatus, requests: 2},
+		{desc: "not stored", path: "/none", status: http.StatusServiceUnavailable, state: cacheMissStatus, requests: 3},
+		{
+			desc: "other host", host: "other.example", path: "/recent",
+			status: http.StatusOK, state: cacheStaleStatus, requests: 4,
+		},
+	}
+
+	for _, test := range tests {
+		host := test.host
+		if host == "" {
+			host = "localhost"
+		}
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://"+host+test.path, nil))
+
+		if rw.Code != test.status {
+			t.Errorf("%s: unexpected status: want %d, got %d", test.desc, test.status, rw.Code)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != test.state {
+			t.Errorf("%s: unexpected cache state: want %q, got: %q", test.desc, test.state, state)
+		}
+
+		if requests != test.requests {
+			t.Errorf("%s: unexpected origin requests: want %d, got %d", test.desc, test.requests, requests)
+		}
+	}
+}
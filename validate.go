@@ -0,0 +1,257 @@
+package plugin_simplecache
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configErrors lists the problems found in a configuration, so that they are
+// all reported at once.
+type configErrors []error
+
+func (e configErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// add records err, if any.
+func (e *configErrors) add(err error) {
+	if err == nil {
+		return
+	}
+
+	var errs configErrors
+	if errors.As(err, &errs) {
+		*e = append(*e, errs...)
+		return
+	}
+
+	*e = append(*e, err)
+}
+
+// err returns the recorded problems as an error, or nil if there are none.
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// validateConfig checks the configuration values New cannot default. Every
+// problem found is reported.
+func validateConfig(cfg *Config) error {
+	var errs configErrors
+
+	validateDurations(cfg, &errs)
+	validateRanges(cfg, &errs)
+	validateOptions(cfg, &errs)
+
+	errs.add(validateTypeTTLs(cfg.TypeTTLs))
+	errs.add(validateCacheControlRules(cfg.ClientCacheControl))
+
+	if _, err := parseNetworks(cfg.BotNetworks); err != nil {
+		errs.add(fmt.Errorf("botNetworks: %w", err))
+	}
+
+	errs.add(cfg.Admin.validate())
+	errs.add(cfg.Replication.validate())
+	errs.add(newRuleSet(cfg).validate())
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errs)
+	}
+
+	return nil
+}
+
+// validateDurations checks the syntax of the configured durations.
+func validateDurations(cfg *Config, errs *configErrors) {
+	durations := map[string]Duration{
+		"maxExpiry":        cfg.MaxExpiry,
+		"cleanup":          cfg.Cleanup,
+		"negativeTtl":      cfg.NegativeTTL,
+		"gracePeriod":      cfg.GracePeriod,
+		"refreshWindow":    cfg.RefreshWindow,
+		"rulesReload":      cfg.RulesReload,
+		"admissionWindow":  cfg.AdmissionWindow,
+		"seedTtl":          cfg.SeedTTL,
+		"admissionLatency": cfg.AdmissionLatency,
+		"microCacheTtl":    cfg.MicroCacheTTL,
+		"maxStaleAge":      cfg.MaxStaleAge,
+		"throttleStaleAge": cfg.ThrottleStaleAge,
+		"offlineStaleAge":  cfg.OfflineStaleAge,
+		"breakerWindow":    cfg.BreakerWindow,
+		"breakerCooldown":  cfg.BreakerCooldown,
+	}
+
+	names := make([]string, 0, len(durations))
+	for name := range durations {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := durations[name].parse(); err != nil {
+			errs.add(fmt.Errorf("invalid %s: %w", name, err))
+		}
+	}
+}
+
+// validateRanges checks that the numeric values are within their bounds.
+func validateRanges(cfg *Config, errs *configErrors) {
+	if d := cfg.MaxExpiry.Duration(); d < 0 || d > 0 && d < time.Second {
+		errs.add(errors.New("maxExpiry must be greater or equal to 1, or 0 for no maximum"))
+	}
+
+	if d := cfg.Cleanup.Duration(); d > 0 && d < time.Second {
+		errs.add(errors.New("cleanup must be greater or equal to 1, or 0 to disable the vacuum"))
+	}
+
+	nonNegative := []struct {
+		name string
+		d    Duration
+	}{
+		{"negativeTtl", cfg.NegativeTTL},
+		{"gracePeriod", cfg.GracePeriod},
+		{"refreshWindow", cfg.RefreshWindow},
+		{"rulesReload", cfg.RulesReload},
+		{"admissionWindow", cfg.AdmissionWindow},
+		{"admissionLatency", cfg.AdmissionLatency},
+		{"microCacheTtl", cfg.MicroCacheTTL},
+		{"maxStaleAge", cfg.MaxStaleAge},
+		{"throttleStaleAge", cfg.ThrottleStaleAge},
+		{"offlineStaleAge", cfg.OfflineStaleAge},
+		{"breakerWindow", cfg.BreakerWindow},
+		{"breakerCooldown", cfg.BreakerCooldown},
+	}
+
+	for _, v := range nonNegative {
+		if v.d.Duration() < 0 {
+			errs.add(fmt.Errorf("%s must be greater or equal to 0", v.name))
+		}
+	}
+
+	if cfg.SigningKey != "" && len(cfg.SigningKey) < minSigningKeySize {
+		errs.add(fmt.Errorf("signingKey must be at least %d bytes long", minSigningKeySize))
+	}
+
+	if cfg.BreakerErrorRate < 0 || cfg.BreakerErrorRate > 1 {
+		errs.add(errors.New("breakerErrorRate must be between 0 and 1"))
+	}
+
+	if cfg.BreakerRequests < 0 {
+		errs.add(errors.New("breakerRequests must be greater or equal to 0"))
+	}
+
+	if cfg.AdmissionSampleRate < 0 || cfg.AdmissionSampleRate > 1 {
+		errs.add(errors.New("admissionSampleRate must be between 0 and 1"))
+	}
+
+	if s := cfg.MaintenanceStatus; s != 0 && (s < 100 || s > 599) {
+		errs.add(fmt.Errorf("invalid maintenanceStatus %d: must be an HTTP status code", s))
+	}
+}
+
+// validateOptions checks the enumerated values and the combinations of
+// options which cannot work together.
+func validateOptions(cfg *Config, errs *configErrors) {
+	switch cfg.OnError {
+	case "", failOpen, failClosed:
+	default:
+		errs.add(fmt.Errorf("invalid onError %q: must be %q or %q", cfg.OnError, failOpen, failClosed))
+	}
+
+	if cfg.SeedPath != "" && (cfg.SeedHost == "" || cfg.SeedTTL.Duration() <= 0) {
+		errs.add(errors.New("seedPath requires a seedHost and a seedTtl greater than 0"))
+	}
+
+	if cfg.SeedPath != "" && cfg.ReadOnly {
+		errs.add(errors.New("seedPath cannot be used with readOnly, the cache is never written"))
+	}
+
+	if cfg.BypassToken != "" && cfg.BypassHeader == "" {
+		errs.add(errors.New("bypassToken requires a bypassHeader"))
+	}
+
+	if cfg.DryRun && cfg.Maintenance {
+		errs.add(errors.New("dryRun cannot be used with maintenance, dry runs always contact the origin"))
+	}
+
+	switch cfg.ExpiryBuckets {
+	case "", bucketsHour, bucketsDay:
+	default:
+		errs.add(fmt.Errorf("invalid expiryBuckets %q: must be %q or %q", cfg.ExpiryBuckets, bucketsHour, bucketsDay))
+	}
+
+	validateTenancy(cfg, errs)
+	validatePaths(cfg, errs)
+}
+
+// validatePaths checks that the cache paths are set either way, and that each
+// is listed once.
+func validatePaths(cfg *Config, errs *configErrors) {
+	if len(cfg.Paths) == 0 {
+		return
+	}
+
+	if cfg.Path != "" {
+		errs.add(errors.New("path cannot be used with paths"))
+	}
+
+	seen := make(map[string]bool, len(cfg.Paths))
+	for _, p := range cfg.Paths {
+		if seen[filepath.Clean(p)] {
+			errs.add(fmt.Errorf("duplicate path %q in paths", p))
+		}
+
+		seen[filepath.Clean(p)] = true
+	}
+}
+
+// validateTenancy checks that the tenant has a single source, that the
+// tenants are listed, and that no option stores entries outside of the tenant
+// partitions.
+func validateTenancy(cfg *Config, errs *configErrors) {
+	if cfg.TenantHeader == "" && !cfg.TenantClientCert {
+		if len(cfg.Tenants) > 0 {
+			errs.add(errors.New("tenants requires tenantHeader or tenantClientCert"))
+		}
+
+		return
+	}
+
+	if len(cfg.Tenants) == 0 {
+		errs.add(errors.New("tenantHeader and tenantClientCert require the tenants to be listed in tenants"))
+	}
+
+	seen := make(map[string]bool, len(cfg.Tenants))
+
+	for _, tenant := range cfg.Tenants {
+		switch {
+		case tenant == "":
+			errs.add(errors.New("empty tenant in tenants"))
+		case seen[tenant]:
+			errs.add(fmt.Errorf("duplicate tenant %q in tenants", tenant))
+		}
+
+		seen[tenant] = true
+	}
+
+	if cfg.TenantHeader != "" && cfg.TenantClientCert {
+		errs.add(errors.New("tenantHeader cannot be used with tenantClientCert"))
+	}
+
+	if cfg.SeedPath != "" || len(cfg.WarmupURLs) > 0 || cfg.WarmupFile != "" {
+		errs.add(errors.New("seedPath and warmup cannot be used with tenants, their entries belong to no tenant"))
+	}
+}
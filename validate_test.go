@@ -0,0 +1,65 @@
+package plugin_simplecache
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	cfg := &Config{
+		MaxExpiry:           "-1",
+		Cleanup:             "soon",
+		GracePeriod:         "-5m",
+		MicroCacheTTL:       "-1",
+		ThrottleStaleAge:    "-10m",
+		BreakerCooldown:     "-30s",
+		AdmissionSampleRate: 2,
+		OnError:             "sometimes",
+		BypassToken:         "secret",
+		BotNetworks:         []string{"10.0.0.0/33"},
+		BypassCookies:       []string{"session["},
+		TTLRules:            []TTLRule{{Path: "/static/*", TTL: "-1h"}},
+		Hosts: []HostConfig{{
+			Hosts: []string{"example.com"}, BypassCookies: []string{"cart["},
+			TTLRules: []TTLRule{{Path: "/news/*", TTL: "-60"}},
+		}},
+	}
+
+	err := validateConfig(cfg)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	want := []string{
+		"invalid cleanup",
+		"maxExpiry must be greater or equal to 1",
+		"gracePeriod must be greater or equal to 0",
+		"microCacheTtl must be greater or equal to 0",
+		"throttleStaleAge must be greater or equal to 0",
+		"breakerCooldown must be greater or equal to 0",
+		"admissionSampleRate must be between 0 and 1",
+		`invalid onError "sometimes"`,
+		"bypassToken requires a bypassHeader",
+		"botNetworks: invalid network",
+		`invalid bypass cookie "session["`,
+		`hosts ["example.com"]: invalid bypass cookie "cart["`,
+		`ttl of rule "/static/*" must be greater or equal to 0`,
+		`hosts ["example.com"]: ttl of rule "/news/*" must be greater or equal to 0`,
+	}
+
+	for _, msg := range want {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("missing problem %q in error: %v", msg, err)
+		}
+	}
+
+	if n := strings.Count(err.Error(), "; ") + 1; n != len(want) {
+		t.Errorf("unexpected number of problems: want %d, got %d: %v", len(want), n, err)
+	}
+}
+
+func TestValidateConfig_Valid(t *testing.T) {
+	if err := validateConfig(CreateConfig()); err != nil {
+		t.Errorf("unexpected error for the default configuration: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// volumeCheckInterval is the interval between two probes of the cache paths,
+// when there are several of them.
+const volumeCheckInterval = 10 * time.Second
+
+// volumeSet spreads the entries across the file caches of several paths,
+// usually on different disks. Every key is stored on one of them, picked by
+// rendezvous hashing of the key hash, so that adding or removing a path only
+// moves the entries of this path. Paths failing their probe are skipped until
+// they recover, their entries going to the next path in the key order.
+type volumeSet struct {
+	volumes []*fileCache
+
+	// down holds 1 for every volume failing its probe.
+	down []int32
+}
+
+// newVolumeSet returns the file caches of paths, partitioned by buckets if
+// set, vacuumed every vacuum interval and probed every volumeCheckInterval,
+// until ctx is done.
+func newVolumeSet(ctx context.Context, paths []string, vacuum time.Duration, parallelism int,
+	buckets *expiryBuckets, clk clock) (*volumeSet, error) {
+	s := &volumeSet{down: make([]int32, len(paths))}
+
+	for _, p := range paths {
+		fc, err := newFileCache(ctx, p, vacuum, parallelism, buckets, clk)
+		if err != nil {
+			return nil, err
+		}
+
+		s.volumes = append(s.volumes, fc)
+	}
+
+	if len(s.volumes) > 1 {
+		go s.watch(ctx)
+	}
+
+	return s, nil
+}
+
+// For returns the file cache storing the entry of key.
+func (s *volumeSet) For(key string) *fileCache {
+	if len(s.volumes) == 1 {
+		return s.volumes[0]
+	}
+
+	return s.pick(keyHash(key))
+}
+
+// pick returns the healthy volume with the highest weight for the key hash
+// h, or the one with the highest weight if every volume is down.
+func (s *volumeSet) pick(h [4]byte) *fileCache {
+	best, bestUp := -1, -1
+
+	var weight, weightUp uint64
+
+	for i, v := range s.volumes {
+		w := volumeWeight(v.path, h)
+
+		if best < 0 || w > weight {
+			best, weight = i, w
+		}
+
+		if atomic.LoadInt32(&s.down[i]) == 0 && (bestUp < 0 || w > weightUp) {
+			bestUp, weightUp = i, w
+		}
+	}
+
+	if bestUp >= 0 {
+		return s.volumes[bestUp]
+	}
+
+	return s.volumes[best]
+}
+
+// volumeWeight returns the weight of the volume at path for the key hash h.
+func volumeWeight(path string, h [4]byte) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(path))
+	_, _ = f.Write(h[:])
+
+	return f.Sum64()
+}
+
+// TempDir returns the directory of the temporary files, such as spilled
+// response bodies: the first path which is not down.
+func (s *volumeSet) TempDir() string {
+	for i, v := range s.volumes {
+		if atomic.LoadInt32(&s.down[i]) == 0 {
+			return v.path
+		}
+	}
+
+	return s.volumes[0].path
+}
+
+func (s *volumeSet) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.For(key).Get(ctx, key)
+}
+
+func (s *volumeSet) Open(ctx context.Context, key string) (*fileEntry, error) {
+	return s.For(key).Open(ctx, key)
+}
+
+func (s *volumeSet) Set(ctx context.Context, key string, val []byte, expiry time.Duration) error {
+	return s.For(key).Set(ctx, key, val, expiry)
+}
+
+func (s *volumeSet) SetParts(ctx context.Context, key string, parts [][]byte, expiry time.Duration) error {
+	return s.For(key).SetParts(ctx, key, parts, expiry)
+}
+
+func (s *volumeSet) SetFrom(ctx context.Context, key string, r io.Reader, expiry time.Duration) error {
+	return s.For(key).SetFrom(ctx, key, r, expiry)
+}
+
+// Delete deletes the entry of key from every volume, as it may have been
+// stored on another one while its volume was down.
+func (s *volumeSet) Delete(key string) error {
+	var err error
+
+	for _, v := range s.volumes {
+		if derr := v.Delete(key); derr != nil && err == nil {
+			err = derr
+		}
+	}
+
+	return err
+}
+
+// Has reports whether any volume holds a file for the entry of key, expired or
+// not.
+func (s *volumeSet) Has(key string) bool {
+	for _, v := range s.volumes {
+		if v.has(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Flush deletes every entry of every volume.
+func (s *volumeSet) Flush() (vacuumStats, error) {
+	var total vacuumStats
+
+	for _, v := range s.volumes {
+		stats, err := v.Flush()
+		if err != nil {
+			return total, err
+		}
+
+		total.merge(stats)
+	}
+
+	return total, nil
+}
+
+// Retain keeps the expired entries of every volume while on.
+func (s *volumeSet) Retain(on bool) {
+	for _, v := range s.volumes {
+		v.Retain(on)
+	}
+}
+
+// TriggerVacuum starts a vacuum pass of every volume. It reports false if the
+// vacuum is disabled.
+func (s *volumeSet) TriggerVacuum() bool {
+	var ok bool
+
+	for _, v := range s.volumes {
+		ok = v.TriggerVacuum()
+	}
+
+	return ok
+}
+
+// LastVacuum returns the merged statistics of the last completed vacuum pass
+// of every volume, which ran concurrently.
+func (s *volumeSet) LastVacuum() vacuumStats {
+	var total vacuumStats
+
+	for i, v := range s.volumes {
+		stats := v.LastVacuum()
+		if i == 0 || stats.Start.Before(total.Start) {
+			total.Start = stats.Start
+		}
+
+		if stats.Duration > total.Duration {
+			total.Duration = stats.Duration
+		}
+
+		total.merge(stats)
+	}
+
+	return total
+}
+
+// watch probes every volume every volumeCheckInterval until ctx is done.
+func (s *volumeSet) watch(ctx context.Context) {
+	ticker := time.NewTicker(volumeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Check(ctx)
+		}
+	}
+}
+
+// Check probes every volume, marking the failing ones down and the others up,
+// and returns the error of each.
+func (s *volumeSet) Check(ctx context.Context) []error {
+	errs := make([]error, len(s.volumes))
+
+	for i, v := range s.volumes {
+		errs[i] = v.Probe(ctx)
+		if ctx.Err() != nil {
+			// The probe was aborted, which tells nothing of the volume.
+			continue
+		}
+
+		switch {
+		case errs[i] != nil && atomic.CompareAndSwapInt32(&s.down[i], 0, 1):
+			if len(s.volumes) > 1 {
+				log.Printf("Cache path %q failing, its entries go to the other paths: %v", v.path, errs[i])
+			}
+		case errs[i] == nil && atomic.CompareAndSwapInt32(&s.down[i], 1, 0):
+			if len(s.volumes) > 1 {
+				log.Printf("Cache path %q recovered", v.path)
+			}
+		}
+	}
+
+	return errs
+}
+
+// volumeOf returns the volume storing the snapshot entry of the given name,
+// relative to a cache path, which must be accepted by snapshotName.
+func (s *volumeSet) volumeOf(name string) *fileCache {
+	if len(s.volumes) == 1 {
+		return s.volumes[0]
+	}
+
+	var h [4]byte
+
+	// The name starts with the hex encoded bytes of the key hash, one
+	// directory each.
+	for i := range h {
+		b, _ := hex.DecodeString(name[i*3 : i*3+2])
+		h[i] = b[0]
+	}
+
+	return s.pick(h)
+}
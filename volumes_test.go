@@ -0,0 +1,156 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestVolumeSet_For(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	paths := []string{createTempDir(t), createTempDir(t), createTempDir(t)}
+
+	s, err := newVolumeSet(ctx, paths[:2], 0, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grown, err := newVolumeSet(ctx, paths, 0, 1, nil, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("GETlocalhost/%d", i)
+
+		before, after := s.For(key).path, grown.For(key).path
+		counts[before]++
+
+		// Adding a path only moves entries to it.
+		if after != before && after != paths[2] {
+			t.Errorf("%s: unexpected move from %s to %s", key, before, after)
+		}
+	}
+
+	for _, p := range paths[:2] {
+		if counts[p] < 400 {
+			t.Errorf("unexpected share of entries on %s: got %d of 1000", p, counts[p])
+		}
+	}
+
+	// The entries of a volume down go to the others, the other entries stay.
+	grown.down[0] = 1
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("GETlocalhost/%d", i)
+
+		before := s.For(key).path
+
+		got := grown.For(key).path
+		if got == paths[0] {
+			t.Fatalf("%s: unexpected volume down", key)
+		}
+
+		if before != paths[0] && got != before && got != paths[2] {
+			t.Errorf("%s: unexpected move from %s to %s", key, before, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTP_Paths(t *testing.T) {
+	var requests int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("body of " + req.URL.Path))
+	}
+
+	paths := []string{createTempDir(t), createTempDir(t)}
+
+	cfg := &Config{Paths: paths, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, HealthPath: "/_health"}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		for _, want := range []string{cacheMissStatus, cacheHitStatus} {
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost/%d", i), nil))
+
+			if state := rw.Header().Get("Cache-Status"); state != want {
+				t.Errorf("/%d: unexpected cache state: want %q, got: %q", i, want, state)
+			}
+		}
+	}
+
+	if requests != 20 {
+		t.Errorf("unexpected origin requests: want 20, got %d", requests)
+	}
+
+	for _, p := range paths {
+		infos, err := ioutil.ReadDir(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(infos) == 0 {
+			t.Errorf("unexpected empty path %s", p)
+		}
+	}
+
+	// A path gone leaves the cache degraded, its entries going to the other.
+	if err = os.RemoveAll(paths[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/_health", nil))
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected health status: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	h.(*cache).serveStats(rw, httptest.NewRequest(http.MethodGet, "http://localhost/_cache/stats", nil))
+
+	var status healthStatus
+	if err = json.Unmarshal(rw.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Status != "degraded" || len(status.Volumes) != 2 || status.Volumes[0].Status != "error" {
+		t.Errorf("unexpected health report: %s", rw.Body.String())
+	}
+
+	for i := 0; i < 20; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost/%d", i), nil))
+
+		rw = httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost/%d", i), nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != cacheHitStatus {
+			t.Errorf("/%d: unexpected cache state after failover: want %q, got: %q", i, cacheHitStatus, state)
+		}
+	}
+
+	infos, err := ioutil.ReadDir(paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) == 0 {
+		t.Error("unexpected empty remaining path")
+	}
+}
@@ -0,0 +1,70 @@
+package plugin_simplecache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// warmupURLs returns the configured warmup URLs, including the ones listed
+// in the warmup file.
+func warmupURLs(cfg *Config) ([]string, error) {
+	urls := append([]string{}, cfg.WarmupURLs...)
+
+	if cfg.WarmupFile == "" {
+		return urls, nil
+	}
+
+	f, err := os.Open(filepath.Clean(cfg.WarmupFile))
+	if err != nil {
+		return nil, fmt.Errorf("error opening warmup file: %w", err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		urls = append(urls, line)
+	}
+
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading warmup file: %w", err)
+	}
+
+	return urls, nil
+}
+
+// warmup requests every URL through the middleware, so that they are cached
+// before real traffic arrives.
+func (m *cache) warmup(ctx context.Context, urls []string) {
+	var warmed int
+
+	for _, u := range urls {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			log.Printf("Invalid warmup URL %q: %v", u, err)
+			continue
+		}
+
+		w := newDiscardWriter()
+		m.ServeHTTP(w, req)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		warmed++
+	}
+
+	log.Printf("Cache warmup done: %d of %d URLs requested", warmed, len(urls))
+}
@@ -0,0 +1,61 @@
+package plugin_simplecache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWarmupURLs(t *testing.T) {
+	dir := createTempDir(t)
+
+	file := filepath.Join(dir, "warmup.txt")
+	content := "# critical pages\nhttp://localhost/b\n\n  http://localhost/c  \n"
+
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	urls, err := warmupURLs(&Config{WarmupURLs: []string{"http://localhost/a"}, WarmupFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"http://localhost/a", "http://localhost/b", "http://localhost/c"}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("unexpected warmup URLs: want %v, got %v", want, urls)
+	}
+
+	if _, err = warmupURLs(&Config{WarmupFile: filepath.Join(dir, "missing.txt")}); err == nil {
+		t.Error("expected error on missing warmup file")
+	}
+}
+
+func TestCache_Warmup(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.(*cache).warmup(context.Background(), []string{"http://localhost/some/path"})
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	if state := rw.Header().Get("Cache-Status"); state != "hit" {
+		t.Errorf("unexpected cache state: want \"hit\", got: %q", state)
+	}
+}